@@ -0,0 +1,227 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"message_handler/status"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxBodySize bounds JSON request bodies that set no limit of their own
+	maxBodySize = 1 << 20
+
+	// BatchEntrySize is the room a batch request body gets per message
+	BatchEntrySize = 16 << 10
+)
+
+// Error is a structured API error. Status is the HTTP status it is sent
+// with; Field names the request field at fault, if any.
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// Errorf creates an error for field, which may be empty
+func Errorf(status int, code, field, format string, args ...any) *Error {
+	return &Error{Status: status, Code: code, Message: fmt.Sprintf(format, args...), Field: field}
+}
+
+// Accepted is the answer to a message that was queued or scheduled
+type Accepted struct {
+	ID     string       `json:"id"`
+	Status status.State `json:"status"`
+	SendAt *time.Time   `json:"send_at,omitempty"`
+}
+
+// NewAccepted describes a message that is queued, or scheduled if sendAt
+// is set
+func NewAccepted(id string, sendAt time.Time) Accepted {
+	if sendAt.IsZero() {
+		return Accepted{ID: id, Status: status.Queued}
+	}
+	sendAt = sendAt.UTC()
+	return Accepted{ID: id, Status: status.Scheduled, SendAt: &sendAt}
+}
+
+// BatchResult is the outcome of one message of a batch, identified by its
+// position in the request
+type BatchResult struct {
+	Index int `json:"index"`
+	*Accepted
+	Error *Error `json:"error,omitempty"`
+}
+
+// BatchResponse answers a batch request. An accepted batch has a result
+// for every message; a rejected one has an error code and message and the
+// results of the messages at fault.
+type BatchResponse struct {
+	Code    string        `json:"code,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Results []BatchResult `json:"results"`
+}
+
+// InvalidBatch rejects a batch of total messages because of the invalid
+// ones
+func InvalidBatch(invalid []BatchResult, total int) BatchResponse {
+	return BatchResponse{
+		Code:    "invalid_batch",
+		Message: fmt.Sprintf("%d of %d messages are invalid, none were sent", len(invalid), total),
+		Results: invalid,
+	}
+}
+
+// WriteJSON writes v as a JSON response
+func WriteJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// WriteError writes e as a JSON error response
+func WriteError(w http.ResponseWriter, e *Error) {
+	w.Header().Del("X-Content-Type-Options")
+	WriteJSON(w, e.Status, e)
+}
+
+// Decode reads a JSON request body of at most maxBytes into v; 0 uses a
+// default limit. Bodies that are not JSON, too large, or have unknown
+// fields are rejected.
+func Decode(w http.ResponseWriter, r *http.Request, v any, maxBytes int64) *Error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return Errorf(http.StatusUnsupportedMediaType, "unsupported_media_type", "", "Content-Type must be application/json")
+	}
+	if maxBytes <= 0 {
+		maxBytes = maxBodySize
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &tooLarge):
+			return Errorf(http.StatusRequestEntityTooLarge, "request_too_large", "", "Request body exceeds %d bytes", maxBytes)
+		case errors.As(err, &typeErr):
+			return Errorf(http.StatusBadRequest, "invalid_field", typeErr.Field, "%s must be a JSON %s", typeErr.Field, typeErr.Type.Kind())
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+			return Errorf(http.StatusBadRequest, "unknown_field", field, "Unknown field %q", field)
+		default:
+			return Errorf(http.StatusBadRequest, "invalid_json", "", "Request body is not valid JSON: %v", err)
+		}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return Errorf(http.StatusBadRequest, "invalid_json", "", "Request body must hold a single JSON value")
+	}
+	return nil
+}
+
+// Middleware serves the JSON API: it rejects requests that do not accept
+// a JSON response, and turns the plain-text errors of the handlers and
+// middleware it wraps (authentication, rate limiting, routing) into JSON
+// errors.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsJSON(r.Header.Get("Accept")) {
+			WriteError(w, Errorf(http.StatusNotAcceptable, "not_acceptable", "", "Responses are application/json"))
+			return
+		}
+
+		ew := &errorWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		if ew.status != 0 {
+			message := strings.TrimSpace(ew.body.String())
+			if message == "" {
+				message = http.StatusText(ew.status)
+			}
+			WriteError(w, &Error{Status: ew.status, Code: statusCode(ew.status), Message: message})
+		}
+	})
+}
+
+// errorWriter holds back plain-text error responses so Middleware can
+// send them as JSON
+type errorWriter struct {
+	http.ResponseWriter
+	status int // set while a plain-text error is held back
+	body   bytes.Buffer
+}
+
+func (w *errorWriter) WriteHeader(code int) {
+	if code >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.status = code
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorWriter) Write(b []byte) (int, error) {
+	if w.status != 0 {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// statusCode names the errors that come as plain text
+func statusCode(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	}
+	if status >= 500 {
+		return "internal_error"
+	}
+	return "bad_request"
+}
+
+// acceptsJSON reports whether an Accept header allows application/json
+func acceptsJSON(accept string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			continue
+		}
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
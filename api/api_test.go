@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func jsonRequest(body, contentType string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/sms", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	return req
+}
+
+// TestDecode tests the checks on JSON request bodies.
+func TestDecode(t *testing.T) {
+	type request struct {
+		Phone string `json:"phone"`
+		Count int    `json:"count"`
+	}
+	tests := []struct {
+		name, body, contentType string
+		status                  int
+		code, field             string
+	}{
+		{"valid", `{"phone": "+31612345678", "count": 2}`, "application/json; charset=utf-8", 0, "", ""},
+		{"form body", `phone=1`, "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType, "unsupported_media_type", ""},
+		{"unknown field", `{"phone": "1", "mesage": "Hi"}`, "application/json", http.StatusBadRequest, "unknown_field", "mesage"},
+		{"wrong type", `{"count": "2"}`, "application/json", http.StatusBadRequest, "invalid_field", "count"},
+		{"broken", `{"phone": `, "application/json", http.StatusBadRequest, "invalid_json", ""},
+		{"two values", `{} {}`, "application/json", http.StatusBadRequest, "invalid_json", ""},
+		{"too large", `{"phone": "` + strings.Repeat("1", 100) + `"}`, "application/json", http.StatusRequestEntityTooLarge, "request_too_large", ""},
+	}
+	for _, tt := range tests {
+		var req request
+		err := Decode(httptest.NewRecorder(), jsonRequest(tt.body, tt.contentType), &req, 64)
+		if tt.status == 0 {
+			if err != nil || req.Phone != "+31612345678" || req.Count != 2 {
+				t.Errorf("%s: unexpected result %+v, %v", tt.name, req, err)
+			}
+			continue
+		}
+		if err == nil || err.Status != tt.status || err.Code != tt.code || err.Field != tt.field {
+			t.Errorf("%s: expected %d %s %q, got %+v", tt.name, tt.status, tt.code, tt.field, err)
+		}
+	}
+}
+
+// TestMiddleware tests content negotiation and the conversion of
+// plain-text errors.
+func TestMiddleware(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/api/v1/invalid" {
+			WriteError(w, Errorf(http.StatusBadRequest, "invalid_phone", "phone", "Invalid phone number format"))
+			return
+		}
+		WriteJSON(w, http.StatusAccepted, map[string]string{"id": "msg"})
+	}))
+
+	tests := []struct {
+		name, path, accept, key string
+		status                  int
+		body                    string
+	}{
+		{"plain-text error", "/api/v1/sms", "", "", http.StatusUnauthorized, `{"code":"unauthorized","message":"Unauthorized"}`},
+		{"JSON error", "/api/v1/invalid", "application/json", "key", http.StatusBadRequest, `{"code":"invalid_phone","message":"Invalid phone number format","field":"phone"}`},
+		{"success", "/api/v1/sms", "text/html, */*;q=0.1", "key", http.StatusAccepted, `{"id":"msg"}`},
+		{"not acceptable", "/api/v1/sms", "text/html, application/json;q=0", "key", http.StatusNotAcceptable, `{"code":"not_acceptable","message":"Responses are application/json"}`},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		req.Header.Set("Accept", tt.accept)
+		req.Header.Set("Authorization", tt.key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status || strings.TrimSpace(rr.Body.String()) != tt.body {
+			t.Errorf("%s: expected %d %s, got %d %s", tt.name, tt.status, tt.body, rr.Code, rr.Body.String())
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: expected a JSON response, got %s", tt.name, ct)
+		}
+		if !json.Valid(rr.Body.Bytes()) {
+			t.Errorf("%s: invalid JSON %s", tt.name, rr.Body.String())
+		}
+	}
+}
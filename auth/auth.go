@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+)
+
+// Keys holds the API keys that may use the service, each under a name.
+// Names identify the caller, e.g. to restrict which sender profiles it
+// may use, without handling the key itself.
+type Keys struct {
+	keys map[string]string // name -> key
+}
+
+// NewKeys creates a key set from a map of names to keys
+func NewKeys(keys map[string]string) *Keys {
+	return &Keys{keys: keys}
+}
+
+// Lookup returns the name of key. Keys are compared in constant time.
+func (k *Keys) Lookup(key string) (string, bool) {
+	for name, candidate := range k.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(candidate)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+type callerKey struct{}
+
+// WithCaller returns a context carrying the name of the API key that made
+// the request
+func WithCaller(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, callerKey{}, name)
+}
+
+// Caller returns the name of the API key that made the request, or "" if
+// the request was not authenticated
+func Caller(r *http.Request) string {
+	name, _ := r.Context().Value(callerKey{}).(string)
+	return name
+}
+
+// Authenticate looks up the key in the Authorization header. On success it
+// returns the request with the key's name attached for Caller.
+func (k *Keys) Authenticate(r *http.Request) (*http.Request, bool) {
+	name, ok := k.Lookup(r.Header.Get("Authorization"))
+	if !ok {
+		return r, false
+	}
+	return r.WithContext(WithCaller(r.Context(), name)), true
+}
@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKeysAuthenticate(t *testing.T) {
+	keys := NewKeys(map[string]string{"billing": "key-1", "monitoring": "key-2"})
+
+	req := httptest.NewRequest("GET", "/inbox", nil)
+	req.Header.Set("Authorization", "key-2")
+	req, ok := keys.Authenticate(req)
+	if !ok || Caller(req) != "monitoring" {
+		t.Errorf("Expected monitoring, got %q (ok %v)", Caller(req), ok)
+	}
+
+	req = httptest.NewRequest("GET", "/inbox", nil)
+	req.Header.Set("Authorization", "key-3")
+	if _, ok := keys.Authenticate(req); ok {
+		t.Error("Unknown key was accepted")
+	}
+	if Caller(req) != "" {
+		t.Errorf("Expected no caller for an unauthenticated request, got %q", Caller(req))
+	}
+}
@@ -1,15 +1,63 @@
 package config
 
+import (
+	"message_handler/retry"
+	"message_handler/sms"
+	"time"
+)
+
+// MailProfile is a named sender identity for email
+type MailProfile struct {
+	Name        string
+	Address     string // From address
+	DisplayName string // Shown with the address, e.g. "Billing"
+	SMTPHost    string // Dedicated SMTP server; empty uses SMTP_HOST
+	SMTPPort    int    // Dedicated SMTP port; 0 uses SMTP_PORT
+	SMTPUser    string // Dedicated SMTP login; empty uses SMTP_USER and SMTP_PASS
+	SMTPPass    string
+	APIKeys     []string // Names of the API keys that may send as this profile; empty allows all
+}
+
 type AppConfig struct {
-	ServerPort   string
-	RateLimit    float64 // Requests per second
-	BurstLimit   int     // Burst requests allowed
-	SMTPHost     string
-	SMTPPort     int
-	SMTPUser     string
-	SMTPPass     string
-	DevicePath   string // Path to the serial device
-	MaxQueueSize int    // Maximum SMS queue size
-	SMSProvider string // "hardware" or "twilio"
-	SerialBaud int // Baud rate for hardware modem
+	ServerPort                 string
+	RateLimit                  float64 // Requests per second
+	BurstLimit                 int     // Burst requests allowed
+	SMTPHost                   string
+	SMTPPort                   int
+	SMTPUser                   string
+	SMTPPass                   string
+	ModemDevices               []string         // Serial devices of the modem pool
+	ModemStrategy              string           // "round-robin" or "least-busy"
+	ModemRateLimit             float64          // Messages per minute per modem; 0 means unlimited
+	MaxQueueSize               int              // Maximum SMS queue size
+	SMSProviders               []string         // Ordered failover chain of "hardware" and/or "twilio"
+	SMSBreakerThreshold        int              // Consecutive failures before a provider is skipped
+	SMSBreakerCooldown         time.Duration    // How long a failing provider is skipped
+	SerialBaud                 int              // Baud rate for hardware modem
+	ModemMode                  string           // "text" or "pdu"
+	ModemTimeout               time.Duration    // How long to wait for the modem to answer a command
+	ModemSendTimeout           time.Duration    // How long to wait for the network to accept an SMS
+	ModemPollInterval          time.Duration    // How often the signal and registration of each modem are checked
+	ModemProfile               sms.ModemProfile // SIM PIN, SMSC, character set and storage set on each modem
+	DeliveryReports            bool             // Request delivery reports for SMS sent through the modem
+	InboxWebhookURL            string           // Incoming SMS are POSTed here as JSON; empty disables forwarding
+	InboxPollInterval          time.Duration    // How often the modem storage is checked for incoming SMS
+	InboxSize                  int              // Number of incoming SMS kept for GET /inbox
+	SMSMaxSegments             int              // Maximum number of segments per SMS accepted by /send-sms
+	QueueDir                   string           // Directory for the SMS journal; empty keeps the queue in memory only
+	ScheduleDir                string           // Directory for messages waiting for their send_at time
+	TemplateDir                string           // Directory for the message templates
+	TemplateDefaultLocale      string           // Template variant used when none suits the recipient
+	BatchMaxSize               int              // Most messages in one batch request
+	IdempotencyTTL             time.Duration    // How long responses to requests with an Idempotency-Key are kept
+	MailQueueSize              int              // Maximum email queue size
+	MailMaxAttachmentSize      int64            // Largest file accepted by /send-email, in bytes
+	MailMaxTotalAttachmentSize int64            // Largest total of the files of one email, in bytes
+	MailAllowedTypes           []string         // Media types accepted as attachments
+	MailMaxRecipients          int              // Most To, CC and BCC addresses of one email
+	MailProfiles               []MailProfile    // Sender identities API callers can choose from
+	MailWorkers                int              // Emails sent concurrently
+	MailRetry                  retry.Policy     // Retry policy for temporary SMTP failures
+	SMSRetry                   retry.Policy     // Retry policy for failed SMS sends
+	MaxTrackedMessages         int              // Number of message statuses kept for GET /messages/{id}
 }
@@ -0,0 +1,243 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"message_handler/auth"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Header is the request header that carries the key
+	Header = "Idempotency-Key"
+
+	// maxKeyLength bounds the keys clients may choose
+	maxKeyLength = 255
+
+	// defaultMaxBodySize bounds the request bodies that are hashed
+	defaultMaxBodySize = 32 << 20
+)
+
+// entry is a request seen with a key and, once done, its response
+type entry struct {
+	hash    [sha256.Size]byte
+	done    chan struct{} // closed when the response is recorded
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// Store remembers the responses to requests with an Idempotency-Key, so a
+// client that retries such a request gets the original response instead
+// of sending the message twice
+type Store struct {
+	mu        sync.Mutex
+	entries   map[string]*entry // caller and key -> entry
+	ttl       time.Duration
+	maxBody   int64
+	lastSweep time.Time
+}
+
+// NewStore creates a store that remembers responses for ttl
+func NewStore(ttl time.Duration) *Store {
+	return &Store{entries: make(map[string]*entry), ttl: ttl, maxBody: defaultMaxBodySize}
+}
+
+// SetMaxBodySize configures the largest request body that is accepted
+// with a key; it should fit the largest request of the wrapped handlers
+func (s *Store) SetMaxBodySize(size int64) {
+	if size > 0 {
+		s.maxBody = size
+	}
+}
+
+// Wrap makes a handler honour the Idempotency-Key header of POST requests.
+// The first request with a key is handled and its response remembered. A
+// repeat with the same key and the same method, path and content gets that
+// response again, marked with an Idempotent-Replayed header, while one
+// with a different request is answered 409 Conflict. A repeat that comes
+// while the first request is still being handled waits for its response.
+// Keys are scoped to the API key name, and 5xx responses are not
+// remembered, so a retry after a server error is handled anew.
+func (s *Store) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			http.Error(w, "Idempotency-Key is longer than 255 characters", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBody))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Failed to read request", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := requestHash(r, body)
+
+		scope := auth.Caller(r) + "\x00" + key
+		e, first := s.begin(scope, hash)
+		if first {
+			s.handle(w, r, next, scope, e)
+			return
+		}
+
+		if e.hash != hash {
+			http.Error(w, "Idempotency-Key was already used for a different request", http.StatusConflict)
+			return
+		}
+		select {
+		case <-e.done:
+		case <-r.Context().Done():
+			return
+		}
+		if e.status == 0 {
+			// The first request failed with a server error: try again
+			s.Wrap(next)(w, r)
+			return
+		}
+		replay(w, e)
+	}
+}
+
+// begin returns the entry of a key, creating it if the key is new
+func (s *Store) begin(scope string, hash [sha256.Size]byte) (*entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		s.sweep(now)
+	}
+	if e, ok := s.entries[scope]; ok && (e.expires.IsZero() || now.Before(e.expires)) {
+		return e, false
+	}
+	e := &entry{hash: hash, done: make(chan struct{})}
+	s.entries[scope] = e
+	return e, true
+}
+
+// handle runs the first request with a key and records its response
+func (s *Store) handle(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, scope string, e *entry) {
+	rec := &recorder{ResponseWriter: w}
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if rec.status == 0 || rec.status >= 500 {
+			delete(s.entries, scope)
+		} else {
+			e.status = rec.status
+			e.header = w.Header().Clone()
+			e.body = rec.body.Bytes()
+			e.expires = time.Now().Add(s.ttl)
+		}
+		close(e.done)
+	}()
+	next(rec, r)
+}
+
+// sweep drops expired keys. The caller must hold s.mu.
+func (s *Store) sweep(now time.Time) {
+	s.lastSweep = now
+	for scope, e := range s.entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(s.entries, scope)
+		}
+	}
+}
+
+// requestHash identifies a request by its method, path, media type and
+// content. A multipart form is hashed by its fields and files rather than
+// its raw body, so a retry with a new boundary matches the original.
+func requestHash(r *http.Request, body []byte) [sha256.Size]byte {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n%s\n", r.Method, r.URL.Path, mediaType)
+	if parts, err := formParts(body, params["boundary"]); mediaType == "multipart/form-data" && err == nil {
+		for _, part := range parts {
+			h.Write([]byte(part + "\n"))
+		}
+	} else {
+		h.Write(body)
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// formParts describes every part of a multipart form by its field name,
+// file name, content type and a digest of its content, in sorted order
+func formParts(body []byte, boundary string) ([]string, error) {
+	if boundary == "" {
+		return nil, errors.New("no multipart boundary")
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	var parts []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, fmt.Sprintf("%q %q %q %x", part.FormName(), part.FileName(),
+			part.Header.Get("Content-Type"), sha256.Sum256(data)))
+	}
+	sort.Strings(parts)
+	return parts, nil
+}
+
+// replay writes a remembered response
+func replay(w http.ResponseWriter, e *entry) {
+	for name, values := range e.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(e.status)
+	_, _ = w.Write(e.body)
+}
+
+// recorder passes a response on and keeps a copy of it
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
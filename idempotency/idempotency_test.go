@@ -0,0 +1,173 @@
+package idempotency
+
+import (
+	"bytes"
+	"fmt"
+	"message_handler/auth"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler accepts every request with a new ID, or fails with
+// status if it is set
+func countingHandler(calls *atomic.Int32, status *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if code := status.Load(); code != 0 {
+			http.Error(w, "Failed", int(code))
+			return
+		}
+		w.Header().Set("X-Message-ID", fmt.Sprint("msg-", n))
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "SMS queued successfully (id: msg-%d)\n", n)
+	}
+}
+
+func post(handler http.HandlerFunc, caller, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/send-sms", strings.NewReader(body))
+	req.Header.Set(Header, key)
+	req = req.WithContext(auth.WithCaller(req.Context(), caller))
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+// TestWrap tests replays, mismatched bodies and per-caller keys.
+func TestWrap(t *testing.T) {
+	var calls, status atomic.Int32
+	handler := NewStore(time.Hour).Wrap(countingHandler(&calls, &status))
+
+	first := post(handler, "billing", "key-1", "phone=%2B31612345678&message=Hi")
+	repeat := post(handler, "billing", "key-1", "phone=%2B31612345678&message=Hi")
+	if calls.Load() != 1 {
+		t.Fatalf("Expected the message to be sent once, got %d", calls.Load())
+	}
+	if repeat.Code != http.StatusAccepted || repeat.Body.String() != first.Body.String() ||
+		repeat.Header().Get("X-Message-ID") != "msg-1" || repeat.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the original response, got %d %v: %s", repeat.Code, repeat.Header(), repeat.Body.String())
+	}
+
+	if rr := post(handler, "billing", "key-1", "phone=%2B31612345678&message=Bye"); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a different body, got %d", rr.Code)
+	}
+	if rr := post(handler, "monitoring", "key-1", "phone=%2B31612345678&message=Bye"); rr.Code != http.StatusAccepted || calls.Load() != 2 {
+		t.Errorf("Expected another caller's key to be separate, got %d", rr.Code)
+	}
+	if rr := post(handler, "billing", "", "phone=%2B31612345678&message=Hi"); rr.Code != http.StatusAccepted || calls.Load() != 3 {
+		t.Errorf("Expected a request without a key to be sent, got %d", rr.Code)
+	}
+	if rr := post(handler, "billing", strings.Repeat("k", 256), "message=Hi"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a long key, got %d", rr.Code)
+	}
+}
+
+// multipartForm encodes an email form with an attachment, separated by boundary
+func multipartForm(t *testing.T, boundary, attachment string) (string, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.SetBoundary(boundary); err != nil {
+		t.Fatalf("SetBoundary: %v", err)
+	}
+	mw.WriteField("to", "a@example.com")
+	mw.WriteField("subject", "Report")
+	part, _ := mw.CreateFormFile("attachment", "report.txt")
+	part.Write([]byte(attachment))
+	mw.Close()
+	return body.String(), mw.FormDataContentType()
+}
+
+// TestWrapMultipart tests that a form sent again with a new boundary is
+// recognised as the same request.
+func TestWrapMultipart(t *testing.T) {
+	var calls, status atomic.Int32
+	handler := NewStore(time.Hour).Wrap(countingHandler(&calls, &status))
+	send := func(body, contentType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/send-email", strings.NewReader(body))
+		req.Header.Set(Header, "key-1")
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	send(multipartForm(t, "boundary-first", "totals"))
+	repeat := send(multipartForm(t, "boundary-second", "totals"))
+	if calls.Load() != 1 || repeat.Code != http.StatusAccepted || repeat.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the original response for a new boundary, got %d after %d calls", repeat.Code, calls.Load())
+	}
+	if rr := send(multipartForm(t, "boundary-third", "changed")); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a different attachment, got %d", rr.Code)
+	}
+	if rr := send("to=a%40example.com&subject=Report", "application/x-www-form-urlencoded"); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a different content type, got %d", rr.Code)
+	}
+}
+
+// TestWrapServerError tests that server errors are not remembered.
+func TestWrapServerError(t *testing.T) {
+	var calls, status atomic.Int32
+	handler := NewStore(time.Hour).Wrap(countingHandler(&calls, &status))
+
+	status.Store(http.StatusServiceUnavailable)
+	if rr := post(handler, "", "key", "message=Hi"); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, got %d", rr.Code)
+	}
+	status.Store(http.StatusBadRequest)
+	post(handler, "", "key", "message=Hi")
+	status.Store(0)
+	if rr := post(handler, "", "key", "message=Hi"); rr.Code != http.StatusBadRequest || calls.Load() != 2 {
+		t.Errorf("Expected the remembered 400 after a retried 503, got %d after %d calls", rr.Code, calls.Load())
+	}
+}
+
+// TestWrapConcurrent tests that a repeat waits for the first request.
+func TestWrapConcurrent(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	handler := NewStore(time.Hour).Wrap(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	var wg sync.WaitGroup
+	codes := make([]int, 3)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = post(handler, "", "key", "message=Hi").Code
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("Expected one call, got %d", calls.Load())
+	}
+	for _, code := range codes {
+		if code != http.StatusAccepted {
+			t.Errorf("Expected 202 for every request, got %v", codes)
+		}
+	}
+}
+
+// TestWrapExpiry tests that keys are forgotten after the TTL.
+func TestWrapExpiry(t *testing.T) {
+	var calls, status atomic.Int32
+	handler := NewStore(20 * time.Millisecond).Wrap(countingHandler(&calls, &status))
+
+	post(handler, "", "key", "message=Hi")
+	time.Sleep(30 * time.Millisecond)
+	if rr := post(handler, "", "key", "message=Bye"); rr.Code != http.StatusAccepted || calls.Load() != 2 {
+		t.Errorf("Expected an expired key to be usable again, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,152 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/gomail.v2"
+)
+
+// formMemory is how much of a multipart form is kept in memory; larger
+// uploads are buffered in temporary files until the request is parsed
+const formMemory = 1 << 20
+
+// ErrAttachmentTooLarge is returned when a file exceeds the size limits
+var ErrAttachmentTooLarge = errors.New("attachment too large")
+
+// Attachment is a file sent with an email. Inline files are images that
+// the HTML body shows with <img src="cid:Filename">.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+	Inline      bool   `json:"inline,omitempty"`
+}
+
+// readAttachments reads the "attachment" and "inline" file parts of a
+// multipart form. The form must have been parsed already. Files larger
+// than the limit are not read; checkAttachments checks the rest.
+func readAttachments(form *multipart.Form, limits Limits) ([]Attachment, error) {
+	if form == nil {
+		return nil, nil
+	}
+
+	var attachments []Attachment
+	for _, field := range []string{"attachment", "inline"} {
+		for _, header := range form.File[field] {
+			if header.Size > limits.MaxFileSize {
+				return nil, fmt.Errorf("%w: %s is %d bytes, the limit is %d", ErrAttachmentTooLarge, cleanFilename(header.Filename), header.Size, limits.MaxFileSize)
+			}
+			data, err := readPart(header)
+			if err != nil {
+				return nil, err
+			}
+			attachments = append(attachments, Attachment{
+				Filename:    header.Filename,
+				ContentType: header.Header.Get("Content-Type"),
+				Data:        data,
+				Inline:      field == "inline",
+			})
+		}
+	}
+	return attachments, nil
+}
+
+// checkAttachments applies the limits to the attachments of a request. It
+// cleans their file names and sets their media types.
+func checkAttachments(attachments []Attachment, limits Limits) ([]Attachment, error) {
+	var total int64
+	for i := range attachments {
+		a := &attachments[i]
+		a.Filename = cleanFilename(a.Filename)
+		size := int64(len(a.Data))
+		if size > limits.MaxFileSize {
+			return nil, fmt.Errorf("%w: %s is %d bytes, the limit is %d", ErrAttachmentTooLarge, a.Filename, size, limits.MaxFileSize)
+		}
+		total += size
+		if total > limits.MaxTotalSize {
+			return nil, fmt.Errorf("%w: the files exceed the total limit of %d bytes", ErrAttachmentTooLarge, limits.MaxTotalSize)
+		}
+
+		a.ContentType = mediaType(a.ContentType, a.Data)
+		if !slices.Contains(limits.AllowedTypes, a.ContentType) {
+			return nil, fmt.Errorf("%s: content type %s is not allowed", a.Filename, a.ContentType)
+		}
+		if a.Inline && !strings.HasPrefix(a.ContentType, "image/") {
+			return nil, fmt.Errorf("%s: only images can be inline", a.Filename)
+		}
+	}
+	return attachments, nil
+}
+
+func readPart(header *multipart.FileHeader) ([]byte, error) {
+	f, err := header.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", header.Filename, err)
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// mediaType returns the declared media type of a file without parameters.
+// A generic or missing type is replaced by one sniffed from the content.
+func mediaType(declared string, data []byte) string {
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil || mediaType == "application/octet-stream" {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+	return strings.ToLower(mediaType)
+}
+
+// cleanFilename keeps the base name of an uploaded file and removes
+// characters that do not belong in a MIME header
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == '"' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == "/" {
+		return "attachment"
+	}
+	return name
+}
+
+// checkInline makes sure every inline image is referenced by the body
+func checkInline(body string, attachments []Attachment) error {
+	for _, a := range attachments {
+		if a.Inline && !strings.Contains(body, "cid:"+a.Filename) {
+			return fmt.Errorf("inline image %s is not referenced as cid:%s in the body", a.Filename, a.Filename)
+		}
+	}
+	return nil
+}
+
+// attach adds the files to a message. Inline files get their file name as
+// Content-ID.
+func attach(msg *gomail.Message, attachments []Attachment) {
+	for _, a := range attachments {
+		data := a.Data
+		settings := []gomail.FileSetting{
+			gomail.SetHeader(map[string][]string{"Content-Type": {a.ContentType}}),
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}),
+		}
+		if a.Inline {
+			msg.Embed(a.Filename, settings...)
+		} else {
+			msg.Attach(a.Filename, settings...)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package mail
+
+import (
+	"bytes"
+	"message_handler/config"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+var testLimits = Limits{
+	MaxFileSize:  1024,
+	MaxTotalSize: 1536,
+	AllowedTypes: []string{"application/pdf", "image/png"},
+}
+
+type testFile struct {
+	field, name, contentType, data string
+}
+
+// multipartRequest builds a /send-email request with the given files
+func multipartRequest(t *testing.T, body string, files ...testFile) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for field, value := range map[string]string{"to": "recipient@example.com", "subject": "Invoice", "body": body} {
+		_ = w.WriteField(field, value)
+	}
+	for _, f := range files {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="`+f.field+`"; filename="`+f.name+`"`)
+		header.Set("Content-Type", f.contentType)
+		part, err := w.CreatePart(header)
+		if err != nil {
+			t.Fatalf("CreatePart failed: %v", err)
+		}
+		_, _ = part.Write([]byte(f.data))
+	}
+	w.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/send-email", &buf)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+// TestHandleSendEmailAttachments tests reading and checking uploaded files.
+func TestHandleSendEmailAttachments(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 100)
+	tests := []struct {
+		name  string
+		body  string
+		files []testFile
+		code  int
+	}{
+		{"attachment and inline image", "<img src='cid:logo.png'>", []testFile{
+			{"attachment", "invoice.pdf", "application/pdf", "%PDF-1.4"},
+			{"inline", "logo.png", "application/octet-stream", png},
+		}, http.StatusAccepted},
+		{"file too large", "Hi", []testFile{
+			{"attachment", "big.pdf", "application/pdf", strings.Repeat("x", 1025)},
+		}, http.StatusRequestEntityTooLarge},
+		{"total too large", "Hi", []testFile{
+			{"attachment", "a.pdf", "application/pdf", strings.Repeat("x", 1000)},
+			{"attachment", "b.pdf", "application/pdf", strings.Repeat("x", 1000)},
+		}, http.StatusRequestEntityTooLarge},
+		{"type not allowed", "Hi", []testFile{
+			{"attachment", "run.exe", "application/x-msdownload", "MZ"},
+		}, http.StatusBadRequest},
+		{"inline image not referenced", "Hi", []testFile{
+			{"inline", "logo.png", "image/png", png},
+		}, http.StatusBadRequest},
+		{"inline file not an image", "cid:invoice.pdf", []testFile{
+			{"inline", "invoice.pdf", "application/pdf", "%PDF-1.4"},
+		}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		queue := NewMailQueue(10, &config.AppConfig{}, &MockDialer{})
+		rr := httptest.NewRecorder()
+		HandleSendEmail(rr, multipartRequest(t, tt.body, tt.files...), testLimits, queue, nil, nil)
+		if rr.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.code, rr.Code, rr.Body.String())
+			continue
+		}
+		if tt.code != http.StatusAccepted {
+			continue
+		}
+		email := <-queue.queue
+		if len(email.Attachments) != 2 || email.Attachments[0].Filename != "invoice.pdf" ||
+			!email.Attachments[1].Inline || email.Attachments[1].ContentType != "image/png" {
+			t.Errorf("%s: unexpected attachments %+v", tt.name, email.Attachments)
+		}
+	}
+}
+
+// TestSendEmailAttachments tests that files end up in the message.
+func TestSendEmailAttachments(t *testing.T) {
+	dialer := &MockDialer{}
+	email := &Email{
+		To:      Addresses{"recipient@example.com"},
+		Subject: "Invoice",
+		Body:    "<img src='cid:logo.png'>",
+		Attachments: []Attachment{
+			{Filename: "invoice.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4")},
+			{Filename: "logo.png", ContentType: "image/png", Data: []byte("PNG"), Inline: true},
+		},
+	}
+	if err := sendEmail(&config.AppConfig{SMTPUser: "sender@example.com"}, email, dialer); err != nil {
+		t.Fatalf("sendEmail failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := dialer.EmailsSent[0].WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	raw := buf.String()
+	for _, want := range []string{
+		`Content-Disposition: attachment; filename="invoice.pdf"`,
+		"Content-Type: application/pdf",
+		"Content-ID: <logo.png>",
+		`Content-Disposition: inline; filename="logo.png"`,
+	} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("Expected %q in the message:\n%s", want, raw)
+		}
+	}
+}
+
+// TestCleanFilename tests that uploaded file names are made safe.
+func TestCleanFilename(t *testing.T) {
+	for name, want := range map[string]string{
+		"invoice.pdf":            "invoice.pdf",
+		"../../etc/passwd":       "passwd",
+		`C:\Users\me\report.pdf`: "report.pdf",
+		"bad\r\nname\".pdf":      "badname.pdf",
+		"":                       "attachment",
+	} {
+		if got := cleanFilename(name); got != want {
+			t.Errorf("cleanFilename(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
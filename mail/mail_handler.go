@@ -1,59 +1,459 @@
 package mail
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"message_handler/api"
+	"message_handler/auth"
 	"message_handler/config"
+	"message_handler/retry"
+	"message_handler/schedule"
+	"message_handler/status"
+	"message_handler/templates"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 )
 
-func HandleSendEmail(w http.ResponseWriter, r *http.Request, cfg *config.AppConfig) {
+// Limits restricts what /send-email accepts
+type Limits struct {
+	MaxFileSize   int64    // Largest single attached file, in bytes
+	MaxTotalSize  int64    // Largest total of all attached files, in bytes
+	AllowedTypes  []string // Accepted media types, e.g. "application/pdf"
+	MaxRecipients int      // Most To, CC and BCC addresses of one email together
+}
+
+// emailRequest is a request to send an email, from a form or a JSON body
+type emailRequest struct {
+	To          Addresses      `json:"to"`
+	Cc          Addresses      `json:"cc,omitempty"`
+	Bcc         Addresses      `json:"bcc,omitempty"`
+	ReplyTo     string         `json:"reply_to,omitempty"`
+	Profile     string         `json:"profile,omitempty"`
+	Subject     string         `json:"subject,omitempty"`
+	HTML        string         `json:"html,omitempty"`
+	Text        string         `json:"text,omitempty"`
+	Template    string         `json:"template,omitempty"`
+	Vars        map[string]any `json:"vars,omitempty"`
+	Locale      string         `json:"locale,omitempty"`
+	SendAt      string         `json:"send_at,omitempty"`
+	Attachments []Attachment   `json:"attachments,omitempty"` // Data is base64 encoded
+}
+
+// HandleSendEmail queues the email described by the form fields under a
+// new message ID and answers 202 Accepted. A multipart form may carry
+// "attachment" and "inline" files within limits. The subject and bodies
+// may instead come from a stored template, filled in with vars in the
+// variant for the "locale" field. An email with a send_at time is handed
+// to scheduler instead.
+func HandleSendEmail(w http.ResponseWriter, r *http.Request, limits Limits, queue *MailQueue, scheduler *schedule.Scheduler, store *templates.Store) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	to := r.FormValue("to")
-	subject := r.FormValue("subject")
-	body := r.FormValue("body")
+	// Room for the files plus the text fields
+	r.Body = http.MaxBytesReader(w, r.Body, limits.MaxTotalSize+formMemory)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(formMemory); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Invalid multipart form", http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+	} else if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
 
-	// Check for missing required fields
-	if strings.TrimSpace(to) == "" || strings.TrimSpace(subject) == "" || strings.TrimSpace(body) == "" {
-		http.Error(w, "Missing required email fields", http.StatusBadRequest)
+	req := &emailRequest{
+		To:       r.Form["to"],
+		Cc:       r.Form["cc"],
+		Bcc:      r.Form["bcc"],
+		ReplyTo:  r.FormValue("reply_to"),
+		Profile:  r.FormValue("profile"),
+		Subject:  r.FormValue("subject"),
+		HTML:     r.FormValue("html"),
+		Text:     r.FormValue("text"),
+		Template: r.FormValue("template"),
+		Locale:   r.FormValue("locale"),
+		SendAt:   r.FormValue("send_at"),
+	}
+	// "body" is the HTML body of earlier versions of the API
+	if req.HTML == "" {
+		req.HTML = r.FormValue("body")
+	}
+	if req.Template != "" {
+		vars, err := templates.ParseVars(r.FormValue("vars"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Vars = vars
+	}
+	attachments, err := readAttachments(r.MultipartForm, limits)
+	if err != nil {
+		writeFormError(w, attachmentError(err))
+		return
+	}
+	req.Attachments = attachments
+
+	email, sendAt, apiErr := prepareEmail(req, auth.Caller(r), limits, queue.cfg, store)
+	if apiErr == nil {
+		apiErr = submitEmail(email, sendAt, queue, scheduler)
+	}
+	if apiErr != nil {
+		writeFormError(w, apiErr)
 		return
 	}
 
-	// Validate the email address format
-	if !validateEmail(to) {
-		http.Error(w, "Invalid email address format", http.StatusBadRequest)
+	w.Header().Set("X-Message-ID", email.ID)
+	w.WriteHeader(http.StatusAccepted)
+	if !sendAt.IsZero() {
+		_, _ = fmt.Fprintf(w, "Email scheduled for %s (id: %s)\n", sendAt.UTC().Format(time.RFC3339), email.ID)
 		return
 	}
+	_, _ = fmt.Fprintf(w, "Email queued successfully (id: %s)\n", email.ID)
+}
 
-	// Create a new dialer and attempt to send the email
-	dialer := NewDialer(cfg)
-	err := sendMail(cfg, to, subject, body, dialer)
+// HandleSendEmailJSON is HandleSendEmail for the JSON API: it takes the
+// same fields as a JSON object, with attachments as base64 data, and
+// answers with the message ID and its state, or a structured error.
+func HandleSendEmailJSON(w http.ResponseWriter, r *http.Request, limits Limits, queue *MailQueue, scheduler *schedule.Scheduler, store *templates.Store) {
+	var req emailRequest
+	// Base64 makes the files a third larger
+	if apiErr := api.Decode(w, r, &req, limits.MaxTotalSize/3*4+formMemory); apiErr != nil {
+		api.WriteError(w, apiErr)
+		return
+	}
 
-	// Handle send-mail errors appropriately
-	if err != nil {
-		var errMessage string
-		if strings.Contains(err.Error(), "invalid email address") {
-			// Specific error for email validation issues
-			errMessage = "Invalid recipient email address"
-			http.Error(w, errMessage, http.StatusBadRequest)
-		} else {
-			// General failure during email sending
-			errMessage = "Failed to send email due to an internal server issue"
-			http.Error(w, errMessage, http.StatusInternalServerError)
+	email, sendAt, apiErr := prepareEmail(&req, auth.Caller(r), limits, queue.cfg, store)
+	if apiErr == nil {
+		apiErr = submitEmail(email, sendAt, queue, scheduler)
+	}
+	if apiErr != nil {
+		api.WriteError(w, apiErr)
+		return
+	}
+	w.Header().Set("X-Message-ID", email.ID)
+	w.Header().Set("Location", "/api/v1/messages/"+email.ID)
+	api.WriteJSON(w, http.StatusAccepted, api.NewAccepted(email.ID, sendAt))
+}
+
+// emailBatch is a batch request: either a list of emails, or one email
+// sent separately to each of several recipients
+type emailBatch struct {
+	Messages   []emailRequest `json:"messages,omitempty"`
+	Recipients Addresses      `json:"recipients,omitempty"`
+	emailRequest
+}
+
+// requests lists the emails of a batch of at most max emails
+func (b *emailBatch) requests(max int) ([]emailRequest, *api.Error) {
+	addressed := len(b.To) > 0 || len(b.Cc) > 0 || len(b.Bcc) > 0
+	shared := addressed || b.ReplyTo != "" || b.Profile != "" || b.Subject != "" || b.HTML != "" || b.Text != "" ||
+		b.Template != "" || b.Vars != nil || b.Locale != "" || b.SendAt != "" || len(b.Attachments) > 0
+	switch {
+	case len(b.Messages) > 0 && (len(b.Recipients) > 0 || shared):
+		return nil, api.Errorf(http.StatusBadRequest, "conflicting_fields", "messages", "A batch has either messages or recipients with one email")
+	case addressed:
+		return nil, api.Errorf(http.StatusBadRequest, "conflicting_fields", "recipients", "A batch takes recipients, not to, cc or bcc")
+	case len(b.Messages) == 0 && len(b.Recipients) == 0:
+		return nil, api.Errorf(http.StatusBadRequest, "missing_field", "messages", "A batch needs messages or recipients")
+	}
+
+	reqs := b.Messages
+	if len(b.Recipients) > 0 {
+		reqs = make([]emailRequest, len(b.Recipients))
+		for i, recipient := range b.Recipients {
+			reqs[i] = b.emailRequest
+			reqs[i].To = Addresses{recipient}
+			// checkAttachments updates the attachments in place
+			reqs[i].Attachments = slices.Clone(b.Attachments)
+		}
+	}
+	if len(reqs) > max {
+		return nil, api.Errorf(http.StatusRequestEntityTooLarge, "batch_too_large", "messages", "Batch of %d emails, maximum is %d", len(reqs), max)
+	}
+	return reqs, nil
+}
+
+// HandleSendEmailBatch sends a batch of up to maxBatch emails with a
+// single request. Every email is checked first; if any is invalid the
+// batch is rejected with the errors of those emails. Otherwise the emails
+// are queued, and those with a send_at time scheduled, together: either
+// all are accepted or, with the queue full, none.
+func HandleSendEmailBatch(w http.ResponseWriter, r *http.Request, limits Limits, queue *MailQueue, scheduler *schedule.Scheduler, store *templates.Store, maxBatch int) {
+	var batch emailBatch
+	// The attachments of all emails together are bound by the total limit
+	if apiErr := api.Decode(w, r, &batch, limits.MaxTotalSize/3*4+int64(maxBatch)*api.BatchEntrySize); apiErr != nil {
+		api.WriteError(w, apiErr)
+		return
+	}
+	reqs, apiErr := batch.requests(maxBatch)
+	if apiErr != nil {
+		api.WriteError(w, apiErr)
+		return
+	}
+
+	caller := auth.Caller(r)
+	emails := make([]*Email, len(reqs))
+	sendAts := make([]time.Time, len(reqs))
+	var invalid []api.BatchResult
+	for i := range reqs {
+		email, sendAt, apiErr := prepareEmail(&reqs[i], caller, limits, queue.cfg, store)
+		if apiErr != nil {
+			invalid = append(invalid, api.BatchResult{Index: i, Error: apiErr})
+			continue
 		}
-		log.Printf("Error while sending email: %v", err)
+		emails[i], sendAts[i] = email, sendAt
+	}
+	if len(invalid) > 0 {
+		api.WriteJSON(w, http.StatusBadRequest, api.InvalidBatch(invalid, len(reqs)))
+		return
+	}
+
+	if apiErr := submitEmailBatch(emails, sendAts, queue, scheduler); apiErr != nil {
+		api.WriteError(w, apiErr)
 		return
 	}
+	results := make([]api.BatchResult, len(emails))
+	for i, email := range emails {
+		accepted := api.NewAccepted(email.ID, sendAts[i])
+		results[i] = api.BatchResult{Index: i, Accepted: &accepted}
+	}
+	api.WriteJSON(w, http.StatusAccepted, api.BatchResponse{Results: results})
+}
+
+// submitEmailBatch schedules the emails with a send time and queues the
+// others. If they cannot be queued, the scheduled ones are canceled again.
+func submitEmailBatch(emails []*Email, sendAts []time.Time, queue *MailQueue, scheduler *schedule.Scheduler) *api.Error {
+	var now []*Email
+	var jobs []schedule.Job
+	for i, email := range emails {
+		if sendAts[i].IsZero() {
+			now = append(now, email)
+			continue
+		}
+		payload, err := json.Marshal(email)
+		if err != nil {
+			log.Printf("Failed to schedule email: %v", err)
+			return api.Errorf(http.StatusInternalServerError, "internal_error", "", "Failed to schedule email")
+		}
+		jobs = append(jobs, schedule.Job{ID: email.ID, Kind: status.KindEmail, SendAt: sendAts[i], Payload: payload})
+	}
 
-	// Successful response
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte("Email sent successfully\n"))
+	if len(jobs) > 0 {
+		if scheduler == nil {
+			return api.Errorf(http.StatusServiceUnavailable, "unavailable", "send_at", "Scheduled sending is not available")
+		}
+		if err := scheduler.ScheduleAll(jobs...); err != nil {
+			log.Printf("Failed to schedule email: %v", err)
+			return api.Errorf(http.StatusInternalServerError, "internal_error", "", "Failed to schedule email")
+		}
+	}
+	if len(now) == 0 {
+		return nil
+	}
+	err := queue.SendAll(now...)
+	if err == nil {
+		return nil
+	}
+	for _, job := range jobs {
+		if err := scheduler.Cancel(job.ID); err != nil {
+			log.Printf("Failed to cancel scheduled email %s of a rejected batch: %v", job.ID, err)
+		}
+	}
+	switch {
+	case errors.Is(err, ErrBatchTooLarge):
+		return api.Errorf(http.StatusRequestEntityTooLarge, "batch_too_large", "messages", "Batch of %d emails is larger than the email queue", len(now))
+	case errors.Is(err, ErrQueueFull):
+		return api.Errorf(http.StatusServiceUnavailable, "queue_full", "", "Email queue has no room for %d emails, try again later", len(now))
+	}
+	log.Printf("Failed to queue email: %v", err)
+	return api.Errorf(http.StatusInternalServerError, "internal_error", "", "Failed to queue email")
+}
+
+// writeFormError answers a form request with the plain-text message of e
+func writeFormError(w http.ResponseWriter, e *api.Error) {
+	http.Error(w, e.Message, e.Status)
+}
+
+// prepareEmail checks a request and builds the email it describes, along
+// with its send time, zero to send it now
+func prepareEmail(req *emailRequest, caller string, limits Limits, cfg *config.AppConfig, store *templates.Store) (*Email, time.Time, *api.Error) {
+	subject, body, text := req.Subject, req.HTML, req.Text
+	if req.Template != "" {
+		if subject != "" || body != "" || text != "" {
+			return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "conflicting_fields", "template", "A template cannot be combined with subject, html or text")
+		}
+		rendered, apiErr := renderTemplate(store, req.Template, req.Locale, req.Vars)
+		if apiErr != nil {
+			return nil, time.Time{}, apiErr
+		}
+		subject, body, text = rendered.Subject, rendered.HTML, rendered.Text
+	}
+
+	// Check for missing required fields
+	switch {
+	case len(strings.TrimSpace(strings.Join(req.To, ""))) == 0:
+		return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "missing_field", "to", "Missing required email fields")
+	case strings.TrimSpace(subject) == "":
+		return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "missing_field", "subject", "Missing required email fields")
+	case strings.TrimSpace(body) == "" && strings.TrimSpace(text) == "":
+		return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "missing_field", "text", "Missing required email fields")
+	}
+
+	// Validate every address; the request is rejected if any is invalid
+	var rejected []string
+	seen := make(map[string]bool)
+	to := addressList(req.To, "to", seen, &rejected)
+	cc := addressList(req.Cc, "cc", seen, &rejected)
+	bcc := addressList(req.Bcc, "bcc", seen, &rejected)
+	replyTo := strings.TrimSpace(req.ReplyTo)
+	if replyTo != "" && !validateEmail(replyTo) {
+		rejected = append(rejected, "reply_to: "+replyTo)
+	}
+	if len(rejected) > 0 {
+		field, _, _ := strings.Cut(rejected[0], ":")
+		return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "invalid_address", field, "Invalid email address format:\n%s", strings.Join(rejected, "\n"))
+	}
+	if count := len(to) + len(cc) + len(bcc); limits.MaxRecipients > 0 && count > limits.MaxRecipients {
+		return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "too_many_recipients", "to", "Too many recipients: %d, maximum is %d", count, limits.MaxRecipients)
+	}
+
+	profileName := strings.ToLower(strings.TrimSpace(req.Profile))
+	if profileName != "" {
+		profile, ok := findProfile(cfg, profileName)
+		if !ok {
+			return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "unknown_profile", "profile", "Unknown sender profile %q", profileName)
+		}
+		if !profileAllowed(profile, caller) {
+			return nil, time.Time{}, api.Errorf(http.StatusForbidden, "profile_forbidden", "profile", "This API key may not send as %q", profileName)
+		}
+	}
+
+	sendAt, err := schedule.ParseSendAt(req.SendAt)
+	if err != nil {
+		return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "invalid_send_at", "send_at", "%s", err.Error())
+	}
+
+	attachments, err := checkAttachments(req.Attachments, limits)
+	if err == nil {
+		err = checkInline(body, attachments)
+	}
 	if err != nil {
-		log.Printf("Failed to write response: %v", err)
+		return nil, time.Time{}, attachmentError(err)
+	}
+
+	return &Email{
+		ID:          status.NewID(),
+		To:          to,
+		Cc:          cc,
+		Bcc:         bcc,
+		ReplyTo:     replyTo,
+		Profile:     profileName,
+		Subject:     subject,
+		Body:        body,
+		Text:        text,
+		Attachments: attachments,
+	}, sendAt, nil
+}
+
+// attachmentError describes a rejected attachment
+func attachmentError(err error) *api.Error {
+	if errors.Is(err, ErrAttachmentTooLarge) {
+		return api.Errorf(http.StatusRequestEntityTooLarge, "attachment_too_large", "attachments", "%s", err.Error())
+	}
+	return api.Errorf(http.StatusBadRequest, "invalid_attachment", "attachments", "%s", err.Error())
+}
+
+// submitEmail queues an email, or hands it to scheduler if it has a send time
+func submitEmail(email *Email, sendAt time.Time, queue *MailQueue, scheduler *schedule.Scheduler) *api.Error {
+	if !sendAt.IsZero() {
+		return scheduleEmail(scheduler, sendAt, email)
+	}
+	if err := queue.Send(email); err != nil {
+		if errors.Is(err, ErrQueueFull) {
+			return api.Errorf(http.StatusServiceUnavailable, "queue_full", "", "Email queue is full, try again later")
+		}
+		log.Printf("Failed to queue email: %v", err)
+		return api.Errorf(http.StatusInternalServerError, "internal_error", "", "Failed to queue email")
+	}
+	return nil
+}
+
+// renderTemplate fills in the variant of the template called name for
+// locale with vars
+func renderTemplate(store *templates.Store, name, locale string, vars map[string]any) (templates.Rendered, *api.Error) {
+	if store == nil {
+		return templates.Rendered{}, api.Errorf(http.StatusBadRequest, "unknown_template", "template", "Templates are not available")
+	}
+	rendered, err := store.Render(name, locale, vars)
+	if err != nil {
+		if errors.Is(err, templates.ErrNotFound) {
+			return templates.Rendered{}, api.Errorf(http.StatusBadRequest, "unknown_template", "template", "%s", err.Error())
+		}
+		return templates.Rendered{}, api.Errorf(http.StatusBadRequest, "template_error", "vars", "%s", err.Error())
+	}
+	return rendered, nil
+}
+
+// scheduleEmail holds an email until sendAt
+func scheduleEmail(scheduler *schedule.Scheduler, sendAt time.Time, email *Email) *api.Error {
+	if scheduler == nil {
+		return api.Errorf(http.StatusServiceUnavailable, "unavailable", "send_at", "Scheduled sending is not available")
+	}
+	payload, err := json.Marshal(email)
+	if err == nil {
+		err = scheduler.Schedule(schedule.Job{ID: email.ID, Kind: status.KindEmail, SendAt: sendAt, Payload: payload})
+	}
+	if err != nil {
+		log.Printf("Failed to schedule email: %v", err)
+		return api.Errorf(http.StatusInternalServerError, "internal_error", "", "Failed to schedule email")
+	}
+	return nil
+}
+
+// SendScheduled is the scheduler handler for emails: it queues the email
+// once its send time has come
+func SendScheduled(q *MailQueue) schedule.Handler {
+	return func(job schedule.Job) error {
+		var email Email
+		if err := json.Unmarshal(job.Payload, &email); err != nil {
+			return retry.Permanent(fmt.Errorf("unreadable scheduled email: %w", err))
+		}
+		email.ID = job.ID
+		return q.Send(&email)
+	}
+}
+
+// addressList collects the addresses of a field, which may be repeated and
+// may hold comma-separated lists. Invalid addresses are added to rejected,
+// prefixed with the field name; addresses already in seen are skipped, so
+// nobody gets the same email twice.
+func addressList(values []string, field string, seen map[string]bool, rejected *[]string) Addresses {
+	var addresses Addresses
+	for _, value := range values {
+		for _, address := range strings.Split(value, ",") {
+			address = strings.TrimSpace(address)
+			key := strings.ToLower(address)
+			switch {
+			case address == "" || seen[key]:
+			case !validateEmail(address):
+				*rejected = append(*rejected, field+": "+address)
+			default:
+				seen[key] = true
+				addresses = append(addresses, address)
+			}
+		}
 	}
-}
\ No newline at end of file
+	return addresses
+}
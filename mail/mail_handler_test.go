@@ -0,0 +1,295 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/json"
+	"message_handler/api"
+	"message_handler/auth"
+	"message_handler/config"
+	"message_handler/templates"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func formRequest(values url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/send-email", strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+// TestHandleSendEmailRecipients tests To, CC, BCC and Reply-To handling.
+func TestHandleSendEmailRecipients(t *testing.T) {
+	limits := Limits{MaxRecipients: 4}
+	queue := NewMailQueue(10, &config.AppConfig{}, &MockDialer{})
+
+	rr := httptest.NewRecorder()
+	HandleSendEmail(rr, formRequest(url.Values{
+		"to":       {"a@example.com, b@example.com", "A@example.com"},
+		"cc":       {"c@example.com"},
+		"bcc":      {"d@example.com", "b@example.com"},
+		"reply_to": {"support@example.com"},
+		"subject":  {"Subject"},
+		"text":     {"Hello"},
+	}), limits, queue, nil, nil)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	email := <-queue.queue
+	if !slices.Equal(email.To, Addresses{"a@example.com", "b@example.com"}) ||
+		!slices.Equal(email.Cc, Addresses{"c@example.com"}) ||
+		!slices.Equal(email.Bcc, Addresses{"d@example.com"}) || email.ReplyTo != "support@example.com" {
+		t.Errorf("Unexpected recipients: %+v", email)
+	}
+
+	rr = httptest.NewRecorder()
+	HandleSendEmail(rr, formRequest(url.Values{
+		"to":       {"a@example.com,not-an-address"},
+		"cc":       {"someone@"},
+		"reply_to": {"nobody"},
+		"subject":  {"Subject"},
+		"text":     {"Hello"},
+	}), limits, queue, nil, nil)
+	want := "Invalid email address format:\nto: not-an-address\ncc: someone@\nreply_to: nobody\n"
+	if rr.Code != http.StatusBadRequest || rr.Body.String() != want {
+		t.Errorf("Expected 400 listing the rejected addresses, got %d: %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	HandleSendEmail(rr, formRequest(url.Values{
+		"to":      {"a@example.com,b@example.com,c@example.com"},
+		"bcc":     {"d@example.com,e@example.com"},
+		"subject": {"Subject"},
+		"text":    {"Hello"},
+	}), limits, queue, nil, nil)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Too many recipients: 5, maximum is 4") {
+		t.Errorf("Expected 400 for too many recipients, got %d: %q", rr.Code, rr.Body.String())
+	}
+}
+
+// TestSendEmailRecipients tests the headers and envelope of the message.
+func TestSendEmailRecipients(t *testing.T) {
+	dialer := &MockDialer{}
+	email := &Email{
+		To:      Addresses{"a@example.com", "b@example.com"},
+		Cc:      Addresses{"c@example.com"},
+		Bcc:     Addresses{"hidden@example.com"},
+		ReplyTo: "support@example.com",
+		Subject: "Subject",
+		Text:    "Hello",
+	}
+	if err := sendEmail(&config.AppConfig{SMTPUser: "sender@example.com"}, email, dialer); err != nil {
+		t.Fatalf("sendEmail failed: %v", err)
+	}
+
+	msg := dialer.EmailsSent[0]
+	if bcc := msg.GetHeader("Bcc"); !slices.Equal(bcc, []string{"hidden@example.com"}) {
+		t.Errorf("Expected the BCC address in the envelope, got %v", bcc)
+	}
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	raw := buf.String()
+	for _, want := range []string{"To: a@example.com, b@example.com", "Cc: c@example.com", "Reply-To: support@example.com"} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("Expected %q in the message:\n%s", want, raw)
+		}
+	}
+	if strings.Contains(raw, "hidden@example.com") {
+		t.Errorf("BCC address leaked into the message:\n%s", raw)
+	}
+}
+
+// TestAddressesUnmarshal tests that single addresses stored by earlier
+// versions are still read.
+func TestAddressesUnmarshal(t *testing.T) {
+	var email Email
+	if err := json.Unmarshal([]byte(`{"to":"a@example.com","cc":["b@example.com","c@example.com"]}`), &email); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !slices.Equal(email.To, Addresses{"a@example.com"}) || !slices.Equal(email.Cc, Addresses{"b@example.com", "c@example.com"}) {
+		t.Errorf("Unexpected addresses: %+v", email)
+	}
+}
+
+// TestHandleSendEmailProfiles tests choosing a sender profile.
+func TestHandleSendEmailProfiles(t *testing.T) {
+	cfg := &config.AppConfig{
+		SMTPHost: "smtp.example.com",
+		SMTPPort: 587,
+		MailProfiles: []config.MailProfile{
+			{Name: "alerts", Address: "alerts@example.com", DisplayName: "Alerts"},
+			{Name: "billing", Address: "billing@example.com", DisplayName: "Billing", SMTPUser: "billing@example.com", APIKeys: []string{"billing"}},
+		},
+	}
+	queue := NewMailQueue(10, cfg, &MockDialer{})
+	if _, ok := queue.dialers["billing"]; !ok {
+		t.Error("Expected a dedicated dialer for the billing profile")
+	}
+
+	tests := []struct {
+		profile, caller string
+		code            int
+	}{
+		{"alerts", "monitoring", http.StatusAccepted},
+		{"Billing", "billing", http.StatusAccepted},
+		{"billing", "monitoring", http.StatusForbidden},
+		{"marketing", "billing", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := formRequest(url.Values{"to": {"a@example.com"}, "subject": {"S"}, "text": {"Hi"}, "profile": {tt.profile}})
+		req = req.WithContext(auth.WithCaller(req.Context(), tt.caller))
+		rr := httptest.NewRecorder()
+		HandleSendEmail(rr, req, Limits{}, queue, nil, nil)
+		if rr.Code != tt.code {
+			t.Errorf("Profile %s as %s: expected %d, got %d: %s", tt.profile, tt.caller, tt.code, rr.Code, rr.Body.String())
+			continue
+		}
+		if tt.code == http.StatusAccepted {
+			if email := <-queue.queue; email.Profile != strings.ToLower(tt.profile) {
+				t.Errorf("Expected profile %s, got %q", tt.profile, email.Profile)
+			}
+		}
+	}
+
+	dialer := &MockDialer{}
+	if err := sendEmail(cfg, &Email{To: Addresses{"a@example.com"}, Subject: "S", Text: "Hi", Profile: "billing"}, dialer); err != nil {
+		t.Fatalf("sendEmail failed: %v", err)
+	}
+	if from := dialer.EmailsSent[0].GetHeader("From"); len(from) != 1 || from[0] != `"Billing" <billing@example.com>` {
+		t.Errorf("Unexpected From header %v", from)
+	}
+}
+
+// TestHandleSendEmailTemplate tests emails built from a stored template.
+func TestHandleSendEmailTemplate(t *testing.T) {
+	store, _ := templates.Open("")
+	if _, err := store.Put(templates.Template{Name: "invoice", Variant: templates.Variant{Subject: "Invoice {{.number}}", HTML: "<p>Amount: {{.amount}}</p>"}}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	queue := NewMailQueue(10, &config.AppConfig{}, &MockDialer{})
+
+	rr := httptest.NewRecorder()
+	HandleSendEmail(rr, formRequest(url.Values{
+		"to":       {"a@example.com"},
+		"template": {"invoice"},
+		"vars":     {`{"number": "2024-001", "amount": "12.50"}`},
+	}), Limits{}, queue, nil, store)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	email := <-queue.queue
+	if email.Subject != "Invoice 2024-001" || email.Body != "<p>Amount: 12.50</p>" {
+		t.Errorf("Unexpected email %+v", email)
+	}
+
+	tests := []struct {
+		name   string
+		values url.Values
+	}{
+		{"missing variable", url.Values{"template": {"invoice"}, "vars": {`{"number": "1"}`}}},
+		{"invalid vars", url.Values{"template": {"invoice"}, "vars": {`["1"]`}}},
+		{"unknown template", url.Values{"template": {"receipt"}}},
+		{"template and subject", url.Values{"template": {"invoice"}, "subject": {"Hi"}}},
+	}
+	for _, tt := range tests {
+		tt.values.Set("to", "a@example.com")
+		rr := httptest.NewRecorder()
+		HandleSendEmail(rr, formRequest(tt.values), Limits{}, queue, nil, store)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", tt.name, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+// TestHandleSendEmailJSON tests the JSON API for sending an email.
+func TestHandleSendEmailJSON(t *testing.T) {
+	queue := NewMailQueue(10, &config.AppConfig{}, &MockDialer{})
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/email", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		HandleSendEmailJSON(rr, req, testLimits, queue, nil, nil)
+		return rr
+	}
+
+	rr := send(`{"to": ["a@example.com", "b@example.com"], "cc": "c@example.com", "subject": "Report",
+		"text": "See attached", "attachments": [{"filename": "report.pdf", "content_type": "application/pdf", "data": "JVBERi0xLjQK"}]}`)
+	var accepted api.Accepted
+	if err := json.Unmarshal(rr.Body.Bytes(), &accepted); err != nil || rr.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 with JSON, got %d: %s", rr.Code, rr.Body.String())
+	}
+	email := <-queue.queue
+	if email.ID != accepted.ID || len(email.To) != 2 || len(email.Cc) != 1 ||
+		len(email.Attachments) != 1 || string(email.Attachments[0].Data) != "%PDF-1.4\n" {
+		t.Errorf("Unexpected email %+v", email)
+	}
+
+	tests := []struct {
+		body   string
+		status int
+		code   string
+		field  string
+	}{
+		{`{"to": "a@example.com", "text": "Hi"}`, http.StatusBadRequest, "missing_field", "subject"},
+		{`{"to": "a@example.com", "cc": ["b@"], "subject": "Hi", "text": "Hi"}`, http.StatusBadRequest, "invalid_address", "cc"},
+		{`{"to": "a@example.com", "subject": "Hi", "text": "Hi", "attachments": [{"filename": "run.sh", "content_type": "application/x-sh", "data": "ZWNobw=="}]}`, http.StatusBadRequest, "invalid_attachment", "attachments"},
+		{`{"to": "a@example.com", "subject": "Hi", "body": "Hi"}`, http.StatusBadRequest, "unknown_field", "body"},
+	}
+	for _, tt := range tests {
+		rr := send(tt.body)
+		var apiErr api.Error
+		if err := json.Unmarshal(rr.Body.Bytes(), &apiErr); err != nil || rr.Code != tt.status {
+			t.Errorf("%s: expected a %d JSON error, got %d: %s", tt.body, tt.status, rr.Code, rr.Body.String())
+			continue
+		}
+		if apiErr.Code != tt.code || apiErr.Field != tt.field {
+			t.Errorf("%s: expected %s on %s, got %+v", tt.body, tt.code, tt.field, apiErr)
+		}
+	}
+}
+
+// TestHandleSendEmailBatch tests sending one email to each of several
+// recipients and rejecting batches with invalid emails.
+func TestHandleSendEmailBatch(t *testing.T) {
+	queue := NewMailQueue(10, &config.AppConfig{}, &MockDialer{})
+	send := func(body string) (*httptest.ResponseRecorder, api.BatchResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/email/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		HandleSendEmailBatch(rr, req, testLimits, queue, nil, nil, 5)
+		var resp api.BatchResponse
+		_ = json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr, resp
+	}
+
+	rr, resp := send(`{"recipients": ["a@example.com", "b@example.com"], "subject": "Outage", "text": "Server down",
+		"attachments": [{"filename": "report.pdf", "data": "JVBERi0xLjQK"}]}`)
+	if rr.Code != http.StatusAccepted || len(resp.Results) != 2 {
+		t.Fatalf("Expected 2 queued emails, got %d: %s", rr.Code, rr.Body.String())
+	}
+	for i, want := range []string{"a@example.com", "b@example.com"} {
+		email := <-queue.queue
+		if email.ID != resp.Results[i].ID || !slices.Equal(email.To, Addresses{want}) ||
+			len(email.Attachments) != 1 || email.Attachments[0].ContentType != "application/pdf" {
+			t.Errorf("Unexpected email %+v for %s", email, want)
+		}
+	}
+
+	rr, resp = send(`{"messages": [{"to": "a@example.com", "subject": "Hi", "text": "Hi"}, {"to": "b@", "subject": "Hi", "text": "Hi"}]}`)
+	if rr.Code != http.StatusBadRequest || len(resp.Results) != 1 || resp.Results[0].Index != 1 || resp.Results[0].Error.Code != "invalid_address" {
+		t.Errorf("Expected the invalid email to be listed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(queue.queue) != 0 {
+		t.Errorf("Expected nothing queued, got %d emails", len(queue.queue))
+	}
+
+	rr, _ = send(`{"recipients": ["a@example.com"], "cc": "b@example.com", "subject": "Hi", "text": "Hi"}`)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "conflicting_fields") {
+		t.Errorf("Expected conflicting_fields, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,253 @@
+package mail
+
+import (
+	"errors"
+	"log"
+	"message_handler/config"
+	"message_handler/retry"
+	"message_handler/status"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when the queue has no room for another email
+	ErrQueueFull = errors.New("email queue is full")
+	// ErrBatchTooLarge is returned for more emails than the queue can hold
+	ErrBatchTooLarge = errors.New("more emails than the email queue can hold")
+)
+
+// smtpReplyCode finds the reply code in an SMTP error that was formatted
+// into a string on its way up, e.g. "gomail: could not send email 1: 452 ..."
+var smtpReplyCode = regexp.MustCompile(`(?:^|: )([2-5]\d\d)[ -]`)
+
+// MailQueue sends emails in the background with a pool of workers, like
+// the SMS queue. Emails that fail with a temporary SMTP error (4xx) or a
+// network error are retried with backoff; permanent errors (5xx, invalid
+// addresses) are not.
+type MailQueue struct {
+	queue   chan *Email
+	sendMu  sync.Mutex // Serialises Send so the queue cannot fill up between check and send
+	cfg     *config.AppConfig
+	dialer  MailDialer            // Shared SMTP login
+	dialers map[string]MailDialer // Profiles with their own SMTP login
+	workers int
+	retry   retry.Policy
+	status  *status.Store // Optional lifecycle tracking
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+
+	retryMu sync.Mutex
+	retries map[*Email]*time.Timer // Failed emails waiting for their next attempt
+	timers  sync.WaitGroup         // Retry timers that have not finished
+}
+
+// NewMailQueue creates a queue of up to maxSize emails that are sent
+// through dialer, or through their own SMTP login for sender profiles
+// that have one
+func NewMailQueue(maxSize int, cfg *config.AppConfig, dialer MailDialer) *MailQueue {
+	dialers := make(map[string]MailDialer)
+	for _, profile := range cfg.MailProfiles {
+		if d := newProfileDialer(cfg, profile); d != nil {
+			dialers[profile.Name] = d
+		}
+	}
+	return &MailQueue{
+		queue:   make(chan *Email, maxSize),
+		cfg:     cfg,
+		dialer:  dialer,
+		dialers: dialers,
+		workers: 1,
+		retry:   retry.Policy{MaxAttempts: 1},
+		stopCh:  make(chan struct{}),
+		retries: make(map[*Email]*time.Timer),
+	}
+}
+
+// SetWorkers configures how many emails are sent concurrently. Call it
+// before Start.
+func (q *MailQueue) SetWorkers(workers int) {
+	if workers > 0 {
+		q.workers = workers
+	}
+}
+
+// SetRetryPolicy configures how failed sends are retried
+func (q *MailQueue) SetRetryPolicy(policy retry.Policy) {
+	q.retry = policy
+}
+
+// SetStatusStore makes the queue record the lifecycle of every email
+func (q *MailQueue) SetStatusStore(store *status.Store) {
+	q.status = store
+}
+
+// setStatus records the state of an email if status tracking is enabled
+func (q *MailQueue) setStatus(email *Email, state status.State, err error) {
+	if q.status != nil {
+		q.status.Set(email.ID, status.KindEmail, state, err)
+	}
+}
+
+// Send queues an email for sending, assigning it an ID if it has none. It
+// returns ErrQueueFull instead of blocking when the queue is full.
+func (q *MailQueue) Send(email *Email) error {
+	return q.SendAll(email)
+}
+
+// SendAll queues several emails together like Send: either all of them
+// are queued or, if the queue has no room for all of them, none is. It
+// returns ErrBatchTooLarge if they would not fit even an empty queue.
+func (q *MailQueue) SendAll(emails ...*Email) error {
+	for _, email := range emails {
+		if email.ID == "" {
+			email.ID = status.NewID()
+		}
+	}
+
+	q.sendMu.Lock()
+	defer q.sendMu.Unlock()
+
+	if len(emails) > cap(q.queue) {
+		return ErrBatchTooLarge
+	}
+	if cap(q.queue)-len(q.queue) < len(emails) {
+		return ErrQueueFull
+	}
+	for _, email := range emails {
+		q.setStatus(email, status.Queued, nil)
+		// Cannot block: only SendAll adds new emails and it checked for room
+		q.queue <- email
+	}
+	return nil
+}
+
+// Start starts the workers
+func (q *MailQueue) Start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for {
+				select {
+				case email := <-q.queue:
+					q.deliver(email)
+				case <-q.stopCh:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Stop waits for the emails being sent. Emails still waiting in the queue
+// or for a retry are dropped and logged.
+func (q *MailQueue) Stop() {
+	close(q.stopCh)
+	q.wg.Wait()
+
+	q.retryMu.Lock()
+	for email, timer := range q.retries {
+		if timer.Stop() {
+			q.timers.Done()
+			q.drop(email)
+		}
+	}
+	q.retries = nil
+	q.retryMu.Unlock()
+	q.timers.Wait()
+
+	for {
+		select {
+		case email := <-q.queue:
+			q.drop(email)
+		default:
+			return
+		}
+	}
+}
+
+func (q *MailQueue) drop(email *Email) {
+	log.Printf("Dropping unsent email %s to %s at shutdown", email.ID, strings.Join(email.To, ", "))
+	q.setStatus(email, status.Failed, errors.New("service stopped before the email was sent"))
+}
+
+// deliver sends an email and retries it later if the failure is temporary
+func (q *MailQueue) deliver(email *Email) {
+	q.setStatus(email, status.Sending, nil)
+	email.Attempts++
+	dialer := q.dialer
+	if d, ok := q.dialers[email.Profile]; ok {
+		dialer = d
+	}
+	err := classifySMTPError(sendEmail(q.cfg, email, dialer))
+	if err == nil {
+		q.setStatus(email, status.Sent, nil)
+		return
+	}
+
+	if !q.retry.ShouldRetry(email.Attempts, err) {
+		log.Printf("Email %s to %s failed after %d attempt(s): %v", email.ID, strings.Join(email.To, ", "), email.Attempts, err)
+		q.setStatus(email, status.Failed, err)
+		return
+	}
+	delay := q.retry.Delay(email.Attempts)
+	log.Printf("Email %s to %s failed (attempt %d), retrying in %s: %v", email.ID, strings.Join(email.To, ", "), email.Attempts, delay.Round(time.Second), err)
+	q.setStatus(email, status.Queued, err)
+
+	q.retryMu.Lock()
+	defer q.retryMu.Unlock()
+	if q.retries == nil {
+		q.drop(email) // stopped
+		return
+	}
+	q.timers.Add(1)
+	q.retries[email] = time.AfterFunc(delay, func() {
+		defer q.timers.Done()
+		q.retryMu.Lock()
+		if q.retries == nil {
+			q.retryMu.Unlock()
+			q.drop(email)
+			return
+		}
+		delete(q.retries, email)
+		q.retryMu.Unlock()
+
+		// Wait for room rather than lose the email
+		select {
+		case q.queue <- email:
+		case <-q.stopCh:
+			q.drop(email)
+		}
+	})
+}
+
+// classifySMTPError marks errors that a retry cannot fix as permanent:
+// 5xx SMTP replies and invalid addresses. 4xx replies and network errors
+// are left retryable.
+func classifySMTPError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		if protoErr.Code >= 500 {
+			return retry.Permanent(err)
+		}
+		return err
+	}
+	if match := smtpReplyCode.FindStringSubmatch(err.Error()); match != nil {
+		if code, _ := strconv.Atoi(match[1]); code >= 500 {
+			return retry.Permanent(err)
+		}
+		return err
+	}
+	if strings.Contains(err.Error(), "invalid email address") || strings.Contains(err.Error(), "invalid address") {
+		return retry.Permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"message_handler/config"
+	"message_handler/retry"
+	"message_handler/status"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// flakyDialer fails with the given errors before it sends successfully
+type flakyDialer struct {
+	mu       sync.Mutex
+	failures []error
+	attempts int
+	sent     chan *gomail.Message
+}
+
+func (d *flakyDialer) DialAndSend(msg ...*gomail.Message) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.attempts++
+	if len(d.failures) > 0 {
+		err := d.failures[0]
+		d.failures = d.failures[1:]
+		return err
+	}
+	d.sent <- msg[0]
+	return nil
+}
+
+func (d *flakyDialer) Attempts() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.attempts
+}
+
+func newTestQueue(dialer MailDialer, store *status.Store) *MailQueue {
+	q := NewMailQueue(10, &config.AppConfig{SMTPUser: "sender@example.com"}, dialer)
+	q.SetRetryPolicy(retry.Policy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond})
+	q.SetStatusStore(store)
+	return q
+}
+
+// TestMailQueueRetry tests that temporary SMTP errors are retried.
+func TestMailQueueRetry(t *testing.T) {
+	dialer := &flakyDialer{
+		failures: []error{
+			&textproto.Error{Code: 451, Msg: "4.7.1 Greylisted, try again later"},
+			fmt.Errorf("gomail: could not send email 1: %v", &textproto.Error{Code: 452, Msg: "4.2.2 Mailbox full"}),
+		},
+		sent: make(chan *gomail.Message, 1),
+	}
+	store := status.NewStore(10)
+	q := newTestQueue(dialer, store)
+	q.Start()
+	defer q.Stop()
+
+	email := &Email{To: Addresses{"recipient@example.com"}, Subject: "Subject", Body: "Body"}
+	if err := q.Send(email); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	select {
+	case msg := <-dialer.sent:
+		if to := msg.GetHeader("To"); len(to) != 1 || to[0] != "recipient@example.com" {
+			t.Errorf("Unexpected recipient %v", to)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Email was not sent")
+	}
+	if attempts := dialer.Attempts(); attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		record, _ := store.Get(email.ID)
+		if record.State == status.Sent {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected state sent, got %+v", record)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestMailQueuePermanentError tests that 5xx replies are not retried.
+func TestMailQueuePermanentError(t *testing.T) {
+	dialer := &flakyDialer{
+		failures: []error{fmt.Errorf("gomail: could not send email 1: 550 5.1.1 User unknown")},
+		sent:     make(chan *gomail.Message, 1),
+	}
+	store := status.NewStore(10)
+	q := newTestQueue(dialer, store)
+	q.Start()
+
+	email := &Email{To: Addresses{"recipient@example.com"}, Subject: "Subject", Body: "Body"}
+	if err := q.Send(email); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	q.Stop()
+
+	if attempts := dialer.Attempts(); attempts != 1 {
+		t.Errorf("Expected a single attempt, got %d", attempts)
+	}
+	if record, _ := store.Get(email.ID); record.State != status.Failed {
+		t.Errorf("Expected state failed, got %+v", record)
+	}
+}
+
+// TestMailQueueFull tests that Send does not block on a full queue.
+func TestMailQueueFull(t *testing.T) {
+	q := NewMailQueue(1, &config.AppConfig{}, &MockDialer{})
+	if err := q.Send(&Email{To: Addresses{"a@example.com"}}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if err := q.Send(&Email{To: Addresses{"b@example.com"}}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+}
+
+// TestClassifySMTPError tests which SMTP errors are retried.
+func TestClassifySMTPError(t *testing.T) {
+	tests := []struct {
+		err       error
+		permanent bool
+	}{
+		{&textproto.Error{Code: 421, Msg: "Service not available"}, false},
+		{&textproto.Error{Code: 535, Msg: "Authentication failed"}, true},
+		{errors.New("gomail: could not send email 1: 554 5.7.1 Rejected"), true},
+		{errors.New("gomail: could not send email 1: 450 4.2.1 Try again"), false},
+		{errors.New("dial tcp 10.0.0.1:587: connect: connection refused"), false},
+		{errors.New("invalid email address: nobody"), true},
+	}
+	for _, tt := range tests {
+		if got := retry.IsPermanent(classifySMTPError(tt.err)); got != tt.permanent {
+			t.Errorf("classifySMTPError(%q) permanent = %v, want %v", tt.err, got, tt.permanent)
+		}
+	}
+}
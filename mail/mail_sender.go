@@ -1,11 +1,15 @@
 package mail
 
 import (
+	"encoding/json"
 	"fmt"
 	"gopkg.in/gomail.v2"
 	"log"
 	"message_handler/config"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 )
 
 // MailDialer allows mocking gomail.Dialer
@@ -13,31 +17,143 @@ type MailDialer interface {
 	DialAndSend(...*gomail.Message) error
 }
 
+// Addresses is a list of email addresses. A single address as a JSON
+// string is accepted too, as stored by earlier versions.
+type Addresses []string
+
+func (a *Addresses) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Addresses{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// Email is a message to send
+type Email struct {
+	ID       string    `json:"id,omitempty"`
+	To       Addresses `json:"to"`
+	Cc       Addresses `json:"cc,omitempty"`
+	Bcc      Addresses `json:"bcc,omitempty"` // Never shown to the other recipients
+	ReplyTo  string    `json:"reply_to,omitempty"`
+	Profile  string    `json:"profile,omitempty"` // Sender profile; empty sends as SMTP_USER
+	Subject  string    `json:"subject"`
+	Body     string    `json:"body"`           // HTML body
+	Text     string    `json:"text,omitempty"` // Plain-text body; generated from Body if empty
+	Attempts int       `json:"attempts,omitempty"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
 // NewDialer constructs the real gomail dialer
 func NewDialer(cfg *config.AppConfig) MailDialer {
 	return gomail.NewDialer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUser, cfg.SMTPPass)
 }
 
+// newProfileDialer constructs a dialer for a profile with its own SMTP
+// login, or returns nil if the profile uses the shared one
+func newProfileDialer(cfg *config.AppConfig, profile config.MailProfile) MailDialer {
+	if profile.SMTPUser == "" {
+		return nil
+	}
+	host, port := profile.SMTPHost, profile.SMTPPort
+	if host == "" {
+		host = cfg.SMTPHost
+	}
+	if port == 0 {
+		port = cfg.SMTPPort
+	}
+	return gomail.NewDialer(host, port, profile.SMTPUser, profile.SMTPPass)
+}
+
+// findProfile returns the sender profile called name
+func findProfile(cfg *config.AppConfig, name string) (config.MailProfile, bool) {
+	for _, profile := range cfg.MailProfiles {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return config.MailProfile{}, false
+}
+
+// profileAllowed reports whether the API key called caller may send as
+// profile
+func profileAllowed(profile config.MailProfile, caller string) bool {
+	return len(profile.APIKeys) == 0 || slices.Contains(profile.APIKeys, caller)
+}
+
 func sendMail(cfg *config.AppConfig, to, subject, body string, dialer MailDialer) error {
-	if !validateEmail(to) {
-		return fmt.Errorf("invalid email address: %s", to)
+	return sendEmail(cfg, &Email{To: Addresses{to}, Subject: subject, Body: body}, dialer)
+}
+
+func sendEmail(cfg *config.AppConfig, email *Email, dialer MailDialer) error {
+	if len(email.To) == 0 {
+		return fmt.Errorf("invalid email address: no recipient")
+	}
+	for _, address := range email.recipients() {
+		if !validateEmail(address) {
+			return fmt.Errorf("invalid email address: %s", address)
+		}
+	}
+	if email.ReplyTo != "" && !validateEmail(email.ReplyTo) {
+		return fmt.Errorf("invalid email address: %s", email.ReplyTo)
 	}
 
 	mailer := gomail.NewMessage()
-	mailer.SetHeader("From", cfg.SMTPUser)
-	mailer.SetHeader("To", to)
-	mailer.SetHeader("Subject", subject)
-	mailer.SetBody("text/html", body)
+	if email.Profile == "" {
+		mailer.SetHeader("From", cfg.SMTPUser)
+	} else {
+		profile, ok := findProfile(cfg, email.Profile)
+		if !ok {
+			return fmt.Errorf("unknown sender profile %q", email.Profile)
+		}
+		mailer.SetAddressHeader("From", profile.Address, profile.DisplayName)
+	}
+	mailer.SetHeader("To", email.To...)
+	if len(email.Cc) > 0 {
+		mailer.SetHeader("Cc", email.Cc...)
+	}
+	if len(email.Bcc) > 0 {
+		mailer.SetHeader("Bcc", email.Bcc...)
+	}
+	if email.ReplyTo != "" {
+		mailer.SetHeader("Reply-To", email.ReplyTo)
+	}
+	mailer.SetHeader("Subject", email.Subject)
+	setBody(mailer, email)
+	attach(mailer, email.Attachments)
 
 	if err := dialer.DialAndSend(mailer); err != nil {
-		return fmt.Errorf("failed to send email: %v. make sure to check the settings.env and recompile it if you changed the settings", err)
+		return fmt.Errorf("failed to send email: %w", err)
 	}
 
-
-	log.Println("Email sent successfully to: " + to + " Subject: `" + subject + "`")
+	// Cc and Bcc are only counted, Bcc addresses must stay hidden
+	log.Println("Email sent successfully to: " + strings.Join(email.To, ", ") +
+		" (" + strconv.Itoa(len(email.recipients())) + " recipients) Subject: `" + email.Subject + "`")
 	return nil
 }
 
+// recipients returns the To, CC and BCC addresses
+func (e *Email) recipients() []string {
+	return slices.Concat(e.To, e.Cc, e.Bcc)
+}
+
+// setBody adds the plain-text part and, if there is an HTML body, the HTML
+// alternative. Clients show the last alternative they can display.
+func setBody(mailer *gomail.Message, email *Email) {
+	if email.Body == "" {
+		mailer.SetBody("text/plain", email.Text)
+		return
+	}
+	text := email.Text
+	if text == "" {
+		text = htmlToText(email.Body)
+	}
+	mailer.SetBody("text/plain", text)
+	mailer.AddAlternative("text/html", email.Body)
+}
+
 func validateEmail(email string) bool {
 	regex := `^[\w-\.]+@([\w-]+\.)+[\w-]{2,4}$`
 	return regexp.MustCompile(regex).MatchString(email)
@@ -0,0 +1,132 @@
+package mail
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	tagName       = regexp.MustCompile(`^</?\s*([a-zA-Z0-9]+)`)
+	tagAttr       = regexp.MustCompile(`(?i)\b(href|alt)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	spaceRun      = regexp.MustCompile(`[ \t\r\n\f]+`)
+	blankLines    = regexp.MustCompile(`\n{3,}`)
+	lineEndSpaces = regexp.MustCompile(` *\n *`)
+)
+
+// paragraphTags start and end a paragraph; lineTags only break the line
+var (
+	paragraphTags = map[string]bool{
+		"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+		"table": true, "ul": true, "ol": true, "blockquote": true, "pre": true,
+	}
+	lineTags = map[string]bool{
+		"div": true, "tr": true, "section": true, "article": true, "header": true,
+		"footer": true, "address": true, "dl": true, "dt": true, "dd": true,
+	}
+	// hiddenTags are skipped with everything inside them
+	hiddenTags = map[string]bool{"head": true, "script": true, "style": true, "title": true}
+)
+
+// htmlToText turns an HTML body into a readable plain-text alternative:
+// tags are stripped, block elements become line breaks, list items get a
+// dash, and links keep their target in brackets after the link text.
+func htmlToText(body string) string {
+	var out strings.Builder
+	var linkHref string
+	linkStart := -1
+	hidden := ""
+
+	write := func(s string) { out.WriteString(s) }
+	for len(body) > 0 {
+		open := strings.IndexByte(body, '<')
+		if open != 0 {
+			text := body
+			if open > 0 {
+				text = body[:open]
+			}
+			if hidden == "" {
+				write(html.UnescapeString(spaceRun.ReplaceAllString(text, " ")))
+			}
+			if open < 0 {
+				break
+			}
+			body = body[open:]
+			continue
+		}
+
+		end := strings.IndexByte(body, '>')
+		if end < 0 {
+			break // unterminated tag
+		}
+		tag := body[:end+1]
+		body = body[end+1:]
+		if strings.HasPrefix(tag, "<!--") {
+			if close := strings.Index(tag+body, "-->"); close >= 0 {
+				body = (tag + body)[close+3:]
+			}
+			continue
+		}
+		match := tagName.FindStringSubmatch(tag)
+		if match == nil {
+			continue // doctype or stray '<'
+		}
+		name := strings.ToLower(match[1])
+		closing := strings.HasPrefix(tag, "</")
+
+		if hidden != "" {
+			if closing && name == hidden {
+				hidden = ""
+			}
+			continue
+		}
+		switch {
+		case hiddenTags[name] && !closing:
+			hidden = name
+		case paragraphTags[name]:
+			write("\n\n")
+		case lineTags[name], name == "br":
+			write("\n")
+		case name == "li" && !closing:
+			write("\n- ")
+		case name == "hr":
+			write("\n\n---\n\n")
+		case name == "img" && !closing:
+			if alt := attr(tag, "alt"); alt != "" {
+				write("[" + alt + "]")
+			}
+		case name == "a" && !closing:
+			linkHref = attr(tag, "href")
+			linkStart = out.Len()
+		case name == "a" && closing:
+			text := strings.TrimSpace(out.String()[max(linkStart, 0):])
+			if showLink(linkHref, text) {
+				write(" (" + linkHref + ")")
+			}
+			linkHref, linkStart = "", -1
+		}
+	}
+
+	text := lineEndSpaces.ReplaceAllString(out.String(), "\n")
+	text = blankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
+
+// attr returns the unescaped value of an attribute of a start tag
+func attr(tag, name string) string {
+	for _, m := range tagAttr.FindAllStringSubmatch(tag, -1) {
+		if strings.EqualFold(m[1], name) {
+			return html.UnescapeString(m[2] + m[3] + m[4])
+		}
+	}
+	return ""
+}
+
+// showLink reports whether a link target adds something to its text
+func showLink(href, text string) bool {
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(href, "cid:") {
+		return false
+	}
+	target := strings.TrimPrefix(href, "mailto:")
+	return target != text
+}
@@ -0,0 +1,81 @@
+package mail
+
+import (
+	"bytes"
+	"message_handler/config"
+	"strings"
+	"testing"
+)
+
+// TestHTMLToText tests the generated plain-text alternative.
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		html, text string
+	}{
+		{"<h1>Hello!</h1><p>This is a <strong>test</strong> email.</p>", "Hello!\n\nThis is a test email."},
+		{`<p>Read <a href="https://example.com/docs?a=1&amp;b=2">the docs</a>.</p>`, "Read the docs (https://example.com/docs?a=1&b=2)."},
+		{`<a href="https://example.com">https://example.com</a>`, "https://example.com"},
+		{`<a href='mailto:help@example.com'>help@example.com</a>`, "help@example.com"},
+		{"<ul><li>One</li><li>Two</li></ul>", "- One\n- Two"},
+		{"Line one<br>Line two<br/>", "Line one\nLine two"},
+		{"<html><head><title>T</title><style>p { color: red }</style></head><body><p>Body &amp; soul</p></body></html>", "Body & soul"},
+		{"<p>Before</p><!-- a <b>comment</b> --><p>After</p>", "Before\n\nAfter"},
+		{`<img src="cid:logo.png" alt="Logo"> Welcome`, "[Logo] Welcome"},
+		{"<div>\n   Spaced\n\n   out   </div>", "Spaced out"},
+	}
+	for _, tt := range tests {
+		if got := htmlToText(tt.html); got != tt.text {
+			t.Errorf("htmlToText(%q) = %q, want %q", tt.html, got, tt.text)
+		}
+	}
+}
+
+// TestSendEmailAlternatives tests that HTML emails carry a plain-text part.
+func TestSendEmailAlternatives(t *testing.T) {
+	cfg := &config.AppConfig{SMTPUser: "sender@example.com"}
+	tests := []struct {
+		email *Email
+		want  []string
+		not   []string
+	}{
+		{
+			&Email{To: Addresses{"a@example.com"}, Subject: "S", Body: "<p>Hi <a href='https://example.com'>there</a></p>"},
+			[]string{"multipart/alternative", "Content-Type: text/plain", "Hi there (https://example.com)", "Content-Type: text/html"},
+			nil,
+		},
+		{
+			&Email{To: Addresses{"a@example.com"}, Subject: "S", Body: "<p>Hi</p>", Text: "Custom text"},
+			[]string{"multipart/alternative", "Custom text", "<p>Hi</p>"},
+			nil,
+		},
+		{
+			&Email{To: Addresses{"a@example.com"}, Subject: "S", Text: "Only text"},
+			[]string{"Content-Type: text/plain", "Only text"},
+			[]string{"text/html", "multipart/alternative"},
+		},
+	}
+	for _, tt := range tests {
+		dialer := &MockDialer{}
+		if err := sendEmail(cfg, tt.email, dialer); err != nil {
+			t.Fatalf("sendEmail failed: %v", err)
+		}
+		var buf bytes.Buffer
+		if _, err := dialer.EmailsSent[0].WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+		raw := buf.String()
+		for _, want := range tt.want {
+			if !strings.Contains(raw, want) {
+				t.Errorf("Expected %q in the message:\n%s", want, raw)
+			}
+		}
+		for _, not := range tt.not {
+			if strings.Contains(raw, not) {
+				t.Errorf("Did not expect %q in the message:\n%s", not, raw)
+			}
+		}
+		if tt.email.Body != "" && strings.Index(raw, "text/plain") > strings.Index(raw, "text/html") {
+			t.Errorf("Expected the plain-text part before the HTML part:\n%s", raw)
+		}
+	}
+}
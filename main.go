@@ -4,14 +4,22 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"message_handler/api"
+	"message_handler/auth"
 	"message_handler/config"
+	"message_handler/idempotency"
 	"message_handler/mail"
+	"message_handler/retry"
+	"message_handler/schedule"
 	"message_handler/sms"
+	"message_handler/status"
+	"message_handler/templates"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/tarm/serial"
@@ -19,10 +27,9 @@ import (
 )
 
 var (
-	portMutex   sync.Mutex
-	apiKey      string
-	smsQueue    *sms.SMSQueue
-	smsProvider string // Declare smsProvider as a package-level variable
+	apiKey   string
+	apiKeys  *auth.Keys
+	smsQueue *sms.SMSQueue
 )
 
 func loadConfig() (*config.AppConfig, error) {
@@ -36,10 +43,27 @@ func loadConfig() (*config.AppConfig, error) {
 		serverPort = "5643"
 	}
 
-	// Assign value to the global smsProvider variable
-	smsProvider = strings.ToLower(os.Getenv("SMS_PROVIDER"))
-	if smsProvider != "hardware" && smsProvider != "twilio" {
-		smsProvider = "hardware" // default
+	// SMS_PROVIDER is an ordered, comma-separated failover chain of
+	// registered provider names
+	var smsProviders []string
+	for _, name := range strings.Split(strings.ToLower(os.Getenv("SMS_PROVIDER")), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && !slices.Contains(smsProviders, name) {
+			smsProviders = append(smsProviders, name)
+		}
+	}
+	if len(smsProviders) == 0 {
+		smsProviders = []string{"hardware"} // default
+	}
+
+	breakerThreshold, err := strconv.Atoi(os.Getenv("SMS_BREAKER_THRESHOLD"))
+	if err != nil || breakerThreshold <= 0 {
+		breakerThreshold = 3
+	}
+
+	breakerCooldown, err := time.ParseDuration(os.Getenv("SMS_BREAKER_COOLDOWN"))
+	if err != nil || breakerCooldown <= 0 {
+		breakerCooldown = time.Minute
 	}
 
 	rateLimit, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT"), 64)
@@ -62,22 +86,265 @@ func loadConfig() (*config.AppConfig, error) {
 		maxQueueSize = 100
 	}
 
+	smsMaxAttempts, err := strconv.Atoi(os.Getenv("SMS_MAX_ATTEMPTS"))
+	if err != nil || smsMaxAttempts <= 0 {
+		smsMaxAttempts = 3
+	}
+
+	smsRetryBaseDelay, err := time.ParseDuration(os.Getenv("SMS_RETRY_BASE_DELAY"))
+	if err != nil || smsRetryBaseDelay <= 0 {
+		smsRetryBaseDelay = 5 * time.Second
+	}
+
+	smsRetryMaxDelay, err := time.ParseDuration(os.Getenv("SMS_RETRY_MAX_DELAY"))
+	if err != nil || smsRetryMaxDelay <= 0 {
+		smsRetryMaxDelay = 5 * time.Minute
+	}
+
+	smsRetryJitter, err := strconv.ParseFloat(os.Getenv("SMS_RETRY_JITTER"), 64)
+	if err != nil || smsRetryJitter < 0 || smsRetryJitter > 1 {
+		smsRetryJitter = 0.2
+	}
+
+	mailQueueSize, err := strconv.Atoi(os.Getenv("MAIL_QUEUE_SIZE"))
+	if err != nil || mailQueueSize <= 0 {
+		mailQueueSize = 100
+	}
+
+	mailWorkers, err := strconv.Atoi(os.Getenv("MAIL_WORKERS"))
+	if err != nil || mailWorkers <= 0 {
+		mailWorkers = 2
+	}
+
+	mailMaxAttempts, err := strconv.Atoi(os.Getenv("MAIL_MAX_ATTEMPTS"))
+	if err != nil || mailMaxAttempts <= 0 {
+		mailMaxAttempts = 5
+	}
+
+	mailRetryBaseDelay, err := time.ParseDuration(os.Getenv("MAIL_RETRY_BASE_DELAY"))
+	if err != nil || mailRetryBaseDelay <= 0 {
+		mailRetryBaseDelay = 30 * time.Second
+	}
+
+	mailRetryMaxDelay, err := time.ParseDuration(os.Getenv("MAIL_RETRY_MAX_DELAY"))
+	if err != nil || mailRetryMaxDelay <= 0 {
+		mailRetryMaxDelay = 15 * time.Minute
+	}
+
+	mailRetryJitter, err := strconv.ParseFloat(os.Getenv("MAIL_RETRY_JITTER"), 64)
+	if err != nil || mailRetryJitter < 0 || mailRetryJitter > 1 {
+		mailRetryJitter = 0.2
+	}
+
+	mailMaxAttachmentMB, err := strconv.ParseFloat(os.Getenv("MAIL_MAX_ATTACHMENT_MB"), 64)
+	if err != nil || mailMaxAttachmentMB <= 0 {
+		mailMaxAttachmentMB = 10
+	}
+
+	mailMaxTotalAttachmentMB, err := strconv.ParseFloat(os.Getenv("MAIL_MAX_TOTAL_ATTACHMENT_MB"), 64)
+	if err != nil || mailMaxTotalAttachmentMB <= 0 {
+		mailMaxTotalAttachmentMB = 25
+	}
+
+	mailMaxRecipients, err := strconv.Atoi(os.Getenv("MAIL_MAX_RECIPIENTS"))
+	if err != nil || mailMaxRecipients <= 0 {
+		mailMaxRecipients = 50
+	}
+
+	// MAIL_PROFILES names the sender profiles; each one is configured by
+	// MAIL_PROFILE_<NAME>_* variables
+	var mailProfiles []config.MailProfile
+	for _, name := range strings.Split(os.Getenv("MAIL_PROFILES"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "MAIL_PROFILE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		profile := config.MailProfile{
+			Name:        name,
+			Address:     os.Getenv(prefix + "ADDRESS"),
+			DisplayName: os.Getenv(prefix + "NAME"),
+			SMTPHost:    os.Getenv(prefix + "SMTP_HOST"),
+			SMTPUser:    os.Getenv(prefix + "SMTP_USER"),
+			SMTPPass:    os.Getenv(prefix + "SMTP_PASS"),
+		}
+		if profile.Address == "" {
+			return nil, fmt.Errorf("mail profile %q has no %sADDRESS", name, prefix)
+		}
+		profile.SMTPPort, _ = strconv.Atoi(os.Getenv(prefix + "SMTP_PORT"))
+		for _, key := range strings.Split(os.Getenv(prefix+"API_KEYS"), ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				profile.APIKeys = append(profile.APIKeys, key)
+			}
+		}
+		mailProfiles = append(mailProfiles, profile)
+	}
+
+	var mailAllowedTypes []string
+	for _, mediaType := range strings.Split(strings.ToLower(os.Getenv("MAIL_ALLOWED_TYPES")), ",") {
+		if mediaType = strings.TrimSpace(mediaType); mediaType != "" {
+			mailAllowedTypes = append(mailAllowedTypes, mediaType)
+		}
+	}
+	if len(mailAllowedTypes) == 0 {
+		mailAllowedTypes = []string{"application/pdf", "image/png", "image/jpeg", "image/gif", "text/plain", "text/csv"} // default
+	}
+
+	maxTrackedMessages, err := strconv.Atoi(os.Getenv("MAX_TRACKED_MESSAGES"))
+	if err != nil || maxTrackedMessages <= 0 {
+		maxTrackedMessages = 10000
+	}
+
+	smsMaxSegments, err := strconv.Atoi(os.Getenv("SMS_MAX_SEGMENTS"))
+	if err != nil || smsMaxSegments <= 0 || smsMaxSegments > 255 {
+		smsMaxSegments = 10
+	}
+
+	modemMode := strings.ToLower(os.Getenv("MODEM_MODE"))
+	if modemMode != string(sms.ModeText) && modemMode != string(sms.ModePDU) {
+		modemMode = string(sms.ModeText) // default
+	}
+
+	modemTimeout, err := time.ParseDuration(os.Getenv("MODEM_TIMEOUT"))
+	if err != nil || modemTimeout <= 0 {
+		modemTimeout = 5 * time.Second
+	}
+
+	modemSendTimeout, err := time.ParseDuration(os.Getenv("MODEM_SEND_TIMEOUT"))
+	if err != nil || modemSendTimeout <= 0 {
+		modemSendTimeout = time.Minute
+	}
+
+	deliveryReports, err := strconv.ParseBool(os.Getenv("SMS_DELIVERY_REPORTS"))
+	if err != nil {
+		deliveryReports = true // default
+	}
+
+	inboxPollInterval, err := time.ParseDuration(os.Getenv("INBOX_POLL_INTERVAL"))
+	if err != nil || inboxPollInterval <= 0 {
+		inboxPollInterval = time.Minute
+	}
+
+	// Modem set-up; IRA makes text mode take plain ASCII as written
+	modemCharset := os.Getenv("MODEM_CHARSET")
+	if modemCharset == "" {
+		modemCharset = "IRA" // default
+	}
+
+	scheduleDir := os.Getenv("SCHEDULE_DIR")
+	if scheduleDir == "" {
+		scheduleDir = "data/schedule" // default
+	}
+
+	idempotencyTTL, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL"))
+	if err != nil || idempotencyTTL <= 0 {
+		idempotencyTTL = 24 * time.Hour
+	}
+
+	batchMaxSize, err := strconv.Atoi(os.Getenv("BATCH_MAX_SIZE"))
+	if err != nil || batchMaxSize <= 0 {
+		batchMaxSize = 1000
+	}
+
+	templateDir := os.Getenv("TEMPLATE_DIR")
+	if templateDir == "" {
+		templateDir = "data/templates" // default
+	}
+
+	modemPollInterval, err := time.ParseDuration(os.Getenv("MODEM_POLL_INTERVAL"))
+	if err != nil || modemPollInterval <= 0 {
+		modemPollInterval = 30 * time.Second
+	}
+
+	inboxSize, err := strconv.Atoi(os.Getenv("INBOX_SIZE"))
+	if err != nil || inboxSize <= 0 {
+		inboxSize = 1000
+	}
+
+	// MODEM_DEVICES lists the serial devices of a modem pool; a single
+	// DEVICE_PATH is still accepted
+	var modemDevices []string
+	for _, device := range strings.Split(os.Getenv("MODEM_DEVICES"), ",") {
+		if device = strings.TrimSpace(device); device != "" && !slices.Contains(modemDevices, device) {
+			modemDevices = append(modemDevices, device)
+		}
+	}
+	if len(modemDevices) == 0 && os.Getenv("DEVICE_PATH") != "" {
+		modemDevices = []string{os.Getenv("DEVICE_PATH")}
+	}
+
+	modemStrategy := strings.ToLower(os.Getenv("MODEM_STRATEGY"))
+	if modemStrategy != string(sms.RoundRobin) && modemStrategy != string(sms.LeastBusy) {
+		modemStrategy = string(sms.LeastBusy) // default
+	}
+
+	modemRateLimit, err := strconv.ParseFloat(os.Getenv("MODEM_RATE_LIMIT"), 64)
+	if err != nil || modemRateLimit < 0 {
+		modemRateLimit = 0 // unlimited
+	}
+
 	serialBaud := 115200
 	if val, err := strconv.Atoi(os.Getenv("SERIAL_BAUD")); err == nil && val > 0 {
 		serialBaud = val
 	}
 
 	return &config.AppConfig{
-		ServerPort:   serverPort,
-		RateLimit:    rateLimit,
-		BurstLimit:   burstLimit,
-		SMTPHost:     os.Getenv("SMTP_HOST"),
-		SMTPPort:     smtpPort,
-		SMTPUser:     os.Getenv("SMTP_USER"),
-		SMTPPass:     os.Getenv("SMTP_PASS"),
-		DevicePath:   os.Getenv("DEVICE_PATH"),
-		MaxQueueSize: maxQueueSize,
-		SerialBaud:   serialBaud,
+		ServerPort:          serverPort,
+		RateLimit:           rateLimit,
+		BurstLimit:          burstLimit,
+		SMTPHost:            os.Getenv("SMTP_HOST"),
+		SMTPPort:            smtpPort,
+		SMTPUser:            os.Getenv("SMTP_USER"),
+		SMTPPass:            os.Getenv("SMTP_PASS"),
+		ModemDevices:        modemDevices,
+		ModemStrategy:       modemStrategy,
+		ModemRateLimit:      modemRateLimit,
+		MaxQueueSize:        maxQueueSize,
+		SMSProviders:        smsProviders,
+		SMSBreakerThreshold: breakerThreshold,
+		SMSBreakerCooldown:  breakerCooldown,
+		SerialBaud:          serialBaud,
+		ModemMode:           modemMode,
+		ModemTimeout:        modemTimeout,
+		ModemSendTimeout:    modemSendTimeout,
+		ModemPollInterval:   modemPollInterval,
+		ModemProfile: sms.ModemProfile{
+			PIN:     os.Getenv("SIM_PIN"),
+			SMSC:    os.Getenv("MODEM_SMSC"),
+			Charset: modemCharset,
+			Storage: strings.ToUpper(os.Getenv("MODEM_STORAGE")),
+		},
+		DeliveryReports:            deliveryReports,
+		InboxWebhookURL:            os.Getenv("INBOX_WEBHOOK_URL"),
+		InboxPollInterval:          inboxPollInterval,
+		InboxSize:                  inboxSize,
+		SMSMaxSegments:             smsMaxSegments,
+		QueueDir:                   os.Getenv("QUEUE_DIR"),
+		ScheduleDir:                scheduleDir,
+		TemplateDir:                templateDir,
+		BatchMaxSize:               batchMaxSize,
+		IdempotencyTTL:             idempotencyTTL,
+		TemplateDefaultLocale:      os.Getenv("TEMPLATE_DEFAULT_LOCALE"),
+		MailQueueSize:              mailQueueSize,
+		MailMaxAttachmentSize:      int64(mailMaxAttachmentMB * (1 << 20)),
+		MailMaxTotalAttachmentSize: int64(mailMaxTotalAttachmentMB * (1 << 20)),
+		MailAllowedTypes:           mailAllowedTypes,
+		MailMaxRecipients:          mailMaxRecipients,
+		MailProfiles:               mailProfiles,
+		MailWorkers:                mailWorkers,
+		MailRetry: retry.Policy{
+			MaxAttempts: mailMaxAttempts,
+			BaseDelay:   mailRetryBaseDelay,
+			MaxDelay:    mailRetryMaxDelay,
+			Jitter:      mailRetryJitter,
+		},
+		MaxTrackedMessages: maxTrackedMessages,
+		SMSRetry: retry.Policy{
+			MaxAttempts: smsMaxAttempts,
+			BaseDelay:   smsRetryBaseDelay,
+			MaxDelay:    smsRetryMaxDelay,
+			Jitter:      smsRetryJitter,
+		},
 	}, nil
 }
 
@@ -100,47 +367,160 @@ func main() {
 		log.Println("Warning: API_KEY environment variable is not set.")
 	}
 
-	baudRate := cfg.SerialBaud
-
-	var serialPort io.ReadWriteCloser
-	serialPortError := ""
-	// smsProvider is now accessible here
-	if smsProvider == "hardware" {
-		if apiKey != "" {
-			serialPort, err = openSerialPort(cfg.DevicePath, baudRate)
-			if err != nil {
-				serialPortError = fmt.Sprintf("Failed to open serial port: %v", err)
-				log.Println(serialPortError)
-			} else {
-				defer serialPort.Close()
+	// API_KEYS adds named keys, e.g. "billing:KEY1,monitoring:KEY2"; the
+	// names decide which mail profiles a key may use
+	keys := make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		name, key, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || name == "" || key == "" {
+			if strings.TrimSpace(entry) != "" {
+				log.Printf("Warning: ignoring API_KEYS entry without name:key")
 			}
+			continue
 		}
+		keys[name] = key
+	}
+	keyConfigured := apiKey != "" || len(keys) > 0
+	if apiKey != "" || len(keys) == 0 {
+		keys["default"] = apiKey
+	}
+	apiKeys = auth.NewKeys(keys)
+
+	baudRate := cfg.SerialBaud
+
+	// Modems of the pool; their serial ports are opened by a supervisor
+	var modemDevices []string
+	if slices.Contains(cfg.SMSProviders, "hardware") && keyConfigured {
+		modemDevices = cfg.ModemDevices
 	}
 
+	tracker := status.NewStore(cfg.MaxTrackedMessages)
+
 	smsQueue = sms.NewSMSQueue(cfg.MaxQueueSize)
-	smsQueue.SetProvider("hardware")
-	smsQueue.Start()
-	defer smsQueue.Stop()
+	if cfg.QueueDir != "" {
+		journal, err := sms.OpenJournal(cfg.QueueDir)
+		if err != nil {
+			log.Fatalf("Failed to open SMS journal: %v", err)
+		}
+		defer journal.Close()
+		smsQueue.SetJournal(journal)
+	}
+	smsQueue.SetRetryPolicy(cfg.SMSRetry)
+	smsQueue.SetStatusStore(tracker)
+	smsQueue.SetCircuitBreaker(cfg.SMSBreakerThreshold, cfg.SMSBreakerCooldown)
 
-	// Set hardware sender
-	if serialPort != nil {
-		smsQueue.SetHardwareSender(func(s *sms.SMS) error {
-			portMutex.Lock()
-			defer portMutex.Unlock()
-			return sms.SendSMSviaHardware(serialPort, s.Recipient, s.Message)
-		})
+	// Register every provider that is configured
+	registry := sms.NewRegistry()
+	inbox := sms.NewInbox(cfg.InboxSize)
+	modemPool := sms.NewModemPool(sms.PoolStrategy(cfg.ModemStrategy))
+	for _, device := range modemDevices {
+		hardware := sms.NewHardwareProvider(nil, sms.ModemMode(cfg.ModemMode))
+		hardware.Conn().SetTimeouts(cfg.ModemTimeout, cfg.ModemSendTimeout)
+		hardware.SetProfile(cfg.ModemProfile)
+		if cfg.DeliveryReports {
+			if err := hardware.EnableDeliveryReports(sms.NewDeliveryReports(tracker)); err != nil {
+				log.Printf("Modem %s: %v", device, err)
+			}
+		}
+
+		// Open the port, and reopen it whenever the modem goes away
+		supervisor := sms.NewModemSupervisor(device, func() (io.ReadWriteCloser, error) {
+			return openSerialPort(device, baudRate)
+		}, hardware)
+		supervisor.SetPollInterval(cfg.ModemPollInterval)
+		if err := supervisor.Start(); err != nil {
+			log.Fatalf("Modem %s: %v", device, err)
+		}
+		defer supervisor.Stop()
+
+		modemPool.AddModem(device, hardware, cfg.ModemRateLimit, cfg.SMSBreakerThreshold, cfg.SMSBreakerCooldown)
+
+		// Read replies and other incoming messages from the modem
+		receiver := sms.NewReceiver(hardware, inbox)
+		receiver.SetPollInterval(cfg.InboxPollInterval)
+		if cfg.InboxWebhookURL != "" {
+			receiver.SetWebhook(cfg.InboxWebhookURL)
+		}
+		receiver.Start()
+		defer receiver.Stop()
+	}
+	if modemPool.Size() > 0 {
+		if err := registry.Register(modemPool); err != nil {
+			log.Fatalf("Failed to register SMS provider: %v", err)
+		}
+		modemPool.Start()
+		defer modemPool.Stop()
+		// Keep every modem busy
+		smsQueue.SetWorkers(modemPool.Size())
+		log.Printf("Modem pool: %d modem(s), %s", modemPool.Size(), cfg.ModemStrategy)
 	}
 
-	// Twilio setup
 	twilioSID := os.Getenv("TWILIO_SID")
 	twilioAuth := os.Getenv("TWILIO_AUTH_TOKEN")
 	twilioNumber := os.Getenv("TWILIO_PHONE")
+	twilioCallback := os.Getenv("TWILIO_STATUS_CALLBACK_URL")
 	if twilioSID != "" && twilioAuth != "" && twilioNumber != "" {
-		smsQueue.SetProvider("twilio")
-		smsQueue.SetTwilioSender(func(s *sms.SMS) error {
-			return sms.SendSMSviaTwilio(twilioSID, twilioAuth, twilioNumber, s)
-		})
+		twilioProvider := &sms.TwilioProvider{AccountSID: twilioSID, AuthToken: twilioAuth, From: twilioNumber, StatusCallback: twilioCallback}
+		if err := registry.Register(twilioProvider); err != nil {
+			log.Fatalf("Failed to register SMS provider: %v", err)
+		}
+	}
+
+	var chain []sms.Provider
+	var chainNames []string
+	for _, name := range cfg.SMSProviders {
+		provider, ok := registry.Get(name)
+		if !ok {
+			log.Printf("Warning: SMS provider %q is not available (registered: %s)", name, strings.Join(registry.Names(), ", "))
+			continue
+		}
+		chain = append(chain, provider)
+		chainNames = append(chainNames, name)
+	}
+	if len(chain) == 0 {
+		log.Println("Warning: no SMS provider available, queued SMS will not be sent")
+	}
+	smsQueue.SetProviders(chain...)
+	log.Printf("SMS provider chain: %s", strings.Join(chainNames, " -> "))
+
+	smsQueue.Start()
+	defer smsQueue.Stop()
+
+	mailLimits := mail.Limits{
+		MaxFileSize:   cfg.MailMaxAttachmentSize,
+		MaxTotalSize:  cfg.MailMaxTotalAttachmentSize,
+		AllowedTypes:  cfg.MailAllowedTypes,
+		MaxRecipients: cfg.MailMaxRecipients,
+	}
+	mailQueue := mail.NewMailQueue(cfg.MailQueueSize, cfg, mail.NewDialer(cfg))
+	mailQueue.SetWorkers(cfg.MailWorkers)
+	mailQueue.SetRetryPolicy(cfg.MailRetry)
+	mailQueue.SetStatusStore(tracker)
+	mailQueue.Start()
+	defer mailQueue.Stop()
+
+	// Messages with a send_at time wait in the scheduler
+	scheduler, err := schedule.Open(cfg.ScheduleDir)
+	if err != nil {
+		log.Fatalf("Failed to open scheduler: %v", err)
 	}
+	scheduler.SetStatusStore(tracker)
+	scheduler.Handle(status.KindSMS, sms.SendScheduled(smsQueue))
+	scheduler.Handle(status.KindEmail, mail.SendScheduled(mailQueue))
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	// Named message templates for /send-sms and /send-email
+	templateStore, err := templates.Open(cfg.TemplateDir)
+	if err != nil {
+		log.Fatalf("Failed to open templates: %v", err)
+	}
+	templateStore.SetDefaultLocale(cfg.TemplateDefaultLocale)
+
+	// Responses to send requests with an Idempotency-Key, for client retries.
+	// The largest request is a JSON email batch with attachments.
+	idempotent := idempotency.NewStore(cfg.IdempotencyTTL)
+	idempotent.SetMaxBodySize(cfg.MailMaxTotalAttachmentSize/3*4 + int64(cfg.BatchMaxSize)*api.BatchEntrySize)
 
 	rl := NewRateLimiter(rate.Limit(cfg.RateLimit), cfg.BurstLimit)
 
@@ -148,52 +528,114 @@ func main() {
 		fmt.Fprintln(w, "pong")
 	})
 
-	http.Handle("/send-sms", rl.LimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("/send-sms", rl.LimitMiddleware(requireAPIKey(idempotent.Wrap(func(w http.ResponseWriter, r *http.Request) {
 		if smsQueue == nil {
 			http.Error(w, "SMS service not initialized", http.StatusInternalServerError)
 			return
 		}
-		if !authenticate(r) {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		phone := r.FormValue("phone")
-		message := r.FormValue("message")
+		sms.HandleSendSMS(w, r, smsQueue, scheduler, templateStore, cfg.SMSMaxSegments)
+	}))))
 
-		if !sms.ValidatePhone(phone) {
-			http.Error(w, "Invalid phone number format", http.StatusBadRequest)
-			return
-		}
-		if strings.TrimSpace(message) == "" {
-			http.Error(w, "Message cannot be empty", http.StatusBadRequest)
-			return
-		}
+	http.Handle("GET /messages/{id}", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		status.HandleGetMessage(w, r, tracker)
+	})))
 
-		smsQueue.Send(&sms.SMS{Recipient: phone, Message: message})
-		w.WriteHeader(http.StatusAccepted)
-		_, _ = w.Write([]byte("SMS queued successfully\n"))
+	http.Handle("GET /providers", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		sms.HandleProviderHealth(w, r, smsQueue)
 	})))
 
-	http.Handle("/send-email", rl.LimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !authenticate(r) {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		mail.HandleSendEmail(w, r, cfg)
+	http.Handle("GET /dead-letters", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		sms.HandleListDeadLetters(w, r, smsQueue)
+	})))
+	http.Handle("POST /dead-letters/{id}/requeue", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		sms.HandleRequeueDeadLetter(w, r, smsQueue)
+	})))
+	http.Handle("DELETE /dead-letters/{id}", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		sms.HandlePurgeDeadLetters(w, r, smsQueue)
+	})))
+	http.Handle("DELETE /dead-letters", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		sms.HandlePurgeDeadLetters(w, r, smsQueue)
+	})))
+
+	// Twilio cannot send the API key; callbacks are authenticated by their signature
+	if twilioAuth != "" && twilioCallback != "" {
+		http.HandleFunc("POST /twilio/status", func(w http.ResponseWriter, r *http.Request) {
+			sms.HandleTwilioStatus(w, r, twilioAuth, twilioCallback, tracker)
+		})
+	}
+
+	http.Handle("GET /modems", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		sms.HandleModemHealth(w, r, modemPool)
+	})))
+
+	http.Handle("GET /inbox", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		sms.HandleInbox(w, r, inbox)
+	})))
+
+	http.Handle("/send-email", rl.LimitMiddleware(requireAPIKey(idempotent.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		mail.HandleSendEmail(w, r, mailLimits, mailQueue, scheduler, templateStore)
+	}))))
+
+	http.Handle("GET /scheduled", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		schedule.HandleList(w, r, scheduler)
+	})))
+	http.Handle("DELETE /scheduled/{id}", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		schedule.HandleCancel(w, r, scheduler)
+	})))
+
+	http.Handle("GET /templates", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		templates.HandleList(w, r, templateStore)
+	})))
+	http.Handle("GET /templates/{name}", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		templates.HandleGet(w, r, templateStore)
+	})))
+	http.Handle("PUT /templates/{name}", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		templates.HandlePut(w, r, templateStore)
+	})))
+	http.Handle("DELETE /templates/{name}", rl.LimitMiddleware(requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		templates.HandleDelete(w, r, templateStore)
 	})))
 
+	// Versioned JSON API; plain-text errors from the rate limiter, the key
+	// check and the router are answered as JSON errors too
+	v1 := http.NewServeMux()
+	v1.Handle("POST /api/v1/sms", requireAPIKey(idempotent.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		sms.HandleSendSMSJSON(w, r, smsQueue, scheduler, templateStore, cfg.SMSMaxSegments)
+	})))
+	v1.Handle("POST /api/v1/email", requireAPIKey(idempotent.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		mail.HandleSendEmailJSON(w, r, mailLimits, mailQueue, scheduler, templateStore)
+	})))
+	v1.Handle("POST /api/v1/sms/batch", requireAPIKey(idempotent.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		sms.HandleSendSMSBatch(w, r, smsQueue, scheduler, templateStore, cfg.SMSMaxSegments, cfg.BatchMaxSize)
+	})))
+	v1.Handle("POST /api/v1/email/batch", requireAPIKey(idempotent.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		mail.HandleSendEmailBatch(w, r, mailLimits, mailQueue, scheduler, templateStore, cfg.BatchMaxSize)
+	})))
+	v1.Handle("GET /api/v1/messages/{id}", requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		status.HandleGetMessage(w, r, tracker)
+	}))
+	http.Handle("/api/v1/", api.Middleware(rl.LimitMiddleware(v1)))
+
 	log.Printf("Server is listening on port %s...", cfg.ServerPort)
 	if err := http.ListenAndServe(":"+cfg.ServerPort, nil); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
 }
 
-func authenticate(r *http.Request) bool {
-	clientAPIKey := r.Header.Get("Authorization")
-	return clientAPIKey == apiKey
-}
\ No newline at end of file
+// requireAPIKey rejects requests without a known API key and tells the
+// handler which key was used
+func requireAPIKey(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, ok := apiKeys.Authenticate(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	})
+}
@@ -0,0 +1,61 @@
+package retry
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// Policy describes how often and how quickly a failed send is retried
+type Policy struct {
+	MaxAttempts int           // Total attempts including the first one
+	BaseDelay   time.Duration // Delay before the first retry, doubled for every further attempt
+	MaxDelay    time.Duration // Upper bound for the delay between attempts
+	Jitter      float64       // Random variation applied to each delay, as a fraction (0-1)
+}
+
+// ShouldRetry reports whether another attempt should be made after the given
+// number of failed attempts ended with err
+func (p Policy) ShouldRetry(attempts int, err error) bool {
+	return attempts < p.MaxAttempts && !IsPermanent(err)
+}
+
+// Delay returns how long to wait after the given number of failed attempts
+func (p Policy) Delay(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(delay))
+	}
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// permanentError marks an error that retrying will not fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that ShouldRetry never retries it
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err, or any error it wraps, was marked permanent
+func IsPermanent(err error) bool {
+	var perm *permanentError
+	return errors.As(err, &perm)
+}
@@ -0,0 +1,51 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPolicyDelay(t *testing.T) {
+	policy := Policy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+	for _, tc := range tests {
+		if got := policy.Delay(tc.attempts); got != tc.want {
+			t.Errorf("Delay(%d) = %s, want %s", tc.attempts, got, tc.want)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := policy.Delay(1); got < 500*time.Millisecond || got > 1500*time.Millisecond {
+			t.Fatalf("Delay with jitter out of range: %s", got)
+		}
+	}
+}
+
+func TestPolicyShouldRetry(t *testing.T) {
+	policy := Policy{MaxAttempts: 3}
+	temporary := errors.New("timeout")
+	permanent := fmt.Errorf("send failed: %w", Permanent(errors.New("invalid number")))
+
+	if !policy.ShouldRetry(1, temporary) {
+		t.Error("Expected temporary error to be retried")
+	}
+	if policy.ShouldRetry(3, temporary) {
+		t.Error("Expected no retry once MaxAttempts is reached")
+	}
+	if policy.ShouldRetry(1, permanent) {
+		t.Error("Expected wrapped permanent error not to be retried")
+	}
+}
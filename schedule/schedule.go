@@ -0,0 +1,375 @@
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"message_handler/retry"
+	"message_handler/status"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const scheduleFile = "scheduled.json"
+
+var (
+	// ErrNotFound is returned when cancelling a message that is not
+	// scheduled, or is already being sent
+	ErrNotFound = errors.New("scheduled message not found")
+	// ErrNoHandler is returned when scheduling a kind nothing can send
+	ErrNoHandler = errors.New("no handler for message kind")
+)
+
+// Job is a message waiting for its send time. Payload holds the message
+// as JSON, in the form its handler expects.
+type Job struct {
+	ID        string          `json:"id"`
+	Kind      string          `json:"kind"` // status.KindSMS or status.KindEmail
+	SendAt    time.Time       `json:"send_at"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Handler sends a job once it is due. An error that is not permanent is
+// retried according to the scheduler's retry policy.
+type Handler func(Job) error
+
+// Scheduler holds messages until their send time. Scheduled messages are
+// written to a file, so they survive a restart; messages that became due
+// while the service was down are sent as soon as it starts.
+type Scheduler struct {
+	mu       sync.Mutex
+	jobs     map[string]*Job
+	running  map[string]*Job // taken out of jobs while their handler runs
+	handlers map[string]Handler
+	path     string // empty keeps the schedule in memory only
+	retry    retry.Policy
+	status   *status.Store
+	wake     chan struct{}
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Open creates a scheduler that keeps its messages in dir, loading the
+// messages scheduled before the last shutdown. An empty dir keeps them in
+// memory only.
+func Open(dir string) (*Scheduler, error) {
+	s := &Scheduler{
+		jobs:     make(map[string]*Job),
+		running:  make(map[string]*Job),
+		handlers: make(map[string]Handler),
+		retry:    retry.Policy{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: 10 * time.Minute, Jitter: 0.2},
+		wake:     make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+	}
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create schedule directory: %w", err)
+	}
+	s.path = filepath.Join(dir, scheduleFile)
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read schedule: %w", err)
+	}
+	if len(data) > 0 {
+		var jobs []*Job
+		if err := json.Unmarshal(data, &jobs); err != nil {
+			return nil, fmt.Errorf("failed to read schedule: %w", err)
+		}
+		for _, job := range jobs {
+			s.jobs[job.ID] = job
+		}
+		log.Printf("Scheduler: %d scheduled message(s) loaded", len(jobs))
+	}
+	return s, nil
+}
+
+// Handle registers the handler that sends jobs of the given kind
+func (s *Scheduler) Handle(kind string, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[kind] = handler
+}
+
+// SetRetryPolicy configures how often a job whose handler failed is retried
+func (s *Scheduler) SetRetryPolicy(policy retry.Policy) {
+	s.retry = policy
+}
+
+// SetStatusStore makes the scheduler record scheduled, canceled and failed
+// messages in store
+func (s *Scheduler) SetStatusStore(store *status.Store) {
+	s.status = store
+}
+
+// Schedule stores a job until its send time. It returns once the job is
+// written to disk.
+func (s *Scheduler) Schedule(job Job) error {
+	return s.ScheduleAll(job)
+}
+
+// ScheduleAll stores several jobs like Schedule, with a single write:
+// either all of them are scheduled or none is.
+func (s *Scheduler) ScheduleAll(jobs ...Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, job := range jobs {
+		if _, ok := s.handlers[job.Kind]; !ok {
+			return fmt.Errorf("%w %q", ErrNoHandler, job.Kind)
+		}
+	}
+	now := time.Now().UTC()
+	for i := range jobs {
+		job := jobs[i]
+		if job.ID == "" {
+			job.ID = status.NewID()
+		}
+		job.SendAt = job.SendAt.UTC()
+		job.CreatedAt = now
+		jobs[i] = job
+		s.jobs[job.ID] = &job
+	}
+	if err := s.save(); err != nil {
+		for _, job := range jobs {
+			delete(s.jobs, job.ID)
+		}
+		return err
+	}
+	for _, job := range jobs {
+		s.setStatus(job.ID, job.Kind, status.Scheduled, nil)
+	}
+	s.notify()
+	return nil
+}
+
+// Cancel removes a job that has not been sent yet
+func (s *Scheduler) Cancel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.jobs, id)
+	if err := s.save(); err != nil {
+		s.jobs[id] = job
+		return err
+	}
+	s.setStatus(id, job.Kind, status.Canceled, nil)
+	return nil
+}
+
+// List returns the jobs waiting for their send time, earliest first
+func (s *Scheduler) List() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].SendAt.Before(jobs[b].SendAt) })
+	return jobs
+}
+
+// Start begins sending jobs when they are due
+func (s *Scheduler) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			for _, job := range s.takeDue() {
+				s.run(job)
+			}
+
+			wait := time.Hour
+			if next, ok := s.next(); ok {
+				wait = time.Until(next)
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-s.wake:
+				timer.Stop()
+			case <-s.stopCh:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops sending jobs. Jobs that are not due yet stay on disk.
+func (s *Scheduler) Stop() {
+	close(s.stopCh)
+	s.wg.Wait()
+}
+
+// notify wakes the loop so that it sees a new earliest job
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default: // a wake-up is already pending
+	}
+}
+
+// next returns the earliest send time
+func (s *Scheduler) next() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var next time.Time
+	for _, job := range s.jobs {
+		if next.IsZero() || job.SendAt.Before(next) {
+			next = job.SendAt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// takeDue moves the jobs whose send time has come to running
+func (s *Scheduler) takeDue() []*Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var due []*Job
+	for id, job := range s.jobs {
+		if !job.SendAt.After(now) {
+			due = append(due, job)
+			delete(s.jobs, id)
+			s.running[id] = job
+		}
+	}
+	sort.Slice(due, func(a, b int) bool { return due[a].SendAt.Before(due[b].SendAt) })
+	return due
+}
+
+// run hands a due job to its handler, and reschedules it if the handler
+// failed and may succeed later
+func (s *Scheduler) run(job *Job) {
+	s.mu.Lock()
+	handler := s.handlers[job.Kind]
+	s.mu.Unlock()
+
+	err := fmt.Errorf("%w %q", ErrNoHandler, job.Kind)
+	if handler != nil {
+		err = handler(*job)
+	}
+	job.Attempts++
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, job.ID)
+	switch {
+	case err == nil:
+	case handler != nil && s.retry.ShouldRetry(job.Attempts, err):
+		delay := s.retry.Delay(job.Attempts)
+		log.Printf("Scheduled %s %s failed (attempt %d), retrying in %s: %v", job.Kind, job.ID, job.Attempts, delay.Round(time.Second), err)
+		job.SendAt = time.Now().Add(delay).UTC()
+		s.jobs[job.ID] = job
+		s.setStatus(job.ID, job.Kind, status.Scheduled, err)
+	default:
+		log.Printf("Scheduled %s %s failed after %d attempt(s): %v", job.Kind, job.ID, job.Attempts, err)
+		s.setStatus(job.ID, job.Kind, status.Failed, err)
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Scheduler: %v", err)
+	}
+}
+
+// save atomically rewrites the schedule file with the waiting and running
+// jobs. The caller must hold s.mu.
+func (s *Scheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+	jobs := make([]*Job, 0, len(s.jobs)+len(s.running))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	for _, job := range s.running {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].SendAt.Before(jobs[b].SendAt) })
+
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		return fmt.Errorf("failed to write schedule: %w", err)
+	}
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write schedule: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write schedule: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write schedule: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write schedule: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to write schedule: %w", err)
+	}
+	return nil
+}
+
+func (s *Scheduler) setStatus(id, kind string, state status.State, err error) {
+	if s.status != nil {
+		s.status.Set(id, kind, state, err)
+	}
+}
+
+// ParseSendAt parses the send_at parameter of a request, an RFC 3339 time
+// in the future. It returns the zero time if value is empty.
+func ParseSendAt(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	sendAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("send_at must be an RFC 3339 time, e.g. 2026-01-02T15:04:05Z")
+	}
+	if !sendAt.After(time.Now()) {
+		return time.Time{}, fmt.Errorf("send_at must be in the future")
+	}
+	return sendAt, nil
+}
+
+// HandleList writes the messages waiting for their send time as JSON
+func HandleList(w http.ResponseWriter, r *http.Request, scheduler *Scheduler) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(scheduler.List()); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// HandleCancel cancels the scheduled message named in the path
+func HandleCancel(w http.ResponseWriter, r *http.Request, scheduler *Scheduler) {
+	if err := scheduler.Cancel(r.PathValue("id")); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Scheduled message not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to cancel scheduled message: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte("Scheduled message canceled\n"))
+}
@@ -0,0 +1,147 @@
+package schedule
+
+import (
+	"errors"
+	"message_handler/retry"
+	"message_handler/status"
+	"testing"
+	"time"
+)
+
+// TestSchedulerSurvivesRestart tests that scheduled jobs are reloaded and
+// sent once due.
+func TestSchedulerSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	noop := func(Job) error { return nil }
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	s.Handle(status.KindSMS, noop)
+	sendAt := time.Now().Add(50 * time.Millisecond)
+	if err := s.Schedule(Job{ID: "msg", Kind: status.KindSMS, SendAt: sendAt, Payload: []byte(`{"message":"Hi"}`)}); err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+
+	// Restart before the job is due
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	if jobs := s.List(); len(jobs) != 1 || jobs[0].ID != "msg" || string(jobs[0].Payload) != `{"message":"Hi"}` {
+		t.Fatalf("Expected the scheduled job after a restart, got %+v", jobs)
+	}
+
+	sent := make(chan Job, 1)
+	s.Handle(status.KindSMS, func(job Job) error {
+		sent <- job
+		return nil
+	})
+	s.Start()
+	defer s.Stop()
+
+	select {
+	case job := <-sent:
+		if time.Now().Before(sendAt) {
+			t.Errorf("Job sent before its time")
+		}
+		if job.ID != "msg" {
+			t.Errorf("Expected job msg, got %s", job.ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Job was not sent")
+	}
+
+	time.Sleep(20 * time.Millisecond) // let the scheduler save
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	if jobs := reopened.List(); len(jobs) != 0 {
+		t.Errorf("Expected no jobs after sending, got %+v", jobs)
+	}
+}
+
+// TestSchedulerCancel tests cancelling a job before it is due.
+func TestSchedulerCancel(t *testing.T) {
+	store := status.NewStore(10)
+	s, _ := Open(t.TempDir())
+	s.SetStatusStore(store)
+	s.Handle(status.KindEmail, func(Job) error {
+		t.Error("Canceled job was sent")
+		return nil
+	})
+	s.Start()
+	defer s.Stop()
+
+	if err := s.Schedule(Job{ID: "mail", Kind: status.KindEmail, SendAt: time.Now().Add(100 * time.Millisecond)}); err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+	if record, _ := store.Get("mail"); record.State != status.Scheduled {
+		t.Errorf("Expected state scheduled, got %s", record.State)
+	}
+	if err := s.Cancel("mail"); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+	if err := s.Cancel("mail"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound cancelling twice, got %v", err)
+	}
+	if record, _ := store.Get("mail"); record.State != status.Canceled {
+		t.Errorf("Expected state canceled, got %s", record.State)
+	}
+	if err := s.Schedule(Job{Kind: "fax", SendAt: time.Now()}); !errors.Is(err, ErrNoHandler) {
+		t.Errorf("Expected ErrNoHandler for an unknown kind, got %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+}
+
+// TestSchedulerRetry tests that failed jobs are retried and then given up.
+func TestSchedulerRetry(t *testing.T) {
+	store := status.NewStore(10)
+	s, _ := Open("")
+	s.SetStatusStore(store)
+	s.SetRetryPolicy(retry.Policy{MaxAttempts: 2, BaseDelay: 10 * time.Millisecond})
+	attempts := make(chan struct{}, 3)
+	s.Handle(status.KindSMS, func(Job) error {
+		attempts <- struct{}{}
+		return errors.New("SMS queue is full")
+	})
+	s.Start()
+	defer s.Stop()
+
+	if err := s.Schedule(Job{ID: "msg", Kind: status.KindSMS, SendAt: time.Now()}); err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-attempts:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected attempt %d", i+1)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(attempts) != 0 {
+		t.Errorf("Expected no more than 2 attempts")
+	}
+	if record, _ := store.Get("msg"); record.State != status.Failed || record.Error != "SMS queue is full" {
+		t.Errorf("Expected failed with the handler's error, got %+v", record)
+	}
+}
+
+// TestParseSendAt tests validation of the send_at parameter.
+func TestParseSendAt(t *testing.T) {
+	if sendAt, err := ParseSendAt(""); err != nil || !sendAt.IsZero() {
+		t.Errorf("ParseSendAt(\"\") = %v, %v", sendAt, err)
+	}
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	if sendAt, err := ParseSendAt(future.Format(time.RFC3339)); err != nil || !sendAt.Equal(future) {
+		t.Errorf("ParseSendAt(future) = %v, %v", sendAt, err)
+	}
+	if _, err := ParseSendAt(time.Now().Add(-time.Minute).Format(time.RFC3339)); err == nil {
+		t.Error("Expected an error for a time in the past")
+	}
+	if _, err := ParseSendAt("tomorrow"); err == nil {
+		t.Error("Expected an error for a malformed time")
+	}
+}
@@ -0,0 +1,453 @@
+package sms
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"message_handler/retry"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ctrlZ = "\x1a"
+
+	// Default timeouts, see SetTimeouts
+	defaultCommandTimeout = 5 * time.Second
+	defaultSubmitTimeout  = 60 * time.Second // the network can take a while to accept an SMS
+)
+
+var (
+	// ErrATTimeout is returned when the modem does not answer in time
+	ErrATTimeout = errors.New("timed out waiting for modem response")
+	// ErrPortClosed is returned once the serial port can no longer be read
+	ErrPortClosed = errors.New("modem port closed")
+)
+
+// ATError is a plain ERROR final result
+type ATError struct {
+	Command string
+}
+
+func (e *ATError) Error() string {
+	return fmt.Sprintf("modem returned ERROR for %s", e.Command)
+}
+
+// CMSError is a +CMS ERROR final result (message service failure)
+type CMSError struct {
+	Code int
+}
+
+func (e *CMSError) Error() string {
+	return fmt.Sprintf("+CMS ERROR: %d", e.Code)
+}
+
+// Permanent reports whether the network rejected the recipient itself,
+// e.g. an unassigned number or a barred subscriber, so that resending the
+// message through any modem or provider would fail the same way
+func (e *CMSError) Permanent() bool {
+	switch e.Code {
+	case 1, // unassigned number
+		8,  // operator determined barring
+		10, // call barred
+		28, // unidentified subscriber
+		30: // unknown subscriber
+		return true
+	}
+	return false
+}
+
+// CMEError is a +CME ERROR final result (equipment failure)
+type CMEError struct {
+	Code int
+}
+
+func (e *CMEError) Error() string {
+	return fmt.Sprintf("+CME ERROR: %d", e.Code)
+}
+
+// URC is an unsolicited result code, such as a new message indication
+type URC struct {
+	Name string // Prefix without the colon, e.g. "+CMTI" or "RING"
+	Line string // The complete line
+	PDU  string // The following PDU line of a +CMT or +CDS in PDU mode
+}
+
+// urcPrefixes are the lines the modem may send on its own
+var urcPrefixes = []string{
+	"+CMTI:", "+CDSI:", "+CMT:", "+CDS:", "+CBM:", "+CREG:", "+CGREG:",
+	"+CUSD:", "+CLIP:", "+CRING:", "+CIEV:", "+CPIN:", "RING", "NO CARRIER",
+}
+
+// ATConn is a line-oriented AT command channel to a modem. A reader
+// goroutine splits the modem output into lines, hands the responses of the
+// running command to it and passes unsolicited result codes interleaved in
+// the stream to the URC handler.
+type ATConn struct {
+	cmd sync.Mutex // one command at a time
+
+	mu       sync.Mutex
+	active   bool   // a command is waiting for its response
+	expect   string // response prefix of the running command, e.g. "+CMGS:"
+	handlers map[string]func(URC)
+
+	timeout       time.Duration // for ordinary commands and the "> " prompt
+	submitTimeout time.Duration // for the network to accept a message
+
+	port io.ReadWriter // nil while disconnected
+	done chan struct{} // closed when port can no longer be read
+
+	lines  chan string // response lines and prompts of the running command
+	urcs   chan URC
+	closed chan struct{}
+}
+
+// NewATConn starts reading from port. The caller owns the port; closing it
+// stops the reader. port may be nil for a modem that is connected later
+// with Reset.
+func NewATConn(port io.ReadWriter) *ATConn {
+	c := &ATConn{
+		handlers:      make(map[string]func(URC)),
+		timeout:       defaultCommandTimeout,
+		submitTimeout: defaultSubmitTimeout,
+		done:          make(chan struct{}),
+		lines:         make(chan string, 64),
+		urcs:          make(chan URC, 64),
+		closed:        make(chan struct{}),
+	}
+	close(c.done)
+	if port != nil {
+		c.Reset(port)
+	}
+	go c.dispatchLoop()
+	return c
+}
+
+// Reset switches the connection to a newly opened port, e.g. after the
+// modem was reconnected. URC handlers and timeouts are kept.
+func (c *ATConn) Reset(port io.ReadWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.port = port
+	c.done = make(chan struct{})
+	go c.readLoop(port, c.done)
+}
+
+// Close stops delivering URCs. It does not close the port.
+func (c *ATConn) Close() {
+	close(c.closed)
+}
+
+// session returns the current port and the channel closed when it fails
+func (c *ATConn) session() (io.ReadWriter, chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.port, c.done
+}
+
+// Connected reports whether the port can still be read
+func (c *ATConn) Connected() bool {
+	_, done := c.session()
+	select {
+	case <-done:
+		return false
+	default:
+		return true
+	}
+}
+
+// SetTimeouts configures how long to wait for the answer to a command and
+// for the network to accept a message after AT+CMGS
+func (c *ATConn) SetTimeouts(command, submit time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = command
+	c.submitTimeout = submit
+}
+
+// Timeouts returns the command and submit timeouts
+func (c *ATConn) Timeouts() (command, submit time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timeout, c.submitTimeout
+}
+
+// HandleURC sets the function that receives the unsolicited result codes
+// named name, e.g. "+CMTI". Handlers run one at a time on their own
+// goroutine and may issue commands.
+func (c *ATConn) HandleURC(name string, handler func(URC)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[name] = handler
+}
+
+// Done is closed when the current port can no longer be read
+func (c *ATConn) Done() <-chan struct{} {
+	_, done := c.session()
+	return done
+}
+
+// readLoop splits the modem output into lines until the port fails
+func (c *ATConn) readLoop(port io.ReadWriter, done chan struct{}) {
+	defer close(done)
+
+	var buf strings.Builder
+	var pending *URC // a URC whose PDU line is still to come
+	chunk := make([]byte, 256)
+	for {
+		n, err := port.Read(chunk)
+		for _, b := range chunk[:n] {
+			if b != '\r' && b != '\n' {
+				buf.WriteByte(b)
+				continue
+			}
+			line := strings.TrimSpace(buf.String())
+			buf.Reset()
+			if line == "" {
+				continue
+			}
+			if pending != nil {
+				pending.PDU = line
+				c.urcs <- *pending
+				pending = nil
+				continue
+			}
+			pending = c.route(line)
+		}
+		// The SMS prompt is not followed by a line break
+		if strings.TrimSpace(buf.String()) == ">" {
+			buf.Reset()
+			c.route(">")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// route hands a line to the running command or to the URC handler. It
+// returns a URC that still waits for its PDU line.
+func (c *ATConn) route(line string) *URC {
+	c.mu.Lock()
+	active, expect := c.active, c.expect
+	c.mu.Unlock()
+
+	if isURC(line) && !(active && expect != "" && strings.HasPrefix(line, expect)) {
+		name, rest, _ := strings.Cut(line, ":")
+		urc := URC{Name: name, Line: line}
+		if hasPDULine(name, rest) {
+			return &urc
+		}
+		c.urcs <- urc
+		return nil
+	}
+
+	if !active {
+		log.Printf("Modem: ignoring unexpected line %q", line)
+		return nil
+	}
+	c.lines <- line
+	return nil
+}
+
+func isURC(line string) bool {
+	for _, prefix := range urcPrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPDULine reports whether a URC is followed by a second line: +CMT
+// always is, +CDS only in PDU mode where its parameter is just a length
+func hasPDULine(name, rest string) bool {
+	switch name {
+	case "+CMT":
+		return true
+	case "+CDS":
+		_, err := strconv.Atoi(strings.TrimSpace(rest))
+		return err == nil
+	}
+	return false
+}
+
+func (c *ATConn) dispatchLoop() {
+	for {
+		select {
+		case urc := <-c.urcs:
+			c.mu.Lock()
+			handler := c.handlers[urc.Name]
+			c.mu.Unlock()
+			if handler != nil {
+				handler(urc)
+			} else {
+				log.Printf("Modem: unhandled %s", urc.Line)
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Command sends an AT command and returns its response lines once the
+// modem answers OK. Error results are returned as *ATError, *CMSError or
+// *CMEError; a missing answer as ErrATTimeout.
+func (c *ATConn) Command(cmd string, timeout time.Duration) ([]string, error) {
+	c.cmd.Lock()
+	defer c.cmd.Unlock()
+
+	port, done, err := c.begin(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer c.end()
+
+	if _, err := port.Write([]byte(cmd + "\r")); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", cmd, err)
+	}
+	lines, _, err := c.await(cmd, done, timeout, false)
+	return lines, err
+}
+
+// CommandWithPrompt sends a command that answers with a "> " prompt, such
+// as AT+CMGS, then sends payload terminated by Ctrl+Z and waits for the
+// final result
+func (c *ATConn) CommandWithPrompt(cmd, payload string, timeout time.Duration) ([]string, error) {
+	c.cmd.Lock()
+	defer c.cmd.Unlock()
+
+	port, done, err := c.begin(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer c.end()
+
+	if _, err := port.Write([]byte(cmd + "\r")); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", cmd, err)
+	}
+	promptTimeout, _ := c.Timeouts()
+	if _, prompted, err := c.await(cmd, done, promptTimeout, true); err != nil {
+		return nil, err
+	} else if !prompted {
+		return nil, fmt.Errorf("modem answered %s without a prompt", cmd)
+	}
+
+	if _, err := port.Write([]byte(payload + ctrlZ)); err != nil {
+		return nil, fmt.Errorf("failed to write message body: %w", err)
+	}
+	lines, _, err := c.await(cmd, done, timeout, false)
+	return lines, err
+}
+
+// begin marks cmd as the running command and returns the port to send it
+// on, or ErrPortClosed while the modem is disconnected
+func (c *ATConn) begin(cmd string) (io.ReadWriter, chan struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return nil, nil, fmt.Errorf("%s: %w", cmd, ErrPortClosed)
+	default:
+	}
+
+	// Drop anything left over from an earlier command that timed out
+	for len(c.lines) > 0 {
+		<-c.lines
+	}
+	c.active = true
+	c.expect = responsePrefix(cmd)
+	return c.port, c.done, nil
+}
+
+func (c *ATConn) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active = false
+	c.expect = ""
+}
+
+// await collects response lines until a final result code or, if
+// wantPrompt is set, the "> " prompt. done is closed if the port fails.
+func (c *ATConn) await(cmd string, done chan struct{}, timeout time.Duration, wantPrompt bool) ([]string, bool, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var lines []string
+	for {
+		select {
+		case line := <-c.lines:
+			switch {
+			case line == ">":
+				if wantPrompt {
+					return lines, true, nil
+				}
+			case line == cmd:
+				// command echo
+			case line == "OK":
+				return lines, false, nil
+			case line == "ERROR":
+				return lines, false, &ATError{Command: cmd}
+			case strings.HasPrefix(line, "+CMS ERROR:"):
+				return lines, false, &CMSError{Code: errorCode(line)}
+			case strings.HasPrefix(line, "+CME ERROR:"):
+				return lines, false, &CMEError{Code: errorCode(line)}
+			default:
+				lines = append(lines, line)
+			}
+		case <-timer.C:
+			return lines, false, fmt.Errorf("%s: %w", cmd, ErrATTimeout)
+		case <-done:
+			return lines, false, fmt.Errorf("%s: %w", cmd, ErrPortClosed)
+		}
+	}
+}
+
+// responsePrefix derives the information response prefix of a command,
+// e.g. "+CMGS:" for AT+CMGS=12
+func responsePrefix(cmd string) string {
+	if !strings.HasPrefix(cmd, "AT+") && !strings.HasPrefix(cmd, "AT^") {
+		return ""
+	}
+	name := cmd[2:]
+	if i := strings.IndexAny(name, "=?"); i >= 0 {
+		name = name[:i]
+	}
+	return name + ":"
+}
+
+// errorCode parses the numeric code of a +CMS/+CME ERROR line. Modems in
+// verbose mode report text instead; those map to -1.
+func errorCode(line string) int {
+	_, value, _ := strings.Cut(line, ":")
+	code, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return -1
+	}
+	return code
+}
+
+// parseMessageReference extracts <mr> from a "+CMGS: <mr>" response
+func parseMessageReference(lines []string) (int, error) {
+	for _, line := range lines {
+		if value, ok := strings.CutPrefix(line, "+CMGS:"); ok {
+			value, _, _ = strings.Cut(strings.TrimSpace(value), ",")
+			return strconv.Atoi(value)
+		}
+	}
+	return 0, errors.New("no +CMGS message reference in modem response")
+}
+
+// classifySubmitError marks an AT+CMGS rejection of the recipient as
+// permanent. A plain ERROR and every other failure may be retried.
+func classifySubmitError(err error) error {
+	var cmsErr *CMSError
+	if errors.As(err, &cmsErr) && cmsErr.Permanent() {
+		return retry.Permanent(err)
+	}
+	return err
+}
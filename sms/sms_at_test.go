@@ -0,0 +1,205 @@
+package sms
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeModem simulates a modem on a serial port. Every command written to it
+// (terminated by CR, or Ctrl+Z for a message body) is passed to respond,
+// whose return value is what the modem sends back.
+type fakeModem struct {
+	mu      sync.Mutex
+	written bytes.Buffer
+	pending bytes.Buffer
+	respond func(cmd string) string
+	r       *io.PipeReader
+	w       *io.PipeWriter
+}
+
+func newFakeModem(respond func(cmd string) string) *fakeModem {
+	r, w := io.Pipe()
+	return &fakeModem{respond: respond, r: r, w: w}
+}
+
+func (m *fakeModem) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	m.written.Write(p)
+	var replies []string
+	for _, b := range p {
+		m.pending.WriteByte(b)
+		if b == '\r' || b == 0x1a {
+			replies = append(replies, m.respond(m.pending.String()))
+			m.pending.Reset()
+		}
+	}
+	m.mu.Unlock()
+
+	for _, reply := range replies {
+		if reply != "" {
+			if _, err := m.w.Write([]byte(reply)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (m *fakeModem) Read(p []byte) (int, error) {
+	return m.r.Read(p)
+}
+
+// Written returns everything that was written to the modem
+func (m *fakeModem) Written() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.written.String()
+}
+
+func (m *fakeModem) Close() error {
+	return m.w.Close()
+}
+
+// smsModem answers like a modem that accepts every message, replying with
+// final to the message body
+func smsModem(final string) func(cmd string) string {
+	return func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "AT+CMGS="):
+			return "\r\n> "
+		case strings.HasSuffix(cmd, "\x1a"):
+			return final
+		}
+		return "\r\nOK\r\n"
+	}
+}
+
+// TestATConnCommand tests final result codes, echo and interleaved URCs.
+func TestATConnCommand(t *testing.T) {
+	modem := newFakeModem(func(cmd string) string {
+		switch cmd {
+		case "AT+CSQ\r":
+			// Echo, a URC that shares nothing with the command, the response
+			return "AT+CSQ\r\r\n+CMTI: \"SM\",3\r\n+CSQ: 21,99\r\n\r\nOK\r\n"
+		case "AT+CREG?\r":
+			// The response prefix is also a URC prefix
+			return "\r\n+CREG: 0,1\r\n\r\nOK\r\n"
+		case "AT+CPIN?\r":
+			return "\r\n+CME ERROR: 10\r\n"
+		case "AT+CMGD=1\r":
+			return "\r\nERROR\r\n"
+		case "AT+CFUN=1\r":
+			// A delivery report in PDU mode: header line followed by the PDU
+			return "\r\n+CDS: 25\r\n0006D60B911326880736F4111011719551401110117195714000\r\n\r\nOK\r\n"
+		}
+		return ""
+	})
+	defer modem.Close()
+
+	conn := NewATConn(modem)
+	var mu sync.Mutex
+	var urcs []URC
+	record := func(urc URC) {
+		mu.Lock()
+		defer mu.Unlock()
+		urcs = append(urcs, urc)
+	}
+	conn.HandleURC("+CMTI", record)
+	conn.HandleURC("+CDS", record)
+
+	lines, err := conn.Command("AT+CSQ", time.Second)
+	if err != nil || len(lines) != 1 || lines[0] != "+CSQ: 21,99" {
+		t.Errorf("AT+CSQ = %q, %v", lines, err)
+	}
+	lines, err = conn.Command("AT+CREG?", time.Second)
+	if err != nil || len(lines) != 1 || lines[0] != "+CREG: 0,1" {
+		t.Errorf("AT+CREG? = %q, %v", lines, err)
+	}
+
+	var cmeErr *CMEError
+	if _, err := conn.Command("AT+CPIN?", time.Second); !errors.As(err, &cmeErr) || cmeErr.Code != 10 {
+		t.Errorf("AT+CPIN? error = %v, want +CME ERROR: 10", err)
+	}
+	var atErr *ATError
+	if _, err := conn.Command("AT+CMGD=1", time.Second); !errors.As(err, &atErr) {
+		t.Errorf("AT+CMGD=1 error = %v, want ATError", err)
+	}
+	if _, err := conn.Command("AT+CFUN=1", time.Second); err != nil {
+		t.Errorf("AT+CFUN=1 error = %v", err)
+	}
+	if _, err := conn.Command("AT", 50*time.Millisecond); !errors.Is(err, ErrATTimeout) {
+		t.Errorf("AT error = %v, want ErrATTimeout", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := len(urcs)
+		mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(urcs) != 2 {
+		t.Fatalf("Expected 2 URCs, got %+v", urcs)
+	}
+	if urcs[0].Name != "+CMTI" || urcs[0].Line != `+CMTI: "SM",3` {
+		t.Errorf("Unexpected first URC %+v", urcs[0])
+	}
+	if urcs[1].Name != "+CDS" || !strings.HasPrefix(urcs[1].PDU, "0006D6") {
+		t.Errorf("Unexpected second URC %+v", urcs[1])
+	}
+}
+
+// TestATConnPortClosed tests that commands fail once the port is gone.
+func TestATConnPortClosed(t *testing.T) {
+	modem := newFakeModem(func(string) string { return "" })
+	conn := NewATConn(modem)
+	modem.Close()
+
+	if _, err := conn.Command("AT", time.Second); !errors.Is(err, ErrPortClosed) {
+		t.Errorf("Expected ErrPortClosed, got %v", err)
+	}
+}
+
+// TestCMSErrorPermanent tests which +CMS ERROR codes are not worth retrying.
+func TestCMSErrorPermanent(t *testing.T) {
+	tests := []struct {
+		code      int
+		permanent bool
+	}{
+		{1, true},    // unassigned number
+		{10, true},   // call barred
+		{42, false},  // congestion
+		{304, false}, // invalid PDU mode parameter
+		{331, false}, // no network service
+		{500, false}, // unknown error
+	}
+	for _, tc := range tests {
+		if got := (&CMSError{Code: tc.code}).Permanent(); got != tc.permanent {
+			t.Errorf("CMSError{%d}.Permanent() = %v, want %v", tc.code, got, tc.permanent)
+		}
+	}
+}
+
+// TestParseMessageReference tests parsing of the +CMGS response.
+func TestParseMessageReference(t *testing.T) {
+	if mr, err := parseMessageReference([]string{"+CMGS: 17"}); err != nil || mr != 17 {
+		t.Errorf("parseMessageReference = %d, %v", mr, err)
+	}
+	// Some modems append the SCTS
+	if mr, err := parseMessageReference([]string{`+CMGS: 5,"24/01/01,12:00:00+00"`}); err != nil || mr != 5 {
+		t.Errorf("parseMessageReference = %d, %v", mr, err)
+	}
+	if _, err := parseMessageReference(nil); err == nil {
+		t.Error("Expected an error without +CMGS line")
+	}
+}
@@ -0,0 +1,77 @@
+package sms
+
+import (
+	"sync"
+	"time"
+)
+
+// DeadLetter is a message that could not be delivered after all retries
+type DeadLetter struct {
+	SMS      *SMS      `json:"sms"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// DeadLetterStore keeps dead letters in the order they failed
+type DeadLetterStore struct {
+	mu      sync.Mutex
+	order   []string
+	letters map[string]DeadLetter
+}
+
+// NewDeadLetterStore creates an empty dead-letter store
+func NewDeadLetterStore() *DeadLetterStore {
+	return &DeadLetterStore{letters: make(map[string]DeadLetter)}
+}
+
+// Add stores a dead letter, replacing any earlier one with the same ID
+func (s *DeadLetterStore) Add(letter DeadLetter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.letters[letter.SMS.ID]; !exists {
+		s.order = append(s.order, letter.SMS.ID)
+	}
+	s.letters[letter.SMS.ID] = letter
+}
+
+// Get returns the dead letter with the given message ID
+func (s *DeadLetterStore) Get(id string) (DeadLetter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letter, ok := s.letters[id]
+	return letter, ok
+}
+
+// List returns all dead letters, oldest first
+func (s *DeadLetterStore) List() []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters := make([]DeadLetter, 0, len(s.order))
+	for _, id := range s.order {
+		letters = append(letters, s.letters[id])
+	}
+	return letters
+}
+
+// Take removes and returns the dead letter with the given message ID. Only
+// one of several concurrent callers gets it.
+func (s *DeadLetterStore) Take(id string) (DeadLetter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letter, exists := s.letters[id]
+	if !exists {
+		return DeadLetter{}, false
+	}
+	delete(s.letters, id)
+	for i, existing := range s.order {
+		if existing == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return letter, true
+}
@@ -0,0 +1,84 @@
+package sms
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker states reported by ProviderHealth
+const (
+	CircuitClosed = "closed" // provider is used normally
+	CircuitOpen   = "open"   // provider is skipped until the cooldown ends
+)
+
+// ProviderHealth is a snapshot of the health of one provider in the chain
+type ProviderHealth struct {
+	Name                string    `json:"name"`
+	Circuit             string    `json:"circuit"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Sent                int       `json:"sent"`
+	Failed              int       `json:"failed"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastSuccess         time.Time `json:"last_success,omitempty"`
+	LastFailure         time.Time `json:"last_failure,omitempty"`
+	OpenUntil           time.Time `json:"open_until,omitempty"`
+}
+
+// circuitBreaker tracks the health of a single provider. After threshold
+// consecutive failures it opens and the provider is skipped for cooldown;
+// the first send after the cooldown decides whether it closes again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	health    ProviderHealth
+	threshold int
+	cooldown  time.Duration
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		health:    ProviderHealth{Name: name, Circuit: CircuitClosed},
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// allow reports whether the provider may be used now
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.health.Circuit == CircuitClosed || !time.Now().Before(b.health.OpenUntil)
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.health.Sent++
+	b.health.ConsecutiveFailures = 0
+	b.health.LastSuccess = time.Now().UTC()
+	b.health.Circuit = CircuitClosed
+	b.health.OpenUntil = time.Time{}
+}
+
+// failure records a provider failure and reports whether it opened the circuit
+func (b *circuitBreaker) failure(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.health.Failed++
+	b.health.ConsecutiveFailures++
+	b.health.LastError = err.Error()
+	b.health.LastFailure = time.Now().UTC()
+	if b.threshold > 0 && b.health.ConsecutiveFailures >= b.threshold {
+		b.health.Circuit = CircuitOpen
+		b.health.OpenUntil = b.health.LastFailure.Add(b.cooldown)
+		return true
+	}
+	return false
+}
+
+func (b *circuitBreaker) snapshot() ProviderHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.health
+}
@@ -1,7 +1,20 @@
 package sms
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"message_handler/api"
+	"message_handler/schedule"
+	"message_handler/status"
+	"message_handler/templates"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
+
+	"github.com/twilio/twilio-go/client"
 )
 
 // ValidatePhone checks if the phone number is in a valid E.164 format
@@ -19,3 +32,426 @@ func maskPhone(phone string) string {
 	}
 	return "****"
 }
+
+// sendRequest is a request to send an SMS, from a form or a JSON body
+type sendRequest struct {
+	Phone    string         `json:"phone"`
+	Message  string         `json:"message,omitempty"`
+	Template string         `json:"template,omitempty"`
+	Vars     map[string]any `json:"vars,omitempty"`
+	Locale   string         `json:"locale,omitempty"`
+	SendAt   string         `json:"send_at,omitempty"`
+}
+
+// HandleSendSMS queues the SMS described by the form fields under a new
+// message ID and answers 202 Accepted. The message may instead come from
+// a stored template, filled in with vars in the variant for the "locale"
+// field or, without one, for the language of the recipient's country. An
+// SMS with a send_at time is handed to scheduler instead.
+func HandleSendSMS(w http.ResponseWriter, r *http.Request, q *SMSQueue, scheduler *schedule.Scheduler, store *templates.Store, maxSegments int) {
+	req := &sendRequest{
+		Phone:    r.FormValue("phone"),
+		Message:  r.FormValue("message"),
+		Template: r.FormValue("template"),
+		Locale:   r.FormValue("locale"),
+		SendAt:   r.FormValue("send_at"),
+	}
+	if req.Template != "" {
+		vars, err := templates.ParseVars(r.FormValue("vars"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Vars = vars
+	}
+
+	msg, sendAt, apiErr := prepareSMS(req, store, maxSegments)
+	if apiErr == nil {
+		apiErr = submitSMS(msg, sendAt, q, scheduler)
+	}
+	if apiErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
+		return
+	}
+
+	w.Header().Set("X-Message-ID", msg.ID)
+	w.WriteHeader(http.StatusAccepted)
+	if !sendAt.IsZero() {
+		_, _ = fmt.Fprintf(w, "SMS scheduled for %s (id: %s)\n", sendAt.UTC().Format(time.RFC3339), msg.ID)
+		return
+	}
+	_, _ = fmt.Fprintf(w, "SMS queued successfully (id: %s)\n", msg.ID)
+}
+
+// HandleSendSMSJSON is HandleSendSMS for the JSON API: it takes the same
+// fields as a JSON object and answers with the message ID and its state,
+// or a structured error.
+func HandleSendSMSJSON(w http.ResponseWriter, r *http.Request, q *SMSQueue, scheduler *schedule.Scheduler, store *templates.Store, maxSegments int) {
+	var req sendRequest
+	if apiErr := api.Decode(w, r, &req, 0); apiErr != nil {
+		api.WriteError(w, apiErr)
+		return
+	}
+
+	msg, sendAt, apiErr := prepareSMS(&req, store, maxSegments)
+	if apiErr == nil {
+		apiErr = submitSMS(msg, sendAt, q, scheduler)
+	}
+	if apiErr != nil {
+		api.WriteError(w, apiErr)
+		return
+	}
+	w.Header().Set("X-Message-ID", msg.ID)
+	w.Header().Set("Location", "/api/v1/messages/"+msg.ID)
+	api.WriteJSON(w, http.StatusAccepted, api.NewAccepted(msg.ID, sendAt))
+}
+
+// smsBatch is a batch request: either a list of messages, or one message
+// sent to each of several phones
+type smsBatch struct {
+	Messages []sendRequest `json:"messages,omitempty"`
+	Phones   []string      `json:"phones,omitempty"`
+	sendRequest
+}
+
+// requests lists the messages of a batch of at most max messages
+func (b *smsBatch) requests(max int) ([]sendRequest, *api.Error) {
+	shared := b.Phone != "" || b.Message != "" || b.Template != "" || b.Vars != nil || b.Locale != "" || b.SendAt != ""
+	switch {
+	case len(b.Messages) > 0 && (len(b.Phones) > 0 || shared):
+		return nil, api.Errorf(http.StatusBadRequest, "conflicting_fields", "messages", "A batch has either messages or phones with one message")
+	case b.Phone != "":
+		return nil, api.Errorf(http.StatusBadRequest, "conflicting_fields", "phone", "A batch takes phones, not phone")
+	case len(b.Messages) == 0 && len(b.Phones) == 0:
+		return nil, api.Errorf(http.StatusBadRequest, "missing_field", "messages", "A batch needs messages or phones")
+	}
+
+	reqs := b.Messages
+	if len(b.Phones) > 0 {
+		reqs = make([]sendRequest, len(b.Phones))
+		for i, phone := range b.Phones {
+			reqs[i] = b.sendRequest
+			reqs[i].Phone = phone
+		}
+	}
+	if len(reqs) > max {
+		return nil, api.Errorf(http.StatusRequestEntityTooLarge, "batch_too_large", "messages", "Batch of %d messages, maximum is %d", len(reqs), max)
+	}
+	return reqs, nil
+}
+
+// HandleSendSMSBatch sends a batch of up to maxBatch messages with a
+// single request. Every message is checked first; if any is invalid the
+// batch is rejected with the errors of those messages. Otherwise the
+// messages are queued, and those with a send_at time scheduled, together:
+// either all are accepted or, with the queue full, none.
+func HandleSendSMSBatch(w http.ResponseWriter, r *http.Request, q *SMSQueue, scheduler *schedule.Scheduler, store *templates.Store, maxSegments, maxBatch int) {
+	var batch smsBatch
+	if apiErr := api.Decode(w, r, &batch, int64(maxBatch)*api.BatchEntrySize); apiErr != nil {
+		api.WriteError(w, apiErr)
+		return
+	}
+	reqs, apiErr := batch.requests(maxBatch)
+	if apiErr != nil {
+		api.WriteError(w, apiErr)
+		return
+	}
+
+	msgs := make([]*SMS, len(reqs))
+	sendAts := make([]time.Time, len(reqs))
+	var invalid []api.BatchResult
+	for i := range reqs {
+		msg, sendAt, apiErr := prepareSMS(&reqs[i], store, maxSegments)
+		if apiErr != nil {
+			invalid = append(invalid, api.BatchResult{Index: i, Error: apiErr})
+			continue
+		}
+		msgs[i], sendAts[i] = msg, sendAt
+	}
+	if len(invalid) > 0 {
+		api.WriteJSON(w, http.StatusBadRequest, api.InvalidBatch(invalid, len(reqs)))
+		return
+	}
+
+	if apiErr := submitSMSBatch(msgs, sendAts, q, scheduler); apiErr != nil {
+		api.WriteError(w, apiErr)
+		return
+	}
+	results := make([]api.BatchResult, len(msgs))
+	for i, msg := range msgs {
+		accepted := api.NewAccepted(msg.ID, sendAts[i])
+		results[i] = api.BatchResult{Index: i, Accepted: &accepted}
+	}
+	api.WriteJSON(w, http.StatusAccepted, api.BatchResponse{Results: results})
+}
+
+// submitSMSBatch schedules the messages with a send time and queues the
+// others. If they cannot be queued, the scheduled ones are canceled again.
+func submitSMSBatch(msgs []*SMS, sendAts []time.Time, q *SMSQueue, scheduler *schedule.Scheduler) *api.Error {
+	var now []*SMS
+	var jobs []schedule.Job
+	for i, msg := range msgs {
+		if sendAts[i].IsZero() {
+			now = append(now, msg)
+			continue
+		}
+		msg.ID = status.NewID()
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			log.Printf("Failed to schedule SMS: %v", err)
+			return api.Errorf(http.StatusInternalServerError, "internal_error", "", "Failed to schedule SMS")
+		}
+		jobs = append(jobs, schedule.Job{ID: msg.ID, Kind: status.KindSMS, SendAt: sendAts[i], Payload: payload})
+	}
+
+	if len(jobs) > 0 {
+		if scheduler == nil {
+			return api.Errorf(http.StatusServiceUnavailable, "unavailable", "send_at", "Scheduled sending is not available")
+		}
+		if err := scheduler.ScheduleAll(jobs...); err != nil {
+			log.Printf("Failed to schedule SMS: %v", err)
+			return api.Errorf(http.StatusInternalServerError, "internal_error", "", "Failed to schedule SMS")
+		}
+	}
+	if len(now) == 0 {
+		return nil
+	}
+	err := q.SendAll(now...)
+	if err == nil {
+		return nil
+	}
+	for _, job := range jobs {
+		if err := scheduler.Cancel(job.ID); err != nil {
+			log.Printf("Failed to cancel scheduled SMS %s of a rejected batch: %v", job.ID, err)
+		}
+	}
+	switch {
+	case errors.Is(err, ErrBatchTooLarge):
+		return api.Errorf(http.StatusRequestEntityTooLarge, "batch_too_large", "messages", "Batch of %d messages is larger than the SMS queue", len(now))
+	case errors.Is(err, ErrQueueFull):
+		return api.Errorf(http.StatusServiceUnavailable, "queue_full", "", "SMS queue has no room for %d messages, try again later", len(now))
+	}
+	log.Printf("Failed to queue SMS: %v", err)
+	return api.Errorf(http.StatusInternalServerError, "internal_error", "", "Failed to queue SMS")
+}
+
+// prepareSMS checks a request and builds the SMS it describes, along with
+// its send time, zero to send it now
+func prepareSMS(req *sendRequest, store *templates.Store, maxSegments int) (*SMS, time.Time, *api.Error) {
+	message := req.Message
+	if req.Template != "" {
+		if message != "" {
+			return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "conflicting_fields", "template", "A template cannot be combined with message")
+		}
+		// Without a locale, the language of the recipient's country
+		locale := req.Locale
+		if locale == "" {
+			locale = PhoneLocale(req.Phone)
+		}
+		if store == nil {
+			return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "unknown_template", "template", "Templates are not available")
+		}
+		rendered, err := store.Render(req.Template, locale, req.Vars)
+		if err != nil {
+			if errors.Is(err, templates.ErrNotFound) {
+				return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "unknown_template", "template", "%s", err.Error())
+			}
+			return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "template_error", "vars", "%s", err.Error())
+		}
+		message = rendered.Text
+	}
+
+	if !ValidatePhone(req.Phone) {
+		return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "invalid_phone", "phone", "Invalid phone number format")
+	}
+	if strings.TrimSpace(message) == "" {
+		return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "missing_field", "message", "Message cannot be empty")
+	}
+	if segments := CountSegments(message); segments > maxSegments {
+		return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "message_too_long", "message", "Message too long: %d segments, maximum is %d", segments, maxSegments)
+	}
+
+	sendAt, err := schedule.ParseSendAt(req.SendAt)
+	if err != nil {
+		return nil, time.Time{}, api.Errorf(http.StatusBadRequest, "invalid_send_at", "send_at", "%s", err.Error())
+	}
+	return &SMS{Recipient: req.Phone, Message: message}, sendAt, nil
+}
+
+// submitSMS queues an SMS, or hands it to scheduler if it has a send time.
+// The queue assigns the ID of a message sent now.
+func submitSMS(msg *SMS, sendAt time.Time, q *SMSQueue, scheduler *schedule.Scheduler) *api.Error {
+	if !sendAt.IsZero() {
+		if scheduler == nil {
+			return api.Errorf(http.StatusServiceUnavailable, "unavailable", "send_at", "Scheduled sending is not available")
+		}
+		msg.ID = status.NewID()
+		payload, err := json.Marshal(msg)
+		if err == nil {
+			err = scheduler.Schedule(schedule.Job{ID: msg.ID, Kind: status.KindSMS, SendAt: sendAt, Payload: payload})
+		}
+		if err != nil {
+			log.Printf("Failed to schedule SMS: %v", err)
+			return api.Errorf(http.StatusInternalServerError, "internal_error", "", "Failed to schedule SMS")
+		}
+		return nil
+	}
+	if err := q.Send(msg); err != nil {
+		if errors.Is(err, ErrQueueFull) {
+			return api.Errorf(http.StatusServiceUnavailable, "queue_full", "", "SMS queue is full, try again later")
+		}
+		log.Printf("Failed to queue SMS: %v", err)
+		return api.Errorf(http.StatusInternalServerError, "internal_error", "", "Failed to queue SMS")
+	}
+	return nil
+}
+
+// HandleProviderHealth writes the health of the provider chain as JSON
+func HandleProviderHealth(w http.ResponseWriter, r *http.Request, q *SMSQueue) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(q.ProviderHealth()); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// HandleListDeadLetters writes all dead letters as JSON
+func HandleListDeadLetters(w http.ResponseWriter, r *http.Request, q *SMSQueue) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(q.DeadLetters()); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// HandleRequeueDeadLetter moves the dead letter named in the path back into the queue
+func HandleRequeueDeadLetter(w http.ResponseWriter, r *http.Request, q *SMSQueue) {
+	id := r.PathValue("id")
+	if err := q.Requeue(id); err != nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte("Dead letter requeued\n"))
+}
+
+// HandlePurgeDeadLetters discards the dead letter named in the path, or all
+// dead letters if the path has no ID
+func HandlePurgeDeadLetters(w http.ResponseWriter, r *http.Request, q *SMSQueue) {
+	if id := r.PathValue("id"); id != "" {
+		if err := q.Purge(id); err != nil {
+			writeDeadLetterError(w, err)
+			return
+		}
+		_, _ = w.Write([]byte("Dead letter purged\n"))
+		return
+	}
+
+	purged, err := q.PurgeAll()
+	if err != nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	_, _ = fmt.Fprintf(w, "Purged %d dead letter(s)\n", purged)
+}
+
+func writeDeadLetterError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrQueueFull) {
+		http.Error(w, "SMS queue is full, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Dead letter operation failed: %v", err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// HandleInbox writes the received messages as JSON
+func HandleInbox(w http.ResponseWriter, r *http.Request, inbox *Inbox) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(inbox.List()); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// twilioStates maps Twilio message statuses to message states
+var twilioStates = map[string]status.State{
+	"accepted":            status.Queued,
+	"scheduled":           status.Queued,
+	"queued":              status.Queued,
+	"sending":             status.Sending,
+	"sent":                status.Sent,
+	"delivered":           status.Delivered,
+	"read":                status.Delivered,
+	"partially_delivered": status.Undelivered,
+	"undelivered":         status.Undelivered,
+	"failed":              status.Failed,
+	"canceled":            status.Failed,
+}
+
+// HandleTwilioStatus receives Twilio's message status callbacks and records
+// the new state of the message named by the "id" query parameter. The
+// X-Twilio-Signature header is checked against callbackURL, the public URL
+// Twilio was given, since the URL of the request may differ behind a proxy.
+func HandleTwilioStatus(w http.ResponseWriter, r *http.Request, authToken, callbackURL string, store *status.Store) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	signedURL, err := url.Parse(callbackURL)
+	if err != nil {
+		log.Printf("Invalid status callback URL: %v", err)
+		http.Error(w, "Status callback misconfigured", http.StatusInternalServerError)
+		return
+	}
+	signedURL.RawQuery = r.URL.RawQuery
+
+	params := make(map[string]string, len(r.PostForm))
+	for key, values := range r.PostForm {
+		params[key] = values[0]
+	}
+	validator := client.NewRequestValidator(authToken)
+	if !validator.Validate(signedURL.String(), params, r.Header.Get("X-Twilio-Signature")) {
+		log.Printf("Rejected Twilio status callback with an invalid signature")
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing message id", http.StatusBadRequest)
+		return
+	}
+	state, ok := twilioStates[params["MessageStatus"]]
+	if !ok {
+		log.Printf("Ignoring unknown Twilio status %q for SMS %s", params["MessageStatus"], id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, tracked := store.Get(id); !tracked {
+		log.Printf("Ignoring Twilio status for unknown SMS %s", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var statusErr error
+	if code := params["ErrorCode"]; code != "" {
+		statusErr = fmt.Errorf("Twilio error %s", code)
+		if message := params["ErrorMessage"]; message != "" {
+			statusErr = fmt.Errorf("Twilio error %s: %s", code, message)
+		}
+	}
+	if store.Advance(id, status.KindSMS, state, statusErr) {
+		log.Printf("SMS %s is %s according to Twilio", id, state)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleModemHealth writes the health of every modem in the pool as JSON
+func HandleModemHealth(w http.ResponseWriter, r *http.Request, pool *ModemPool) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pool.Health()); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
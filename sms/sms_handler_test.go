@@ -0,0 +1,222 @@
+package sms
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"message_handler/api"
+	"message_handler/schedule"
+	"message_handler/status"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// twilioSignature computes X-Twilio-Signature for a form POST to fullURL
+func twilioSignature(authToken, fullURL string, form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := fullURL
+	for _, key := range keys {
+		data += key + form.Get(key)
+	}
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TestHandleTwilioStatus tests signature checks and status updates of the
+// Twilio status callback.
+func TestHandleTwilioStatus(t *testing.T) {
+	const authToken = "secret"
+	const callbackURL = "https://sms.example.com/twilio/status"
+
+	store := status.NewStore(10)
+	store.Set("msg-1", status.KindSMS, status.Sent, nil)
+
+	post := func(id string, form url.Values, signature string) int {
+		req := httptest.NewRequest(http.MethodPost, "/twilio/status?id="+id, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if signature == "" {
+			signature = twilioSignature(authToken, callbackURL+"?id="+id, form)
+		}
+		req.Header.Set("X-Twilio-Signature", signature)
+		rr := httptest.NewRecorder()
+		HandleTwilioStatus(rr, req, authToken, callbackURL, store)
+		return rr.Code
+	}
+
+	undelivered := url.Values{"MessageSid": {"SM1"}, "MessageStatus": {"undelivered"}, "ErrorCode": {"30003"}}
+	if code := post("msg-1", undelivered, "bm90IGEgc2lnbmF0dXJl"); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a bad signature, got %d", code)
+	}
+	if record, _ := store.Get("msg-1"); record.State != status.Sent {
+		t.Errorf("Bad signature changed the state to %s", record.State)
+	}
+
+	if code := post("msg-1", undelivered, ""); code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", code)
+	}
+	record, _ := store.Get("msg-1")
+	if record.State != status.Undelivered || !strings.Contains(record.Error, "30003") {
+		t.Errorf("Expected undelivered with error code, got %+v", record)
+	}
+
+	// A late "sent" does not undo the final state
+	if code := post("msg-1", url.Values{"MessageSid": {"SM1"}, "MessageStatus": {"sent"}}, ""); code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", code)
+	}
+	if record, _ := store.Get("msg-1"); record.State != status.Undelivered {
+		t.Errorf("Out-of-order callback changed the state to %s", record.State)
+	}
+
+	// Unknown messages are acknowledged but not tracked
+	if code := post("other", url.Values{"MessageStatus": {"delivered"}}, ""); code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", code)
+	}
+	if _, ok := store.Get("other"); ok {
+		t.Error("Callback created a record for an unknown message")
+	}
+}
+
+// TestStatusCallbackURL tests that the message ID is added to the URL.
+func TestStatusCallbackURL(t *testing.T) {
+	got, err := statusCallbackURL("https://sms.example.com/twilio/status?tenant=a", "abc")
+	if err != nil || got != "https://sms.example.com/twilio/status?id=abc&tenant=a" {
+		t.Errorf("statusCallbackURL = %q, %v", got, err)
+	}
+}
+
+// TestPhoneLocale tests the language lookup by country calling code.
+func TestPhoneLocale(t *testing.T) {
+	tests := map[string]string{
+		"+31612345678":   "nl",
+		"+4915112345678": "de",
+		"+12025550123":   "en",
+		"+351912345678":  "pt",
+		"+999123456789":  "",
+		"0612345678":     "",
+	}
+	for phone, want := range tests {
+		if got := PhoneLocale(phone); got != want {
+			t.Errorf("PhoneLocale(%q) = %q, want %q", phone, got, want)
+		}
+	}
+}
+
+// TestHandleSendSMSJSON tests the JSON API for sending an SMS.
+func TestHandleSendSMSJSON(t *testing.T) {
+	queue := NewSMSQueue(10)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/sms", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		HandleSendSMSJSON(rr, req, queue, nil, nil, 10)
+		return rr
+	}
+
+	rr := send(`{"phone": "+31612345678", "message": "Hi"}`)
+	var accepted api.Accepted
+	if err := json.Unmarshal(rr.Body.Bytes(), &accepted); err != nil || rr.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 with JSON, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if accepted.ID == "" || accepted.Status != status.Queued || rr.Header().Get("Location") != "/api/v1/messages/"+accepted.ID {
+		t.Errorf("Unexpected answer %+v, Location %q", accepted, rr.Header().Get("Location"))
+	}
+	if msg := <-queue.queue; msg.ID != accepted.ID || msg.Message != "Hi" {
+		t.Errorf("Unexpected queued message %+v", msg)
+	}
+
+	tests := []struct {
+		body, code, field string
+	}{
+		{`{"phone": "12345", "message": "Hi"}`, "invalid_phone", "phone"},
+		{`{"phone": "+31612345678", "message": " "}`, "missing_field", "message"},
+		{`{"phone": "+31612345678", "message": "Hi", "send_at": "tomorrow"}`, "invalid_send_at", "send_at"},
+		{`{"phone": "+31612345678", "template": "welcome"}`, "unknown_template", "template"},
+	}
+	for _, tt := range tests {
+		rr := send(tt.body)
+		var apiErr api.Error
+		if err := json.Unmarshal(rr.Body.Bytes(), &apiErr); err != nil || rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected a 400 JSON error, got %d: %s", tt.body, rr.Code, rr.Body.String())
+			continue
+		}
+		if apiErr.Code != tt.code || apiErr.Field != tt.field {
+			t.Errorf("%s: expected %s on %s, got %+v", tt.body, tt.code, tt.field, apiErr)
+		}
+	}
+}
+
+// TestHandleSendSMSBatch tests batch validation and atomic queueing.
+func TestHandleSendSMSBatch(t *testing.T) {
+	queue := NewSMSQueue(3)
+	scheduler, err := schedule.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	scheduler.Handle(status.KindSMS, func(schedule.Job) error { return nil })
+
+	send := func(body string) (*httptest.ResponseRecorder, api.BatchResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/sms/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		HandleSendSMSBatch(rr, req, queue, scheduler, nil, 10, 4)
+		var resp api.BatchResponse
+		_ = json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr, resp
+	}
+
+	// One message to several phones
+	rr, resp := send(`{"phones": ["+31612345678", "+31612345679"], "message": "Server down"}`)
+	if rr.Code != http.StatusAccepted || len(resp.Results) != 2 || resp.Results[1].Index != 1 || resp.Results[1].Status != status.Queued {
+		t.Fatalf("Expected 2 queued messages, got %d: %s", rr.Code, rr.Body.String())
+	}
+	for _, result := range resp.Results {
+		if msg := <-queue.queue; msg.ID != result.ID || msg.Message != "Server down" {
+			t.Errorf("Unexpected queued message %+v for %+v", msg, result)
+		}
+	}
+
+	// A single invalid message rejects the whole batch
+	rr, resp = send(`{"messages": [{"phone": "+31612345678", "message": "Hi"}, {"phone": "123", "message": "Hi"}, {"phone": "+31612345678"}]}`)
+	if rr.Code != http.StatusBadRequest || resp.Code != "invalid_batch" || len(resp.Results) != 2 ||
+		resp.Results[0].Index != 1 || resp.Results[0].Error.Code != "invalid_phone" || resp.Results[1].Error.Field != "message" {
+		t.Errorf("Expected the invalid messages to be listed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(queue.queue) != 0 {
+		t.Errorf("Expected nothing queued, got %d messages", len(queue.queue))
+	}
+
+	// No room for all of them: the scheduled one is canceled again
+	if err := queue.Send(&SMS{Recipient: "+31612345678", Message: "Hi"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	sendAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	rr, _ = send(`{"messages": [{"phone": "+31612345678", "message": "A"}, {"phone": "+31612345678", "message": "B"},
+		{"phone": "+31612345678", "message": "C"}, {"phone": "+31612345678", "message": "D", "send_at": "` + sendAt + `"}]}`)
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "queue_full") {
+		t.Errorf("Expected queue_full, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(queue.queue) != 1 || len(scheduler.List()) != 0 {
+		t.Errorf("Expected nothing added, got %d queued and %d scheduled", len(queue.queue), len(scheduler.List()))
+	}
+
+	rr, _ = send(`{"phones": ["+31612345670", "+31612345671", "+31612345672", "+31612345673", "+31612345674"], "message": "Hi"}`)
+	if rr.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rr.Body.String(), "batch_too_large") {
+		t.Errorf("Expected batch_too_large, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr, _ = send(`{"phones": ["+31612345678"], "messages": [{"phone": "+31612345678", "message": "Hi"}]}`)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "conflicting_fields") {
+		t.Errorf("Expected conflicting_fields, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
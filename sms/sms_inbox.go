@@ -0,0 +1,359 @@
+package sms
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"message_handler/retry"
+	"message_handler/status"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// partTimeout is how long the parts of a concatenated message are kept
+	// waiting for the rest
+	partTimeout = 24 * time.Hour
+
+	// webhookQueueSize is the number of messages waiting to be forwarded
+	webhookQueueSize = 100
+)
+
+// InboundSMS is a message received by the modem
+type InboundSMS struct {
+	ID         string    `json:"id"`
+	From       string    `json:"from"`
+	Message    string    `json:"message"`
+	SentAt     time.Time `json:"sent_at"` // Service centre time stamp
+	ReceivedAt time.Time `json:"received_at"`
+	Segments   int       `json:"segments"`
+}
+
+// Inbox keeps the most recently received messages in memory
+type Inbox struct {
+	mu       sync.Mutex
+	messages []InboundSMS
+	max      int
+}
+
+// NewInbox creates an inbox that keeps up to max messages
+func NewInbox(max int) *Inbox {
+	return &Inbox{max: max}
+}
+
+// Add stores a message, dropping the oldest one when the inbox is full
+func (i *Inbox) Add(msg InboundSMS) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.messages = append(i.messages, msg)
+	if len(i.messages) > i.max {
+		i.messages = i.messages[len(i.messages)-i.max:]
+	}
+}
+
+// List returns the stored messages, oldest first
+func (i *Inbox) List() []InboundSMS {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	messages := make([]InboundSMS, len(i.messages))
+	copy(messages, i.messages)
+	return messages
+}
+
+// StoredMessage is a message in the modem's storage
+type StoredMessage struct {
+	Index int
+	PDU   string
+}
+
+// ListMessages returns every message in the modem's message storage
+func (p *HardwareProvider) ListMessages() ([]StoredMessage, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	timeout, _ := p.conn.Timeouts()
+	if _, err := p.conn.Command("AT+CMGF=0", timeout); err != nil {
+		return nil, fmt.Errorf("failed to set PDU mode: %w", err)
+	}
+	lines, err := p.conn.Command("AT+CMGL=4", timeout) // 4: all messages
+	if err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+	return parseMessageList(lines), nil
+}
+
+// parseMessageList parses the "+CMGL: <index>,<stat>,[<alpha>],<length>"
+// lines of an AT+CMGL response, each followed by its PDU
+func parseMessageList(lines []string) []StoredMessage {
+	var messages []StoredMessage
+	for i := 0; i < len(lines); i++ {
+		header, ok := strings.CutPrefix(lines[i], "+CMGL:")
+		if !ok || i+1 >= len(lines) {
+			continue
+		}
+		field, _, _ := strings.Cut(strings.TrimSpace(header), ",")
+		index, err := strconv.Atoi(field)
+		if err != nil {
+			log.Printf("Modem: skipping unreadable message list entry %q", lines[i])
+			continue
+		}
+		i++
+		messages = append(messages, StoredMessage{Index: index, PDU: lines[i]})
+	}
+	return messages
+}
+
+// DeleteMessage removes a message from the modem's message storage
+func (p *HardwareProvider) DeleteMessage(index int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	timeout, _ := p.conn.Timeouts()
+	if _, err := p.conn.Command(fmt.Sprintf("AT+CMGD=%d", index), timeout); err != nil {
+		return fmt.Errorf("failed to delete message %d: %w", index, err)
+	}
+	return nil
+}
+
+// concatKey identifies the parts of one concatenated message
+type concatKey struct {
+	sender string
+	ref    int
+	total  int
+}
+
+// partialMessage collects the parts of a concatenated message
+type partialMessage struct {
+	parts    map[int]*DeliverPDU
+	received time.Time // when the first part arrived
+}
+
+// Receiver reads incoming messages from the modem, stores them in the
+// inbox and forwards them to a webhook. It reacts to +CMTI new message
+// indications and also polls the storage periodically, so messages that
+// arrived while the service was down are picked up too. Messages are
+// deleted from the SIM once read.
+type Receiver struct {
+	modem    *HardwareProvider
+	inbox    *Inbox
+	poll     time.Duration
+	parts    map[concatKey]*partialMessage // worker only
+	wake     chan struct{}
+	webhook  string
+	client   *http.Client
+	retry    retry.Policy
+	forwards chan InboundSMS
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewReceiver creates a receiver for the modem that stores messages in inbox
+func NewReceiver(modem *HardwareProvider, inbox *Inbox) *Receiver {
+	return &Receiver{
+		modem:    modem,
+		inbox:    inbox,
+		poll:     time.Minute,
+		parts:    make(map[concatKey]*partialMessage),
+		wake:     make(chan struct{}, 1),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		retry:    retry.Policy{MaxAttempts: 5, BaseDelay: 2 * time.Second, MaxDelay: time.Minute, Jitter: 0.2},
+		forwards: make(chan InboundSMS, webhookQueueSize),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// SetWebhook makes the receiver POST every message as JSON to url
+func (r *Receiver) SetWebhook(url string) {
+	r.webhook = url
+}
+
+// SetPollInterval configures how often the modem storage is checked
+// without a new message indication
+func (r *Receiver) SetPollInterval(interval time.Duration) {
+	r.poll = interval
+}
+
+// Start enables new message indications and begins reading messages
+func (r *Receiver) Start() {
+	conn := r.modem.Conn()
+	conn.HandleURC("+CMTI", func(URC) {
+		select {
+		case r.wake <- struct{}{}:
+		default: // a check is already pending
+		}
+	})
+	if r.modem.Connected() {
+		if err := r.modem.EnableIndications(); err != nil {
+			log.Printf("Modem: %v, relying on polling", err)
+		}
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.poll)
+		defer ticker.Stop()
+		for {
+			r.check()
+			select {
+			case <-r.wake:
+			case <-ticker.C:
+			case <-r.stopCh:
+				return
+			}
+		}
+	}()
+
+	if r.webhook != "" {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			for {
+				select {
+				case msg := <-r.forwards:
+					r.forward(msg)
+				case <-r.stopCh:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Stop stops reading messages. Messages still waiting for the webhook are
+// kept in the inbox only.
+func (r *Receiver) Stop() {
+	close(r.stopCh)
+	r.wg.Wait()
+}
+
+// check reads and deletes every message in the modem storage
+func (r *Receiver) check() {
+	if !r.modem.Connected() {
+		return // checked again once the modem is reconnected
+	}
+	stored, err := r.modem.ListMessages()
+	if err != nil {
+		log.Printf("Failed to read incoming SMS: %v", err)
+		return
+	}
+	for _, s := range stored {
+		msg, err := DecodeDeliverPDU(s.PDU)
+		if err != nil {
+			log.Printf("Discarding unreadable SMS at index %d: %v", s.Index, err)
+		} else {
+			r.receive(msg)
+		}
+		if err := r.modem.DeleteMessage(s.Index); err != nil {
+			log.Printf("Modem: %v", err)
+		}
+	}
+	r.expireParts()
+}
+
+// receive stores a single message, or a concatenated one once all of its
+// parts are there
+func (r *Receiver) receive(msg *DeliverPDU) {
+	if msg.Concat == nil || msg.Concat.Total <= 1 {
+		r.deliver(InboundSMS{From: msg.Sender, Message: msg.Text, SentAt: msg.Timestamp, Segments: 1})
+		return
+	}
+
+	key := concatKey{sender: msg.Sender, ref: msg.Concat.Ref, total: msg.Concat.Total}
+	partial, ok := r.parts[key]
+	if !ok {
+		partial = &partialMessage{parts: make(map[int]*DeliverPDU), received: time.Now()}
+		r.parts[key] = partial
+	}
+	partial.parts[msg.Concat.Seq] = msg
+	if len(partial.parts) < key.total {
+		return
+	}
+
+	delete(r.parts, key)
+	var text strings.Builder
+	for seq := 1; seq <= key.total; seq++ {
+		part, ok := partial.parts[seq]
+		if !ok {
+			log.Printf("Concatenated SMS from %s is missing part %d", maskPhone(key.sender), seq)
+			return
+		}
+		text.WriteString(part.Text)
+	}
+	r.deliver(InboundSMS{From: msg.Sender, Message: text.String(), SentAt: partial.parts[1].Timestamp, Segments: key.total})
+}
+
+// expireParts drops concatenated messages whose remaining parts never came
+func (r *Receiver) expireParts() {
+	for key, partial := range r.parts {
+		if time.Since(partial.received) > partTimeout {
+			log.Printf("Dropping incomplete SMS from %s: %d of %d parts received", maskPhone(key.sender), len(partial.parts), key.total)
+			delete(r.parts, key)
+		}
+	}
+}
+
+// deliver stores a complete message and queues it for the webhook
+func (r *Receiver) deliver(msg InboundSMS) {
+	msg.ID = status.NewID()
+	msg.ReceivedAt = time.Now().UTC()
+	r.inbox.Add(msg)
+	log.Printf("Received SMS %s from %s (%d segment(s))", msg.ID, maskPhone(msg.From), msg.Segments)
+
+	if r.webhook == "" {
+		return
+	}
+	select {
+	case r.forwards <- msg:
+	default:
+		log.Printf("Webhook queue is full, SMS %s is only kept in the inbox", msg.ID)
+	}
+}
+
+// forward posts a message to the webhook, retrying failures
+func (r *Receiver) forward(msg InboundSMS) {
+	for attempts := 1; ; attempts++ {
+		err := r.post(msg)
+		if err == nil {
+			return
+		}
+		if !r.retry.ShouldRetry(attempts, err) {
+			log.Printf("Failed to forward SMS %s to the webhook after %d attempt(s): %v", msg.ID, attempts, err)
+			return
+		}
+		delay := r.retry.Delay(attempts)
+		log.Printf("Failed to forward SMS %s to the webhook, retrying in %s: %v", msg.ID, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-r.stopCh:
+			return
+		}
+	}
+}
+
+func (r *Receiver) post(msg InboundSMS) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	resp, err := r.client.Post(r.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("webhook responded %s", resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return retry.Permanent(err)
+	}
+	return err
+}
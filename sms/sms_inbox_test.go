@@ -0,0 +1,106 @@
+package sms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestReceiver tests reading, reassembling, deleting and forwarding
+// incoming messages.
+func TestReceiver(t *testing.T) {
+	long := strings.Repeat("Long reply. ", 20)
+	stored := []string{deliverPDUs(t, "+46708251358", "Yes", 0)[0]}
+	stored = append(stored, deliverPDUs(t, "+46708251359", long, 12)...)
+
+	var mu sync.Mutex
+	var deleted []string
+	listed := false
+	modem := newFakeModem(func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case cmd == "AT+CMGL=4\r":
+			var b strings.Builder
+			if !listed {
+				// Parts out of order, as they may arrive
+				for _, i := range []int{2, 0, 1} {
+					fmt.Fprintf(&b, "\r\n+CMGL: %d,0,,%d\r\n%s", i+1, len(stored[i])/2-1, stored[i])
+				}
+				listed = true
+			}
+			return b.String() + "\r\n\r\nOK\r\n"
+		case strings.HasPrefix(cmd, "AT+CMGD="):
+			deleted = append(deleted, strings.TrimSpace(strings.TrimPrefix(cmd, "AT+CMGD=")))
+		}
+		return "\r\nOK\r\n"
+	})
+	defer modem.Close()
+
+	var posted []InboundSMS
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg InboundSMS
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("Failed to decode webhook body: %v", err)
+		}
+		mu.Lock()
+		posted = append(posted, msg)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	inbox := NewInbox(10)
+	receiver := NewReceiver(NewHardwareProvider(modem, ModeText), inbox)
+	receiver.SetWebhook(server.URL)
+	receiver.Start()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		done := len(posted) == 2
+		mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	receiver.Stop()
+
+	messages := inbox.List()
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages in the inbox, got %+v", messages)
+	}
+	// The concatenated message is complete once its first part is read
+	if messages[0].From != "+46708251358" || messages[0].Message != "Yes" || messages[0].Segments != 1 {
+		t.Errorf("Unexpected single message %+v", messages[0])
+	}
+	if messages[1].From != "+46708251359" || messages[1].Message != long || messages[1].Segments != 2 {
+		t.Errorf("Unexpected concatenated message %+v", messages[1])
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(deleted, ",") != "3,1,2" {
+		t.Errorf("Expected messages 3,1,2 to be deleted, got %v", deleted)
+	}
+	if len(posted) != 2 || posted[0].ID != messages[0].ID || posted[1].ID != messages[1].ID {
+		t.Errorf("Webhook received %+v", posted)
+	}
+}
+
+// TestInboxLimit tests that the inbox drops the oldest messages.
+func TestInboxLimit(t *testing.T) {
+	inbox := NewInbox(2)
+	for _, id := range []string{"a", "b", "c"} {
+		inbox.Add(InboundSMS{ID: id})
+	}
+	messages := inbox.List()
+	if len(messages) != 2 || messages[0].ID != "b" || messages[1].ID != "c" {
+		t.Errorf("Unexpected inbox contents %+v", messages)
+	}
+}
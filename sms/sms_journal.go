@@ -0,0 +1,346 @@
+package sms
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	journalFile = "sms-journal.log"
+
+	journalOpEnqueue = "enqueue"
+	journalOpDone    = "done"
+	journalOpDead    = "dead"
+	journalOpPurge   = "purge"
+
+	// journalCompactThreshold is the number of entries after which the
+	// journal is rewritten to hold only pending messages and dead letters,
+	// provided at least half of its entries are obsolete.
+	journalCompactThreshold = 1000
+)
+
+// journalEntry is a single line in the journal file
+type journalEntry struct {
+	Op    string    `json:"op"`
+	ID    string    `json:"id"`
+	SMS   *SMS      `json:"sms,omitempty"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time,omitempty"`
+}
+
+// Journal is an append-only on-disk log of queued SMS messages. Every
+// message is written (and synced) before it is handed to the queue and is
+// only marked done after a sender delivered it, so messages that were
+// accepted but not sent survive a restart or crash. Dead letters are kept
+// in the journal too until they are requeued or purged.
+type Journal struct {
+	mu      sync.Mutex
+	file    *os.File
+	path    string
+	live    map[string]liveEntry // latest entry of every pending or dead message
+	seq     uint64               // order of live entries, for compaction
+	entries int                  // entries in the journal file
+	replay  []*SMS               // pending messages found when the journal was opened
+	dead    []DeadLetter         // dead letters found when the journal was opened
+}
+
+// liveEntry is an entry that is still needed, tagged with its position
+type liveEntry struct {
+	entry journalEntry
+	seq   uint64
+}
+
+// OpenJournal opens (or creates) the journal in dir and loads all messages
+// that were not marked done, compacting the file in the process.
+func OpenJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	j := &Journal{
+		path: filepath.Join(dir, journalFile),
+		live: make(map[string]liveEntry),
+	}
+
+	pending, dead, err := readJournal(j.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, sms := range pending {
+		j.track(enqueueEntry(sms))
+	}
+	for _, letter := range dead {
+		j.track(deadEntry(letter))
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+
+	j.replay = pending
+	j.dead = dead
+	if len(pending) > 0 {
+		log.Printf("SMS journal: %d unsent message(s) to replay", len(pending))
+	}
+	return j, nil
+}
+
+// readJournal returns the messages in the journal at path that are still
+// pending and those that ended up as dead letters, in journal order.
+func readJournal(path string) ([]*SMS, []DeadLetter, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer f.Close()
+
+	var order []string
+	pending := make(map[string]*SMS)
+	dead := make(map[string]DeadLetter)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn write at the end of the file after a crash
+			log.Printf("SMS journal: skipping unreadable entry: %v", err)
+			continue
+		}
+		switch entry.Op {
+		case journalOpEnqueue:
+			if entry.SMS == nil {
+				continue
+			}
+			order = append(order, entry.ID)
+			pending[entry.ID] = entry.SMS
+			delete(dead, entry.ID)
+		case journalOpDone:
+			delete(pending, entry.ID)
+		case journalOpDead:
+			if entry.SMS == nil {
+				continue
+			}
+			order = append(order, entry.ID)
+			delete(pending, entry.ID)
+			dead[entry.ID] = DeadLetter{SMS: entry.SMS, Error: entry.Error, FailedAt: entry.Time}
+		case journalOpPurge:
+			delete(dead, entry.ID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	// An ID may appear several times in order; only its last position counts
+	last := make(map[string]int, len(order))
+	for i, id := range order {
+		last[id] = i
+	}
+
+	var pendingList []*SMS
+	var deadList []DeadLetter
+	for i, id := range order {
+		if last[id] != i {
+			continue
+		}
+		if sms, ok := pending[id]; ok {
+			pendingList = append(pendingList, sms)
+		} else if letter, ok := dead[id]; ok {
+			deadList = append(deadList, letter)
+		}
+	}
+	return pendingList, deadList, nil
+}
+
+func enqueueEntry(sms *SMS) journalEntry {
+	return journalEntry{Op: journalOpEnqueue, ID: sms.ID, SMS: sms}
+}
+
+func deadEntry(letter DeadLetter) journalEntry {
+	return journalEntry{Op: journalOpDead, ID: letter.SMS.ID, SMS: letter.SMS, Error: letter.Error, Time: letter.FailedAt}
+}
+
+// track remembers entry as the latest state of its message. The message is
+// copied because the queue keeps updating the original. The caller must
+// hold j.mu or have exclusive access.
+func (j *Journal) track(entry journalEntry) {
+	sms := *entry.SMS
+	entry.SMS = &sms
+	j.seq++
+	j.live[entry.ID] = liveEntry{entry: entry, seq: j.seq}
+}
+
+// compact atomically replaces the journal file with one containing only
+// the live entries and reopens it for appending. The caller must hold j.mu
+// or have exclusive access.
+func (j *Journal) compact() error {
+	live := make([]liveEntry, 0, len(j.live))
+	for _, entry := range j.live {
+		live = append(live, entry)
+	}
+	sort.Slice(live, func(a, b int) bool { return live[a].seq < live[b].seq })
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, entry := range live {
+		if err := enc.Encode(entry.entry); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to compact journal: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	j.file = file
+	j.entries = len(live)
+	return nil
+}
+
+// write appends an entry and syncs it to disk
+func (j *Journal) write(entries ...journalEntry) error {
+	var buf []byte
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	if _, err := j.file.Write(buf); err != nil {
+		return err
+	}
+	j.entries += len(entries)
+	return j.file.Sync()
+}
+
+// Append records messages as queued, all in a single write
+func (j *Journal) Append(msgs ...*SMS) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := make([]journalEntry, len(msgs))
+	for i, sms := range msgs {
+		entries[i] = enqueueEntry(sms)
+	}
+	if err := j.write(entries...); err != nil {
+		return fmt.Errorf("failed to write journal entry: %w", err)
+	}
+	for _, entry := range entries {
+		j.track(entry)
+	}
+	return j.maybeCompact()
+}
+
+// MarkDone records that a message was sent and no longer needs replaying
+func (j *Journal) MarkDone(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.write(journalEntry{Op: journalOpDone, ID: id}); err != nil {
+		return fmt.Errorf("failed to write journal entry: %w", err)
+	}
+	return j.forget(id)
+}
+
+// MarkDead records that a message exhausted its retries
+func (j *Journal) MarkDead(letter DeadLetter) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry := deadEntry(letter)
+	if err := j.write(entry); err != nil {
+		return fmt.Errorf("failed to write journal entry: %w", err)
+	}
+	j.track(entry)
+	return j.maybeCompact()
+}
+
+// Purge records that a dead letter was discarded
+func (j *Journal) Purge(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.write(journalEntry{Op: journalOpPurge, ID: id}); err != nil {
+		return fmt.Errorf("failed to write journal entry: %w", err)
+	}
+	return j.forget(id)
+}
+
+// forget drops id from the live set. The caller must hold j.mu.
+func (j *Journal) forget(id string) error {
+	delete(j.live, id)
+	return j.maybeCompact()
+}
+
+// maybeCompact rewrites the journal once it has grown past the threshold
+// and is mostly made up of obsolete entries. The caller must hold j.mu.
+func (j *Journal) maybeCompact() error {
+	if j.entries < journalCompactThreshold || j.entries < 2*len(j.live) {
+		return nil
+	}
+	return j.compact()
+}
+
+// Replay returns the unsent messages found when the journal was opened.
+// It only returns them once.
+func (j *Journal) Replay() []*SMS {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	pending := j.replay
+	j.replay = nil
+	return pending
+}
+
+// DeadLetters returns the dead letters found when the journal was opened.
+// It only returns them once.
+func (j *Journal) DeadLetters() []DeadLetter {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	dead := j.dead
+	j.dead = nil
+	return dead
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
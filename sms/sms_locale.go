@@ -0,0 +1,64 @@
+package sms
+
+import "strings"
+
+// callingCodeLocales maps country calling codes to the main language of
+// the country. Countries with several languages get the most common one.
+var callingCodeLocales = map[string]string{
+	"1":   "en", // United States, Canada
+	"7":   "ru", // Russia, Kazakhstan
+	"20":  "ar", // Egypt
+	"27":  "en", // South Africa
+	"30":  "el", // Greece
+	"31":  "nl", // Netherlands
+	"32":  "nl", // Belgium
+	"33":  "fr", // France
+	"34":  "es", // Spain
+	"36":  "hu", // Hungary
+	"39":  "it", // Italy
+	"40":  "ro", // Romania
+	"41":  "de", // Switzerland
+	"43":  "de", // Austria
+	"44":  "en", // United Kingdom
+	"45":  "da", // Denmark
+	"46":  "sv", // Sweden
+	"47":  "nb", // Norway
+	"48":  "pl", // Poland
+	"49":  "de", // Germany
+	"52":  "es", // Mexico
+	"54":  "es", // Argentina
+	"55":  "pt", // Brazil
+	"56":  "es", // Chile
+	"57":  "es", // Colombia
+	"61":  "en", // Australia
+	"62":  "id", // Indonesia
+	"64":  "en", // New Zealand
+	"81":  "ja", // Japan
+	"82":  "ko", // South Korea
+	"86":  "zh", // China
+	"90":  "tr", // Turkey
+	"91":  "en", // India
+	"351": "pt", // Portugal
+	"352": "fr", // Luxembourg
+	"353": "en", // Ireland
+	"358": "fi", // Finland
+	"380": "uk", // Ukraine
+	"420": "cs", // Czech Republic
+	"421": "sk", // Slovakia
+}
+
+// PhoneLocale returns the language of the country of an international
+// phone number such as "+31612345678", or "" if the country is not known
+func PhoneLocale(phone string) string {
+	digits, ok := strings.CutPrefix(phone, "+")
+	if !ok {
+		return ""
+	}
+	// Calling codes are prefix-free, so at most one length matches
+	for n := 1; n <= 3 && n <= len(digits); n++ {
+		if locale, ok := callingCodeLocales[digits[:n]]; ok {
+			return locale
+		}
+	}
+	return ""
+}
@@ -0,0 +1,594 @@
+package sms
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Encoding is the character encoding of an SMS in PDU mode
+type Encoding int
+
+const (
+	EncodingGSM7 Encoding = iota // GSM 03.38 default alphabet, 7 bits per character
+	EncodingUCS2                 // UTF-16BE, 16 bits per code unit
+	Encoding8Bit                 // Binary data, only ever received
+)
+
+const (
+	gsm7Escape = 0x1B
+
+	// Single-part message limits
+	maxGSM7Septets = 160
+	maxUCS2Octets  = 140
+
+	// Per-segment limits of a concatenated message, after the 6-octet UDH
+	maxGSM7SegmentSeptets = 153
+	maxUCS2SegmentOctets  = 134
+
+	// maxSegments is the most segments a concatenation header can number
+	maxSegments = 255
+
+	// validityPeriod is the relative TP-VP: 0xA7 means 24 hours
+	validityPeriod = 0xA7
+)
+
+// gsm7Alphabet is the GSM 03.38 default alphabet, indexed by septet value.
+// The escape at 0x1B is never produced from text.
+var gsm7Alphabet = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// gsm7Extension maps characters of the extension table to the septet that
+// follows the escape
+var gsm7Extension = map[rune]byte{
+	'\f': 0x0A,
+	'^':  0x14,
+	'{':  0x28,
+	'}':  0x29,
+	'\\': 0x2F,
+	'[':  0x3C,
+	'~':  0x3D,
+	']':  0x3E,
+	'|':  0x40,
+	'€':  0x65,
+}
+
+// gsm7ExtensionRunes maps septets after the escape back to characters
+var gsm7ExtensionRunes = func() map[byte]rune {
+	runes := make(map[byte]rune, len(gsm7Extension))
+	for r, septet := range gsm7Extension {
+		runes[septet] = r
+	}
+	return runes
+}()
+
+var gsm7Index = func() map[rune]byte {
+	index := make(map[rune]byte, len(gsm7Alphabet))
+	for i, r := range gsm7Alphabet {
+		if i != gsm7Escape {
+			index[r] = byte(i)
+		}
+	}
+	return index
+}()
+
+// encodeGSM7 converts text to GSM-7 septets, using the extension table
+// where needed. It reports false if text has characters outside both tables.
+func encodeGSM7(text string) ([]byte, bool) {
+	septets := make([]byte, 0, len(text))
+	for _, r := range text {
+		if septet, ok := gsm7Index[r]; ok {
+			septets = append(septets, septet)
+		} else if septet, ok := gsm7Extension[r]; ok {
+			septets = append(septets, gsm7Escape, septet)
+		} else {
+			return nil, false
+		}
+	}
+	return septets, true
+}
+
+// encodeUCS2 converts text to big-endian UTF-16. Characters outside the
+// basic multilingual plane, such as emoji, become surrogate pairs.
+func encodeUCS2(text string) []byte {
+	units := utf16.Encode([]rune(text))
+	octets := make([]byte, 0, 2*len(units))
+	for _, unit := range units {
+		octets = append(octets, byte(unit>>8), byte(unit))
+	}
+	return octets
+}
+
+// ChooseEncoding returns GSM-7 if every character of text is in the GSM
+// alphabet or its extension table, and UCS-2 otherwise
+func ChooseEncoding(text string) Encoding {
+	if _, ok := encodeGSM7(text); ok {
+		return EncodingGSM7
+	}
+	return EncodingUCS2
+}
+
+// packSeptets packs 7-bit values into octets, starting after fillBits
+// padding bits
+func packSeptets(septets []byte, fillBits int) []byte {
+	totalBits := fillBits + 7*len(septets)
+	packed := make([]byte, (totalBits+7)/8)
+	bit := fillBits
+	for _, septet := range septets {
+		for i := 0; i < 7; i++ {
+			if septet&(1<<i) != 0 {
+				packed[bit/8] |= 1 << (bit % 8)
+			}
+			bit++
+		}
+	}
+	return packed
+}
+
+// encodeAddress encodes a phone number as a TP-DA field: digit count, type
+// of address and semi-octets
+func encodeAddress(number string) ([]byte, error) {
+	toa := byte(0x81) // unknown numbering plan
+	if strings.HasPrefix(number, "+") {
+		toa = 0x91 // international
+		number = number[1:]
+	}
+	if number == "" {
+		return nil, errors.New("empty phone number")
+	}
+	for _, c := range number {
+		if c < '0' || c > '9' {
+			return nil, fmt.Errorf("invalid digit %q in phone number", c)
+		}
+	}
+
+	address := []byte{byte(len(number)), toa}
+	if len(number)%2 == 1 {
+		number += "F"
+	}
+	for i := 0; i < len(number); i += 2 {
+		low := number[i] - '0'
+		high := byte(0x0F)
+		if number[i+1] != 'F' {
+			high = number[i+1] - '0'
+		}
+		address = append(address, high<<4|low)
+	}
+	return address, nil
+}
+
+// PDU is an encoded SMS-SUBMIT ready for AT+CMGS in PDU mode
+type PDU struct {
+	Hex    string // Hex encoding including the (empty) SMSC prefix
+	Length int    // TPDU length in octets, excluding the SMSC prefix
+}
+
+// segment is the user data of one SMS
+type segment struct {
+	data  []byte // GSM-7 septets or UCS-2 octets
+	units int    // UDL contribution: septets for GSM-7, octets for UCS-2
+}
+
+// splitMessage encodes message and splits it into segments. A message that
+// fits in a single SMS yields one segment; longer ones are split at the
+// concatenated-SMS limits without breaking escape sequences or surrogate
+// pairs.
+func splitMessage(message string) (Encoding, []segment) {
+	if septets, ok := encodeGSM7(message); ok {
+		if len(septets) <= maxGSM7Septets {
+			return EncodingGSM7, []segment{{data: septets, units: len(septets)}}
+		}
+		var segments []segment
+		for len(septets) > 0 {
+			n := min(len(septets), maxGSM7SegmentSeptets)
+			if n < len(septets) && septets[n-1] == gsm7Escape {
+				n-- // keep the escape together with its character
+			}
+			segments = append(segments, segment{data: septets[:n], units: n})
+			septets = septets[n:]
+		}
+		return EncodingGSM7, segments
+	}
+
+	octets := encodeUCS2(message)
+	if len(octets) <= maxUCS2Octets {
+		return EncodingUCS2, []segment{{data: octets, units: len(octets)}}
+	}
+	var segments []segment
+	for len(octets) > 0 {
+		n := min(len(octets), maxUCS2SegmentOctets)
+		if n < len(octets) && octets[n-2] >= 0xD8 && octets[n-2] <= 0xDB {
+			n -= 2 // keep the high surrogate together with the low one
+		}
+		segments = append(segments, segment{data: octets[:n], units: n})
+		octets = octets[n:]
+	}
+	return EncodingUCS2, segments
+}
+
+// CountSegments returns the number of SMS needed to send message
+func CountSegments(message string) int {
+	_, segments := splitMessage(message)
+	return len(segments)
+}
+
+// EncodeSubmitPDU builds an SMS-SUBMIT PDU for a single-part message. It
+// picks GSM-7 or UCS-2 based on the message content and uses the modem's
+// default SMSC.
+func EncodeSubmitPDU(recipient, message string) (PDU, error) {
+	if segments := CountSegments(message); segments > 1 {
+		return PDU{}, fmt.Errorf("message too long for a single SMS: needs %d segments", segments)
+	}
+	pdus, err := EncodeSubmitPDUs(recipient, message, 0, false)
+	if err != nil {
+		return PDU{}, err
+	}
+	return pdus[0], nil
+}
+
+// EncodeSubmitPDUs builds the SMS-SUBMIT PDUs for message. Messages that do
+// not fit a single SMS are split into segments carrying a concatenation
+// header with reference number ref, so the handset joins them again. With
+// statusReport set, every segment requests a delivery report.
+func EncodeSubmitPDUs(recipient, message string, ref byte, statusReport bool) ([]PDU, error) {
+	address, err := encodeAddress(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	encoding, segments := splitMessage(message)
+	if len(segments) > maxSegments {
+		return nil, fmt.Errorf("message too long: %d segments", len(segments))
+	}
+	multipart := len(segments) > 1
+
+	dcs := byte(0x00)
+	if encoding == EncodingUCS2 {
+		dcs = 0x08
+	}
+
+	pdus := make([]PDU, 0, len(segments))
+	for i, seg := range segments {
+		firstOctet := byte(0x11) // SMS-SUBMIT with a relative validity period
+		if statusReport {
+			firstOctet |= 0x20 // status report request
+		}
+		var udh []byte
+		if multipart {
+			firstOctet |= 0x40 // user data starts with a header
+			udh = []byte{0x05, 0x00, 0x03, ref, byte(len(segments)), byte(i + 1)}
+		}
+
+		var udl int
+		var ud []byte
+		if encoding == EncodingGSM7 {
+			// Septets start at the next septet boundary after the header
+			fillBits := 0
+			if len(udh) > 0 {
+				fillBits = (7 - (len(udh)*8)%7) % 7
+			}
+			udl = (len(udh)*8+fillBits)/7 + seg.units
+			ud = append(udh, packSeptets(seg.data, fillBits)...)
+		} else {
+			udl = len(udh) + seg.units
+			ud = append(udh, seg.data...)
+		}
+
+		tpdu := []byte{
+			firstOctet,
+			0x00, // message reference, assigned by the modem
+		}
+		tpdu = append(tpdu, address...)
+		tpdu = append(tpdu, 0x00, dcs, validityPeriod, byte(udl))
+		tpdu = append(tpdu, ud...)
+
+		pdus = append(pdus, PDU{
+			Hex:    strings.ToUpper("00" + hex.EncodeToString(tpdu)),
+			Length: len(tpdu),
+		})
+	}
+	return pdus, nil
+}
+
+// decodeGSM7 converts GSM-7 septets back to text. Unknown extension
+// characters decode as a space, as the specification recommends.
+func decodeGSM7(septets []byte) string {
+	var b strings.Builder
+	for i := 0; i < len(septets); i++ {
+		septet := septets[i] & 0x7F
+		if septet == gsm7Escape && i+1 < len(septets) {
+			i++
+			if r, ok := gsm7ExtensionRunes[septets[i]&0x7F]; ok {
+				b.WriteRune(r)
+			} else {
+				b.WriteRune(' ')
+			}
+			continue
+		}
+		b.WriteRune(gsm7Alphabet[septet])
+	}
+	return b.String()
+}
+
+// decodeUCS2 converts big-endian UTF-16 back to text
+func decodeUCS2(octets []byte) string {
+	units := make([]uint16, 0, len(octets)/2)
+	for i := 0; i+1 < len(octets); i += 2 {
+		units = append(units, uint16(octets[i])<<8|uint16(octets[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+// unpackSeptets extracts count 7-bit values from packed octets, skipping
+// fillBits padding bits first
+func unpackSeptets(packed []byte, fillBits, count int) []byte {
+	septets := make([]byte, 0, count)
+	bit := fillBits
+	for i := 0; i < count && (bit+7) <= 8*len(packed); i++ {
+		var septet byte
+		for j := 0; j < 7; j++ {
+			if packed[bit/8]&(1<<(bit%8)) != 0 {
+				septet |= 1 << j
+			}
+			bit++
+		}
+		septets = append(septets, septet)
+	}
+	return septets
+}
+
+// pduReader reads the fields of a received PDU octet by octet
+type pduReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *pduReader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errors.New("PDU is truncated")
+	}
+	octets := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return octets, nil
+}
+
+func (r *pduReader) octet() (byte, error) {
+	octets, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return octets[0], nil
+}
+
+// address reads a TP-OA or TP-RA field: digit count, type of address and
+// semi-octets, or packed GSM-7 for alphanumeric senders
+func (r *pduReader) address() (string, error) {
+	digits, err := r.octet()
+	if err != nil {
+		return "", err
+	}
+	toa, err := r.octet()
+	if err != nil {
+		return "", err
+	}
+	octets, err := r.next((int(digits) + 1) / 2)
+	if err != nil {
+		return "", err
+	}
+
+	if toa&0x70 == 0x50 {
+		// Alphanumeric sender such as a company name
+		return decodeGSM7(unpackSeptets(octets, 0, int(digits)*4/7)), nil
+	}
+	var b strings.Builder
+	if toa&0x70 == 0x10 {
+		b.WriteByte('+')
+	}
+	for _, octet := range octets {
+		for _, nibble := range []byte{octet & 0x0F, octet >> 4} {
+			if nibble > 9 {
+				continue // filler
+			}
+			b.WriteByte('0' + nibble)
+		}
+	}
+	return b.String(), nil
+}
+
+// timestamp reads a TP-SCTS or TP-DT field: seven semi-octet pairs for
+// year, month, day, hour, minute, second and time zone in quarter hours
+func (r *pduReader) timestamp() (time.Time, error) {
+	octets, err := r.next(7)
+	if err != nil {
+		return time.Time{}, err
+	}
+	v := make([]int, 6)
+	for i := range v {
+		v[i] = int(octets[i]&0x0F)*10 + int(octets[i]>>4)
+	}
+	tz := octets[6]
+	quarters := int(tz&0x07)*10 + int(tz>>4)
+	if tz&0x08 != 0 {
+		quarters = -quarters
+	}
+	zone := time.FixedZone("", quarters*15*60)
+	return time.Date(2000+v[0], time.Month(v[1]), v[2], v[3], v[4], v[5], 0, zone), nil
+}
+
+// dcsEncoding returns the alphabet of a TP-DCS value
+func dcsEncoding(dcs byte) Encoding {
+	switch {
+	case dcs&0xC0 == 0x00: // general data coding
+		switch (dcs >> 2) & 0x03 {
+		case 1:
+			return Encoding8Bit
+		case 2:
+			return EncodingUCS2
+		}
+	case dcs&0xF0 == 0xE0: // message waiting, UCS-2
+		return EncodingUCS2
+	case dcs&0xF0 == 0xF0: // data coding/message class
+		if dcs&0x04 != 0 {
+			return Encoding8Bit
+		}
+	}
+	return EncodingGSM7
+}
+
+// Concat identifies one part of a concatenated message
+type Concat struct {
+	Ref   int // Reference shared by all parts
+	Total int // Number of parts
+	Seq   int // Position of this part, starting at 1
+}
+
+// DeliverPDU is a decoded SMS-DELIVER, a message received by the modem
+type DeliverPDU struct {
+	Sender    string
+	Timestamp time.Time // Service centre time stamp
+	Encoding  Encoding
+	Text      string  // Hex encoded for 8-bit data
+	Concat    *Concat // Set for one part of a concatenated message
+}
+
+// parseUDH looks for a concatenation element in a user data header
+func parseUDH(udh []byte) *Concat {
+	for i := 0; i+1 < len(udh); {
+		iei, length := udh[i], int(udh[i+1])
+		data := udh[i+2 : min(i+2+length, len(udh))]
+		switch {
+		case iei == 0x00 && len(data) == 3:
+			return &Concat{Ref: int(data[0]), Total: int(data[1]), Seq: int(data[2])}
+		case iei == 0x08 && len(data) == 4:
+			return &Concat{Ref: int(data[0])<<8 | int(data[1]), Total: int(data[2]), Seq: int(data[3])}
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+// DecodeDeliverPDU decodes an SMS-DELIVER PDU as listed by AT+CMGL or
+// AT+CMGR in PDU mode, including its SMSC prefix
+func DecodeDeliverPDU(pduHex string) (*DeliverPDU, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(pduHex))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PDU: %w", err)
+	}
+	r := &pduReader{data: data}
+
+	smscLen, err := r.octet()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.next(int(smscLen)); err != nil {
+		return nil, err
+	}
+	firstOctet, err := r.octet()
+	if err != nil {
+		return nil, err
+	}
+	if firstOctet&0x03 != 0x00 {
+		return nil, fmt.Errorf("not an SMS-DELIVER PDU (message type %d)", firstOctet&0x03)
+	}
+
+	msg := &DeliverPDU{}
+	if msg.Sender, err = r.address(); err != nil {
+		return nil, err
+	}
+	if _, err := r.octet(); err != nil { // TP-PID
+		return nil, err
+	}
+	dcs, err := r.octet()
+	if err != nil {
+		return nil, err
+	}
+	msg.Encoding = dcsEncoding(dcs)
+	if msg.Timestamp, err = r.timestamp(); err != nil {
+		return nil, err
+	}
+	udl, err := r.octet()
+	if err != nil {
+		return nil, err
+	}
+	ud := r.data[r.pos:]
+
+	headerOctets := 0
+	if firstOctet&0x40 != 0 && len(ud) > 0 {
+		headerOctets = 1 + int(ud[0])
+		if headerOctets > len(ud) {
+			return nil, errors.New("PDU is truncated")
+		}
+		msg.Concat = parseUDH(ud[1:headerOctets])
+	}
+
+	switch msg.Encoding {
+	case EncodingGSM7:
+		// UDL counts septets, including those taken by the header
+		headerSeptets := (headerOctets*8 + 6) / 7
+		fillBits := headerSeptets*7 - headerOctets*8
+		count := int(udl) - headerSeptets
+		septets := unpackSeptets(ud[headerOctets:], fillBits, count)
+		msg.Text = decodeGSM7(septets)
+	case EncodingUCS2:
+		msg.Text = decodeUCS2(ud[headerOctets:min(int(udl), len(ud))])
+	default:
+		msg.Text = hex.EncodeToString(ud[headerOctets:min(int(udl), len(ud))])
+	}
+	return msg, nil
+}
+
+// StatusReportPDU is a decoded SMS-STATUS-REPORT, the delivery report for
+// a message sent with a status report request
+type StatusReportPDU struct {
+	Reference int // TP-MR of the reported message, as returned by +CMGS
+	Recipient string
+	Delivered time.Time // When the final status was reached (TP-DT)
+	Status    byte      // TP-ST
+}
+
+// DecodeStatusReportPDU decodes an SMS-STATUS-REPORT PDU as received with
+// +CDS in PDU mode, including its SMSC prefix
+func DecodeStatusReportPDU(pduHex string) (*StatusReportPDU, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(pduHex))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PDU: %w", err)
+	}
+	r := &pduReader{data: data}
+
+	smscLen, err := r.octet()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.next(int(smscLen)); err != nil {
+		return nil, err
+	}
+	firstOctet, err := r.octet()
+	if err != nil {
+		return nil, err
+	}
+	if firstOctet&0x03 != 0x02 {
+		return nil, fmt.Errorf("not an SMS-STATUS-REPORT PDU (message type %d)", firstOctet&0x03)
+	}
+
+	report := &StatusReportPDU{}
+	mr, err := r.octet()
+	if err != nil {
+		return nil, err
+	}
+	report.Reference = int(mr)
+	if report.Recipient, err = r.address(); err != nil {
+		return nil, err
+	}
+	if _, err := r.timestamp(); err != nil { // TP-SCTS
+		return nil, err
+	}
+	if report.Delivered, err = r.timestamp(); err != nil {
+		return nil, err
+	}
+	if report.Status, err = r.octet(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,304 @@
+package sms
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestGSM7Alphabet tests that the default alphabet has one entry per septet.
+func TestGSM7Alphabet(t *testing.T) {
+	if len(gsm7Alphabet) != 128 {
+		t.Fatalf("Expected 128 characters in the GSM-7 alphabet, got %d", len(gsm7Alphabet))
+	}
+}
+
+// TestChooseEncoding tests the automatic GSM-7/UCS-2 selection.
+func TestChooseEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		encoding Encoding
+	}{
+		{"ASCII", "Hello, world!", EncodingGSM7},
+		{"GSM7Accents", "Café à Åre", EncodingGSM7},
+		{"ExtensionTable", "Price: 5€ [approx]", EncodingGSM7},
+		{"Cyrillic", "Привет", EncodingUCS2},
+		{"Emoji", "Done 👍", EncodingUCS2},
+		{"NonGSMAccent", "façade ê", EncodingUCS2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ChooseEncoding(tc.text); got != tc.encoding {
+				t.Errorf("ChooseEncoding(%q) = %v, want %v", tc.text, got, tc.encoding)
+			}
+		})
+	}
+}
+
+// TestEncodeSubmitPDU tests complete SMS-SUBMIT PDUs.
+func TestEncodeSubmitPDU(t *testing.T) {
+	tests := []struct {
+		name      string
+		recipient string
+		message   string
+		wantHex   string
+		wantLen   int
+	}{
+		{
+			name:      "GSM7",
+			recipient: "+46708251358",
+			message:   "hellohello",
+			wantHex:   "0011000B916407281553F80000A70AE8329BFD4697D9EC37",
+			wantLen:   23,
+		},
+		{
+			name:      "GSM7Extension",
+			recipient: "+46708251358",
+			message:   "€",
+			wantHex:   "0011000B916407281553F80000A7029B32",
+			wantLen:   16,
+		},
+		{
+			name:      "UCS2",
+			recipient: "+46708251358",
+			message:   "Привет",
+			wantHex:   "0011000B916407281553F80008A70C041F04400438043204350442",
+			wantLen:   26,
+		},
+		{
+			name:      "UCS2SurrogatePair",
+			recipient: "+46708251358",
+			message:   "👍",
+			wantHex:   "0011000B916407281553F80008A704D83DDC4D",
+			wantLen:   18,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pdu, err := EncodeSubmitPDU(tc.recipient, tc.message)
+			if err != nil {
+				t.Fatalf("EncodeSubmitPDU failed: %v", err)
+			}
+			if pdu.Hex != tc.wantHex {
+				t.Errorf("Unexpected PDU. Got: %s, want: %s", pdu.Hex, tc.wantHex)
+			}
+			if pdu.Length != tc.wantLen {
+				t.Errorf("Unexpected TPDU length. Got: %d, want: %d", pdu.Length, tc.wantLen)
+			}
+		})
+	}
+}
+
+// TestEncodeSubmitPDUErrors tests rejected input.
+func TestEncodeSubmitPDUErrors(t *testing.T) {
+	if _, err := EncodeSubmitPDU("+12AB", "Hello"); err == nil {
+		t.Error("Expected an error for a phone number with letters")
+	}
+	if _, err := EncodeSubmitPDU("+46708251358", strings.Repeat("a", 161)); err == nil {
+		t.Error("Expected an error for a GSM-7 message over 160 characters")
+	}
+	if _, err := EncodeSubmitPDU("+46708251358", strings.Repeat("я", 71)); err == nil {
+		t.Error("Expected an error for a UCS-2 message over 70 characters")
+	}
+}
+
+// TestCountSegments tests segment counting at the single and concatenated limits.
+func TestCountSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		segments int
+	}{
+		{"GSM7Single", strings.Repeat("a", 160), 1},
+		{"GSM7Two", strings.Repeat("a", 161), 2},
+		{"GSM7Three", strings.Repeat("a", 307), 3},
+		{"GSM7ExtensionCountsDouble", strings.Repeat("€", 80), 1},
+		{"GSM7ExtensionOverflow", strings.Repeat("€", 81), 2},
+		{"UCS2Single", strings.Repeat("я", 70), 1},
+		{"UCS2Two", strings.Repeat("я", 71), 2},
+		{"UCS2Three", strings.Repeat("я", 135), 3},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := CountSegments(tc.message); got != tc.segments {
+				t.Errorf("CountSegments() = %d, want %d", got, tc.segments)
+			}
+		})
+	}
+}
+
+// TestEncodeSubmitPDUsConcatenated tests the UDH and user data of a
+// concatenated GSM-7 message.
+func TestEncodeSubmitPDUsConcatenated(t *testing.T) {
+	pdus, err := EncodeSubmitPDUs("+46708251358", strings.Repeat("a", 200), 0x2A, false)
+	if err != nil {
+		t.Fatalf("EncodeSubmitPDUs failed: %v", err)
+	}
+	if len(pdus) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", len(pdus))
+	}
+
+	// SMSC, first octet with UDHI, MR, address, PID, DCS, VP
+	header := "0051000B916407281553F80000A7"
+	for i, pdu := range pdus {
+		if !strings.HasPrefix(pdu.Hex, header) {
+			t.Errorf("Segment %d: unexpected header %s", i+1, pdu.Hex[:len(header)])
+		}
+		udh := pdu.Hex[len(header)+2 : len(header)+14]
+		if want := "0500032A02" + []string{"01", "02"}[i]; udh != want {
+			t.Errorf("Segment %d: UDH = %s, want %s", i+1, udh, want)
+		}
+		// The first septet starts after one fill bit
+		if ud := pdu.Hex[len(header)+14 : len(header)+16]; ud != "C2" {
+			t.Errorf("Segment %d: first user data octet = %s, want C2", i+1, ud)
+		}
+	}
+	if udl := pdus[0].Hex[len(header) : len(header)+2]; udl != "A0" {
+		t.Errorf("First segment UDL = %s, want A0 (7 + 153 septets)", udl)
+	}
+	if udl := pdus[1].Hex[len(header) : len(header)+2]; udl != "36" {
+		t.Errorf("Second segment UDL = %s, want 36 (7 + 47 septets)", udl)
+	}
+}
+
+// TestSplitMessageBoundaries tests that escapes and surrogate pairs are never
+// split across segments.
+func TestSplitMessageBoundaries(t *testing.T) {
+	_, segments := splitMessage(strings.Repeat("a", 152) + "€" + strings.Repeat("a", 10))
+	if len(segments[0].data) != 152 {
+		t.Errorf("Expected the escape sequence to move to the next segment, first segment has %d septets", len(segments[0].data))
+	}
+
+	_, segments = splitMessage(strings.Repeat("я", 66) + "👍" + strings.Repeat("я", 10))
+	if len(segments[0].data) != 132 {
+		t.Errorf("Expected the surrogate pair to move to the next segment, first segment has %d octets", len(segments[0].data))
+	}
+}
+
+// TestSendSMSviaHardwarePDU tests that every segment is submitted with its own AT+CMGS.
+func TestSendSMSviaHardwarePDU(t *testing.T) {
+	mr := 0
+	modem := newFakeModem(func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "AT+CMGS="):
+			return "\r\n> "
+		case strings.HasSuffix(cmd, "\x1a"):
+			mr++
+			return fmt.Sprintf("\r\n+CMGS: %d\r\n\r\nOK\r\n", mr)
+		}
+		return "\r\nOK\r\n"
+	})
+	defer modem.Close()
+	conn := NewATConn(modem)
+
+	refs, err := SendSMSviaHardwarePDU(conn, "+46708251358", strings.Repeat("a", 200), 9, false)
+	if err != nil {
+		t.Fatalf("SendSMSviaHardwarePDU: %v", err)
+	}
+	if len(refs) != 2 || refs[0] != 1 || refs[1] != 2 {
+		t.Errorf("Expected message references [1 2], got %v", refs)
+	}
+	if !strings.HasPrefix(modem.Written(), "AT+CMGF=0\rAT+CMGS=") {
+		t.Errorf("Unexpected commands sent to port: %q", modem.Written())
+	}
+}
+
+// deliverPDUs turns the SMS-SUBMIT PDUs for message into the SMS-DELIVER
+// PDUs a recipient's modem would list, sent by sender
+func deliverPDUs(t *testing.T, sender, message string, ref byte) []string {
+	t.Helper()
+	pdus, err := EncodeSubmitPDUs(sender, message, ref, false)
+	if err != nil {
+		t.Fatalf("EncodeSubmitPDUs: %v", err)
+	}
+	var delivers []string
+	for _, pdu := range pdus {
+		data, _ := hex.DecodeString(pdu.Hex)
+		tpdu := data[1:]
+		addressLen := 2 + (int(tpdu[2])+1)/2
+		address := tpdu[2 : 2+addressLen]
+		rest := tpdu[2+addressLen:] // PID, DCS, VP, UDL, UD
+
+		deliver := []byte{0x00, tpdu[0]&0x40 | 0x04}
+		deliver = append(deliver, address...)
+		deliver = append(deliver, rest[0], rest[1])
+		deliver = append(deliver, 0x42, 0x10, 0x10, 0x21, 0x00, 0x00, 0x40) // 2024-01-01 12:00:00 +01:00
+		deliver = append(deliver, rest[3:]...)
+		delivers = append(delivers, strings.ToUpper(hex.EncodeToString(deliver)))
+	}
+	return delivers
+}
+
+// TestDecodeDeliverPDU tests decoding of received messages.
+func TestDecodeDeliverPDU(t *testing.T) {
+	msg, err := DecodeDeliverPDU("07911326040000F0040B911346610089F60000208062917314080CC8F71D14969741F977FD07")
+	if err != nil {
+		t.Fatalf("DecodeDeliverPDU: %v", err)
+	}
+	if msg.Sender != "+31641600986" || msg.Text != "How are you?" || msg.Concat != nil {
+		t.Errorf("Unexpected message %+v", msg)
+	}
+	if y, m, d := msg.Timestamp.Date(); y != 2002 || m != time.August || d != 26 {
+		t.Errorf("Unexpected timestamp %v", msg.Timestamp)
+	}
+
+	for _, text := range []string{"Grüße € [ok]", "Привет 👋"} {
+		pdus := deliverPDUs(t, "+46708251358", text, 0)
+		msg, err := DecodeDeliverPDU(pdus[0])
+		if err != nil {
+			t.Fatalf("DecodeDeliverPDU: %v", err)
+		}
+		if msg.Text != text || msg.Sender != "+46708251358" {
+			t.Errorf("Decoded %q from %s, want %q", msg.Text, msg.Sender, text)
+		}
+		if _, offset := msg.Timestamp.Zone(); offset != 3600 || msg.Timestamp.Hour() != 12 {
+			t.Errorf("Unexpected timestamp %v", msg.Timestamp)
+		}
+	}
+
+	if _, err := DecodeDeliverPDU("0011000B916407281553F80000A70AE8329BFD4697D9EC37"); err == nil {
+		t.Error("Expected an error for an SMS-SUBMIT PDU")
+	}
+	if _, err := DecodeDeliverPDU("07911326040000F0040B91"); err == nil {
+		t.Error("Expected an error for a truncated PDU")
+	}
+}
+
+// TestDecodeConcatenatedDeliverPDU tests that every part carries its header.
+func TestDecodeConcatenatedDeliverPDU(t *testing.T) {
+	for _, text := range []string{strings.Repeat("abc{", 50), strings.Repeat("Ж", 100)} {
+		pdus := deliverPDUs(t, "+46708251358", text, 77)
+		var joined strings.Builder
+		for i, pdu := range pdus {
+			msg, err := DecodeDeliverPDU(pdu)
+			if err != nil {
+				t.Fatalf("DecodeDeliverPDU: %v", err)
+			}
+			want := Concat{Ref: 77, Total: len(pdus), Seq: i + 1}
+			if msg.Concat == nil || *msg.Concat != want {
+				t.Fatalf("Part %d has concatenation %+v, want %+v", i+1, msg.Concat, want)
+			}
+			joined.WriteString(msg.Text)
+		}
+		if joined.String() != text {
+			t.Errorf("Joined text %q, want %q", joined.String(), text)
+		}
+	}
+}
+
+// TestEncodeSubmitPDUStatusReport tests the status report request bit.
+func TestEncodeSubmitPDUStatusReport(t *testing.T) {
+	pdus, err := EncodeSubmitPDUs("+46708251358", "hellohello", 0, true)
+	if err != nil {
+		t.Fatalf("EncodeSubmitPDUs failed: %v", err)
+	}
+	if !strings.HasPrefix(pdus[0].Hex, "0031") {
+		t.Errorf("Expected first octet 0x31, got %s", pdus[0].Hex)
+	}
+}
@@ -0,0 +1,241 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"message_handler/retry"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// PoolStrategy selects the modem of a pool that sends the next message
+type PoolStrategy string
+
+const (
+	RoundRobin PoolStrategy = "round-robin" // take turns
+	LeastBusy  PoolStrategy = "least-busy"  // fewest messages waiting or in flight
+)
+
+// ModemHealth is a snapshot of one modem in the pool
+type ModemHealth struct {
+	ProviderHealth
+	Busy  int         `json:"busy"` // messages waiting for or being sent by this modem
+	Modem ModemStatus `json:"modem"`
+}
+
+// poolJob is a message handed to a modem's worker
+type poolJob struct {
+	sms    *SMS
+	result chan error
+}
+
+// poolModem is one modem of a pool with its own worker, rate limit and health
+type poolModem struct {
+	name     string
+	provider *HardwareProvider
+	limiter  *rate.Limiter
+	breaker  *circuitBreaker
+	jobs     chan poolJob
+	busy     int // guarded by the pool's mu
+}
+
+// ModemPool spreads messages over several modems. Every modem has its own
+// worker and an optional rate limit; a modem that keeps failing is taken
+// out of rotation for a while, and a message it fails to send is offered
+// to the next modem. The pool is a single provider named "hardware".
+type ModemPool struct {
+	mu       sync.Mutex
+	modems   []*poolModem
+	strategy PoolStrategy
+	next     int // next modem for round-robin
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewModemPool creates an empty pool that picks modems by strategy
+func NewModemPool(strategy PoolStrategy) *ModemPool {
+	return &ModemPool{strategy: strategy, stopCh: make(chan struct{})}
+}
+
+// AddModem adds a modem to the pool. perMinute limits the messages it
+// sends per minute; zero means no limit. After threshold consecutive
+// failures the modem is taken out of rotation for cooldown. Call it before
+// Start.
+func (p *ModemPool) AddModem(name string, provider *HardwareProvider, perMinute float64, threshold int, cooldown time.Duration) {
+	limit := rate.Inf
+	if perMinute > 0 {
+		limit = rate.Limit(perMinute / 60)
+	}
+	p.modems = append(p.modems, &poolModem{
+		name:     name,
+		provider: provider,
+		limiter:  rate.NewLimiter(limit, 1),
+		breaker:  newCircuitBreaker(name, threshold, cooldown),
+		jobs:     make(chan poolJob),
+	})
+}
+
+// Start starts one worker per modem
+func (p *ModemPool) Start() {
+	for _, modem := range p.modems {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.work(modem)
+		}()
+	}
+}
+
+// Stop stops the workers once their current message is sent
+func (p *ModemPool) Stop() {
+	close(p.stopCh)
+	p.wg.Wait()
+}
+
+// work sends the messages handed to a modem, respecting its rate limit
+func (p *ModemPool) work(modem *poolModem) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-p.stopCh
+		cancel()
+	}()
+
+	for {
+		select {
+		case job := <-modem.jobs:
+			if err := modem.limiter.Wait(ctx); err != nil {
+				job.result <- fmt.Errorf("modem %s stopped", modem.name)
+				continue
+			}
+			job.result <- modem.provider.Send(job.sms)
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+func (p *ModemPool) Name() string { return "hardware" }
+
+// Send hands the message to a modem chosen by the pool's strategy. If that
+// modem fails for a reason other than the message itself, the next healthy
+// modem is tried.
+func (p *ModemPool) Send(sms *SMS) error {
+	tried := make(map[*poolModem]bool)
+	var failures []string
+	var lastErr error
+	for {
+		modem := p.pick(tried)
+		if modem == nil {
+			break
+		}
+		tried[modem] = true
+
+		err := p.sendVia(modem, sms)
+		if err == nil {
+			modem.breaker.success()
+			if len(p.modems) > 1 {
+				log.Printf("SMS %s sent via modem %s", sms.ID, modem.name)
+			}
+			return nil
+		}
+		if retry.IsPermanent(err) {
+			// The message itself is at fault, not the modem
+			return err
+		}
+		if modem.breaker.failure(err) {
+			log.Printf("Modem %s failed %d times in a row, taking it out of rotation for %s", modem.name, modem.breaker.threshold, modem.breaker.cooldown)
+		}
+		lastErr = err
+		failures = append(failures, fmt.Sprintf("%s: %v", modem.name, err))
+	}
+
+	if len(failures) == 0 {
+		return errors.New("no healthy modem available")
+	}
+	if len(failures) == 1 {
+		return lastErr
+	}
+	return fmt.Errorf("all modems failed: %s", strings.Join(failures, "; "))
+}
+
+// sendVia queues the message for a modem reserved by pick, waits for the
+// result and releases the modem
+func (p *ModemPool) sendVia(modem *poolModem, sms *SMS) error {
+	defer p.release(modem)
+	result := make(chan error, 1)
+	select {
+	case modem.jobs <- poolJob{sms: sms, result: result}:
+	case <-p.stopCh:
+		return errors.New("modem pool stopped")
+	}
+	return <-result
+}
+
+// pick reserves the next healthy modem that was not tried yet
+func (p *ModemPool) pick(tried map[*poolModem]bool) *poolModem {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var chosen *poolModem
+	for i := range p.modems {
+		idx := (p.next + i) % len(p.modems)
+		modem := p.modems[idx]
+		if tried[modem] || !modem.provider.Connected() || !modem.breaker.allow() {
+			continue
+		}
+		if p.strategy == RoundRobin {
+			chosen = modem
+			p.next = idx + 1
+			break
+		}
+		if chosen == nil || modem.busy < chosen.busy {
+			chosen = modem
+		}
+	}
+	if chosen != nil {
+		chosen.busy++
+	}
+	return chosen
+}
+
+// release marks a message of modem as done
+func (p *ModemPool) release(modem *poolModem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	modem.busy--
+}
+
+// Capabilities are those of the first modem; all modems are driven alike
+func (p *ModemPool) Capabilities() Capabilities {
+	if len(p.modems) == 0 {
+		return Capabilities{}
+	}
+	return p.modems[0].provider.Capabilities()
+}
+
+// Size returns the number of modems in the pool
+func (p *ModemPool) Size() int {
+	return len(p.modems)
+}
+
+// Health returns the state of every modem in the pool
+func (p *ModemPool) Health() []ModemHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	health := make([]ModemHealth, 0, len(p.modems))
+	for _, modem := range p.modems {
+		health = append(health, ModemHealth{
+			ProviderHealth: modem.breaker.snapshot(),
+			Busy:           modem.busy,
+			Modem:          modem.provider.Status(),
+		})
+	}
+	return health
+}
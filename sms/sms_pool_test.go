@@ -0,0 +1,155 @@
+package sms
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingModem is a fake modem that counts submitted messages and answers
+// them with final
+func countingModem(sent *atomic.Int32, final string) *fakeModem {
+	return newFakeModem(func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "AT+CMGS="):
+			return "\r\n> "
+		case strings.HasSuffix(cmd, "\x1a"):
+			sent.Add(1)
+			return final
+		}
+		return "\r\nOK\r\n"
+	})
+}
+
+// TestModemPoolRoundRobin tests that messages take turns over the modems.
+func TestModemPoolRoundRobin(t *testing.T) {
+	var sentA, sentB atomic.Int32
+	modemA := countingModem(&sentA, "\r\n+CMGS: 1\r\n\r\nOK\r\n")
+	modemB := countingModem(&sentB, "\r\n+CMGS: 1\r\n\r\nOK\r\n")
+	defer modemA.Close()
+	defer modemB.Close()
+
+	pool := NewModemPool(RoundRobin)
+	pool.AddModem("a", NewHardwareProvider(modemA, ModeText), 0, 3, time.Minute)
+	pool.AddModem("b", NewHardwareProvider(modemB, ModeText), 0, 3, time.Minute)
+	pool.Start()
+	defer pool.Stop()
+
+	for i := 0; i < 4; i++ {
+		if err := pool.Send(&SMS{ID: "msg", Recipient: "+1234567890", Message: "Hi"}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	if sentA.Load() != 2 || sentB.Load() != 2 {
+		t.Errorf("Expected 2 messages per modem, got %d and %d", sentA.Load(), sentB.Load())
+	}
+}
+
+// TestModemPoolFailover tests that a failing modem is skipped and taken out
+// of rotation.
+func TestModemPoolFailover(t *testing.T) {
+	var sentBad, sentGood atomic.Int32
+	bad := countingModem(&sentBad, "\r\n+CMS ERROR: 331\r\n") // no network service
+	good := countingModem(&sentGood, "\r\n+CMGS: 1\r\n\r\nOK\r\n")
+	defer bad.Close()
+	defer good.Close()
+
+	pool := NewModemPool(RoundRobin)
+	pool.AddModem("bad", NewHardwareProvider(bad, ModeText), 0, 2, time.Minute)
+	pool.AddModem("good", NewHardwareProvider(good, ModeText), 0, 2, time.Minute)
+	pool.Start()
+	defer pool.Stop()
+
+	for i := 0; i < 4; i++ {
+		if err := pool.Send(&SMS{ID: "msg", Recipient: "+1234567890", Message: "Hi"}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	if sentGood.Load() != 4 {
+		t.Errorf("Expected all messages via the good modem, got %d", sentGood.Load())
+	}
+	if sentBad.Load() != 2 {
+		t.Errorf("Expected the bad modem to be tried twice before leaving rotation, got %d", sentBad.Load())
+	}
+
+	health := pool.Health()
+	if health[0].Circuit != CircuitOpen || health[1].Circuit != CircuitClosed {
+		t.Errorf("Unexpected health %+v", health)
+	}
+}
+
+// TestModemPoolLeastBusy tests that the modem with the fewest messages is picked.
+func TestModemPoolLeastBusy(t *testing.T) {
+	pool := NewModemPool(LeastBusy)
+	for _, name := range []string{"a", "b", "c"} {
+		pool.AddModem(name, NewHardwareProvider(newFakeModem(smsModem("")), ModeText), 0, 3, time.Minute)
+	}
+	pool.AddModem("d", NewHardwareProvider(nil, ModeText), 0, 3, time.Minute) // disconnected
+	pool.modems[0].busy = 2
+	pool.modems[2].busy = 1
+
+	if modem := pool.pick(map[*poolModem]bool{}); modem.name != "b" {
+		t.Errorf("Expected modem b, got %s", modem.name)
+	}
+	if modem := pool.pick(map[*poolModem]bool{pool.modems[1]: true}); modem.name != "c" {
+		t.Errorf("Expected modem c when b was tried, got %s", modem.name)
+	}
+}
+
+// TestModemPoolRateLimit tests the per-modem throughput limit.
+func TestModemPoolRateLimit(t *testing.T) {
+	var sent atomic.Int32
+	modem := countingModem(&sent, "\r\n+CMGS: 1\r\n\r\nOK\r\n")
+	defer modem.Close()
+
+	pool := NewModemPool(RoundRobin)
+	pool.AddModem("a", NewHardwareProvider(modem, ModeText), 600, 3, time.Minute) // one per 100ms
+	pool.Start()
+	defer pool.Stop()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := pool.Send(&SMS{ID: "msg", Recipient: "+1234567890", Message: "Hi"}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("Expected sends to be spaced out, took %s", elapsed)
+	}
+}
+
+// TestQueueWorkers tests that the queue delivers messages concurrently.
+func TestQueueWorkers(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	release := make(chan struct{})
+	queue := NewSMSQueue(10)
+	queue.SetWorkers(2)
+	queue.SetProviders(NewFuncProvider("slow", Capabilities{}, func(*SMS) error {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return nil
+	}))
+	queue.Start()
+
+	for i := 0; i < 4; i++ {
+		if err := queue.Send(&SMS{Recipient: "+1234567890", Message: "Hi"}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	queue.Stop()
+
+	if maxInFlight != 2 {
+		t.Errorf("Expected 2 concurrent deliveries, got %d", maxInFlight)
+	}
+}
@@ -0,0 +1,262 @@
+package sms
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Capabilities describes what a provider can do with a message
+type Capabilities struct {
+	Unicode         bool `json:"unicode"`          // Sends non-GSM characters intact
+	Multipart       bool `json:"multipart"`        // Sends messages longer than one SMS
+	DeliveryReports bool `json:"delivery_reports"` // Reports delivery to the handset
+}
+
+// Provider is a backend that can send SMS messages
+type Provider interface {
+	Name() string
+	Send(sms *SMS) error
+	Capabilities() Capabilities
+}
+
+// Registry holds the providers that SMS_PROVIDER can select by name
+type Registry struct {
+	mu        sync.Mutex
+	providers map[string]Provider
+}
+
+// NewRegistry creates an empty provider registry
+func NewRegistry() *Registry {
+	return &Registry{providers: make(map[string]Provider)}
+}
+
+// Register adds a provider. Names must be unique.
+func (r *Registry) Register(provider Provider) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := provider.Name()
+	if _, exists := r.providers[name]; exists {
+		return fmt.Errorf("SMS provider %q is already registered", name)
+	}
+	r.providers[name] = provider
+	return nil
+}
+
+// Get returns the provider registered under name
+func (r *Registry) Get(name string) (Provider, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	provider, ok := r.providers[name]
+	return provider, ok
+}
+
+// Names returns the names of all registered providers, sorted
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// funcProvider adapts a plain function to the Provider interface
+type funcProvider struct {
+	name string
+	caps Capabilities
+	send func(*SMS) error
+}
+
+// NewFuncProvider wraps a send function as a Provider
+func NewFuncProvider(name string, caps Capabilities, send func(*SMS) error) Provider {
+	return &funcProvider{name: name, caps: caps, send: send}
+}
+
+func (p *funcProvider) Name() string               { return p.name }
+func (p *funcProvider) Send(sms *SMS) error        { return p.send(sms) }
+func (p *funcProvider) Capabilities() Capabilities { return p.caps }
+
+// ModemMode selects how messages are handed to the modem
+type ModemMode string
+
+const (
+	ModeText ModemMode = "text" // AT+CMGF=1, plain text
+	ModePDU  ModemMode = "pdu"  // AT+CMGF=0, encoded GSM-7 or UCS-2
+)
+
+// HardwareProvider sends SMS through an AT-command modem on a serial port
+type HardwareProvider struct {
+	mu      sync.Mutex // The modem handles one command sequence at a time
+	conn    *ATConn
+	mode    ModemMode
+	ref     byte             // Reference number of the last concatenated message
+	reports *DeliveryReports // Set when delivery reports are requested
+	profile ModemProfile     // Set-up run by Init
+
+	statusMu sync.Mutex // Separate from mu, which is held while sending
+	status   ModemStatus
+}
+
+// NewHardwareProvider creates a provider for the modem on port
+func NewHardwareProvider(port io.ReadWriter, mode ModemMode) *HardwareProvider {
+	return &HardwareProvider{conn: NewATConn(port), mode: mode}
+}
+
+// Conn returns the AT connection to the modem
+func (p *HardwareProvider) Conn() *ATConn {
+	return p.conn
+}
+
+// Connected reports whether the modem's serial port is usable
+func (p *HardwareProvider) Connected() bool {
+	return p.conn.Connected()
+}
+
+// Init prepares a freshly connected modem: it checks that the modem
+// answers, turns off command echo, unlocks the SIM, applies the profile,
+// selects the message mode and enables the message indications. It
+// returns ErrSIMLocked, ErrSIMPINRejected or ErrSIMBlocked if the SIM
+// cannot be used.
+func (p *HardwareProvider) Init() error {
+	if err := p.initModem(); err != nil {
+		return err
+	}
+	return p.EnableIndications()
+}
+
+func (p *HardwareProvider) initModem() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	timeout, _ := p.conn.Timeouts()
+	for _, cmd := range []string{"AT", "ATE0"} {
+		if _, err := p.conn.Command(cmd, timeout); err != nil {
+			return fmt.Errorf("modem initialisation failed: %w", err)
+		}
+	}
+	if err := p.unlockSIM(timeout); err != nil {
+		return err
+	}
+
+	cmgf := "AT+CMGF=1"
+	if p.mode == ModePDU {
+		cmgf = "AT+CMGF=0"
+	}
+	for _, cmd := range append(p.profileCommands(), cmgf) {
+		if _, err := p.conn.Command(cmd, timeout); err != nil {
+			return fmt.Errorf("modem initialisation failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// Status returns the last known connection and network state of the modem
+func (p *HardwareProvider) Status() ModemStatus {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	status := p.status
+	status.Connected = p.Connected()
+	return status
+}
+
+// updateStatus changes the recorded modem state
+func (p *HardwareProvider) updateStatus(fn func(*ModemStatus)) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	fn(&p.status)
+}
+
+func (p *HardwareProvider) Name() string { return "hardware" }
+
+// EnableDeliveryReports makes the provider request a delivery report for
+// every message and hand the reports the modem receives to reports
+func (p *HardwareProvider) EnableDeliveryReports(reports *DeliveryReports) error {
+	p.mu.Lock()
+	p.reports = reports
+	p.mu.Unlock()
+
+	p.conn.HandleURC("+CDS", reports.HandleURC)
+	if !p.Connected() {
+		return nil // Init enables them once the modem is connected
+	}
+	return p.EnableIndications()
+}
+
+// EnableIndications tells the modem to announce new messages with +CMTI
+// and, if delivery reports are enabled, to pass them on with +CDS
+func (p *HardwareProvider) EnableIndications() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ds := 0
+	if p.reports != nil {
+		ds = 1
+	}
+	timeout, _ := p.conn.Timeouts()
+	if _, err := p.conn.Command(fmt.Sprintf("AT+CNMI=2,1,0,%d,0", ds), timeout); err != nil {
+		return fmt.Errorf("failed to configure message indications: %w", err)
+	}
+	return nil
+}
+
+func (p *HardwareProvider) Send(sms *SMS) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var refs []int
+	var err error
+	statusReport := p.reports != nil
+	segments := CountSegments(sms.Message)
+	if p.mode == ModeText && segments == 1 {
+		refs, err = SendSMSviaHardware(p.conn, sms.Recipient, sms.Message, statusReport)
+	} else {
+		if p.mode == ModeText {
+			// Text mode cannot carry the concatenation header
+			log.Printf("SMS %s needs %d segments, sending it in PDU mode", sms.ID, segments)
+		}
+		if segments > 1 {
+			p.ref++
+		}
+		refs, err = SendSMSviaHardwarePDU(p.conn, sms.Recipient, sms.Message, p.ref, statusReport)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("SMS %s accepted by the network, message reference(s) %v", sms.ID, refs)
+	if p.reports != nil {
+		p.reports.Track(sms.ID, refs)
+	}
+	return nil
+}
+
+func (p *HardwareProvider) Capabilities() Capabilities {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Capabilities{Unicode: p.mode == ModePDU, Multipart: true, DeliveryReports: p.reports != nil}
+}
+
+// TwilioProvider sends SMS through the Twilio API
+type TwilioProvider struct {
+	AccountSID     string
+	AuthToken      string
+	From           string // Twilio phone number
+	StatusCallback string // Public URL of the status callback endpoint; empty disables callbacks
+}
+
+func (p *TwilioProvider) Name() string { return "twilio" }
+
+func (p *TwilioProvider) Send(sms *SMS) error {
+	return SendSMSviaTwilio(p.AccountSID, p.AuthToken, p.From, p.StatusCallback, sms)
+}
+
+func (p *TwilioProvider) Capabilities() Capabilities {
+	return Capabilities{Unicode: true, Multipart: true, DeliveryReports: true}
+}
@@ -1,77 +1,464 @@
 package sms
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"message_handler/retry"
+	"message_handler/schedule"
+	"message_handler/status"
+	"strings"
 	"sync"
+	"time"
+)
 
+var (
+	// ErrDeadLetterNotFound is returned when a dead letter ID is unknown
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	// ErrQueueFull is returned when the queue has no room for another message
+	ErrQueueFull = errors.New("SMS queue is full")
+	// ErrBatchTooLarge is returned for more messages than the queue can hold
+	ErrBatchTooLarge = errors.New("more messages than the SMS queue can hold")
 )
 
 // SMS represents a single SMS message
 type SMS struct {
-	Recipient string
-	Message   string
+	ID        string `json:"id"`
+	Recipient string `json:"recipient"`
+	Message   string `json:"message"`
+	Attempts  int    `json:"attempts,omitempty"`
 }
 
 // SMSQueue handles SMS sending in a queue with multiple sender options
 type SMSQueue struct {
-	queue       chan *SMS
-	stopCh      chan struct{}
-	wg          sync.WaitGroup
-	hardwareSend func(*SMS) error // Hardware-based sender
-	twilioSend   func(*SMS) error // Twilio-based sender
-	provider     string           // Selected provider ("hardware" or "twilio")
+	queue        chan *SMS
+	sendMu       sync.Mutex // Serialises Send so the queue cannot fill up between check and send
+	stopCh       chan struct{}
+	wg           sync.WaitGroup
+	providers    []Provider                 // Provider chain, tried in order
+	breakers     map[string]*circuitBreaker // Health of every provider in the chain
+	breakerLimit int                        // Consecutive failures that open a circuit
+	breakerDelay time.Duration              // How long an open circuit skips its provider
+	journal      *Journal                   // Optional on-disk journal for durability
+	retry        retry.Policy               // Retry policy for failed sends
+	deadLetters  *DeadLetterStore           // Messages that exhausted their retries
+	retryMu      sync.Mutex
+	retries      []pendingRetry // Failed messages waiting for their next attempt
+	wake         chan struct{}  // Signals the dispatcher that a retry was scheduled
+	workers      int            // Messages delivered concurrently
+	inflight     sync.WaitGroup
+	status       *status.Store // Optional lifecycle tracking
+}
+
+// pendingRetry is a failed message and the time of its next attempt
+type pendingRetry struct {
+	sms *SMS
+	due time.Time
+}
+
+// SetProviders sets the provider chain. Each message is offered to the
+// providers in order until one of them sends it.
+func (q *SMSQueue) SetProviders(providers ...Provider) {
+	q.providers = providers
+	q.breakers = make(map[string]*circuitBreaker, len(providers))
+	for _, provider := range providers {
+		q.breakers[provider.Name()] = newCircuitBreaker(provider.Name(), q.breakerLimit, q.breakerDelay)
+	}
 }
 
-// SetProvider sets the preferred SMS provider
-func (q *SMSQueue) SetProvider(provider string) {
-	q.provider = provider
+// SetCircuitBreaker configures after how many consecutive failures a
+// provider is skipped, and for how long. Call it before SetProviders.
+func (q *SMSQueue) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	q.breakerLimit = threshold
+	q.breakerDelay = cooldown
 }
 
-// SetHardwareSender configures the hardware SMS sender
-func (q *SMSQueue) SetHardwareSender(sendFunc func(*SMS) error) {
-	q.hardwareSend = sendFunc
+// ProviderHealth returns the health of every provider in the chain
+func (q *SMSQueue) ProviderHealth() []ProviderHealth {
+	health := make([]ProviderHealth, 0, len(q.providers))
+	for _, provider := range q.providers {
+		health = append(health, q.breakers[provider.Name()].snapshot())
+	}
+	return health
 }
 
-// SetTwilioSender configures the Twilio SMS sender
-func (q *SMSQueue) SetTwilioSender(sendFunc func(*SMS) error) {
-	q.twilioSend = sendFunc
+// SetJournal makes the queue durable. Messages are written to the journal
+// before they are queued, and unsent messages are replayed on Start.
+func (q *SMSQueue) SetJournal(journal *Journal) {
+	q.journal = journal
+	for _, letter := range journal.DeadLetters() {
+		q.deadLetters.Add(letter)
+	}
 }
 
-// Send queues an SMS message for sending
-func (q *SMSQueue) Send(sms *SMS) {
-	q.queue <- sms
+// SetStatusStore makes the queue record the lifecycle of every message
+func (q *SMSQueue) SetStatusStore(store *status.Store) {
+	q.status = store
 }
 
-// Start begins processing the SMS queue
+// setStatus records the state of a message if status tracking is enabled
+func (q *SMSQueue) setStatus(sms *SMS, state status.State, err error) {
+	if q.status != nil {
+		q.status.Set(sms.ID, status.KindSMS, state, err)
+	}
+}
+
+// SetRetryPolicy configures how failed sends are retried before a message
+// is moved to the dead-letter store
+func (q *SMSQueue) SetRetryPolicy(policy retry.Policy) {
+	q.retry = policy
+}
+
+// SetWorkers configures how many messages are delivered concurrently, e.g.
+// one per modem in a pool. Call it before Start.
+func (q *SMSQueue) SetWorkers(workers int) {
+	if workers > 0 {
+		q.workers = workers
+	}
+}
+
+// Send queues an SMS message for sending, assigning it an ID if it has
+// none. It returns ErrQueueFull instead of blocking when the queue is full.
+func (q *SMSQueue) Send(sms *SMS) error {
+	return q.SendAll(sms)
+}
+
+// SendAll queues several messages together like Send: either all of them
+// are queued or, if the queue has no room for all of them, none is. It
+// returns ErrBatchTooLarge if they would not fit even an empty queue.
+func (q *SMSQueue) SendAll(msgs ...*SMS) error {
+	for _, sms := range msgs {
+		if sms.ID == "" {
+			sms.ID = status.NewID()
+		}
+	}
+
+	q.sendMu.Lock()
+	defer q.sendMu.Unlock()
+
+	if len(msgs) > cap(q.queue) {
+		return ErrBatchTooLarge
+	}
+	if cap(q.queue)-len(q.queue) < len(msgs) {
+		return ErrQueueFull
+	}
+	if q.journal != nil {
+		if err := q.journal.Append(msgs...); err != nil {
+			return err
+		}
+	}
+	for _, sms := range msgs {
+		q.setStatus(sms, status.Queued, nil)
+		if q.status != nil {
+			q.status.SetSegments(sms.ID, CountSegments(sms.Message))
+		}
+		// Cannot block: only SendAll adds to the queue and it checked for room
+		q.queue <- sms
+	}
+	return nil
+}
+
+// Start begins processing the SMS queue. A dispatcher hands messages and
+// due retries to up to the configured number of concurrent deliveries.
 func (q *SMSQueue) Start() {
+	sem := make(chan struct{}, q.workers)
 	q.wg.Add(1)
 	go func() {
 		defer q.wg.Done()
+		defer q.inflight.Wait()
+		if q.journal != nil {
+			replayed := q.journal.Replay()
+			for _, sms := range replayed {
+				q.setStatus(sms, status.Queued, nil)
+				if q.status != nil {
+					q.status.SetSegments(sms.ID, CountSegments(sms.Message))
+				}
+			}
+			for _, sms := range replayed {
+				if !q.dispatch(sem, sms) {
+					return
+				}
+			}
+		}
 		for {
+			var timer *time.Timer
+			var retryCh <-chan time.Time
+			if next, ok := q.nextRetry(); ok {
+				timer = time.NewTimer(time.Until(next))
+				retryCh = timer.C
+			}
+
+			stopped := false
 			select {
 			case sms := <-q.queue:
-				var err error
-				if q.provider == "twilio" && q.twilioSend != nil {
-					err = q.twilioSend(sms)
-				} else if q.provider == "hardware" && q.hardwareSend != nil {
-					err = q.hardwareSend(sms)
-				} else {
-					log.Println("No sender configured or provider not set correctly")
-				}
-				if err != nil {
-					log.Printf("Failed to send SMS to %s: %v", sms.Recipient, err)
+				stopped = !q.dispatch(sem, sms)
+			case <-retryCh:
+				for _, sms := range q.takeDue() {
+					if !q.dispatch(sem, sms) {
+						stopped = true
+						break
+					}
 				}
+			case <-q.wake:
+				// a retry was scheduled; recompute the timer
 			case <-q.stopCh:
+				stopped = true
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			if stopped {
+				q.inflight.Wait()
+				q.dropRetries()
 				return
 			}
 		}
 	}()
 }
 
+// dispatch delivers a message as soon as a worker is free. It reports false
+// if the queue was stopped while waiting.
+func (q *SMSQueue) dispatch(sem chan struct{}, sms *SMS) bool {
+	select {
+	case sem <- struct{}{}:
+	case <-q.stopCh:
+		q.dropUnsent(sms)
+		return false
+	}
+	q.inflight.Add(1)
+	go func() {
+		defer q.inflight.Done()
+		defer func() { <-sem }()
+		q.deliver(sms)
+	}()
+	return true
+}
+
+// nextRetry returns when the earliest pending retry is due
+func (q *SMSQueue) nextRetry() (time.Time, bool) {
+	q.retryMu.Lock()
+	defer q.retryMu.Unlock()
+
+	if len(q.retries) == 0 {
+		return time.Time{}, false
+	}
+	next := q.retries[0].due
+	for _, r := range q.retries[1:] {
+		if r.due.Before(next) {
+			next = r.due
+		}
+	}
+	return next, true
+}
+
+// takeDue removes and returns every pending retry whose time has come
+func (q *SMSQueue) takeDue() []*SMS {
+	q.retryMu.Lock()
+	defer q.retryMu.Unlock()
+
+	now := time.Now()
+	var due []*SMS
+	remaining := q.retries[:0]
+	for _, r := range q.retries {
+		if r.due.After(now) {
+			remaining = append(remaining, r)
+		} else {
+			due = append(due, r.sms)
+		}
+	}
+	q.retries = remaining
+	return due
+}
+
+// scheduleRetry queues a failed message for another attempt after delay
+func (q *SMSQueue) scheduleRetry(sms *SMS, delay time.Duration) {
+	q.retryMu.Lock()
+	q.retries = append(q.retries, pendingRetry{sms: sms, due: time.Now().Add(delay)})
+	q.retryMu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default: // the dispatcher is already due to look
+	}
+}
+
+// dropRetries is called on shutdown. With a journal the messages are still
+// pending on disk and are retried after a restart; without one they are lost.
+func (q *SMSQueue) dropRetries() {
+	q.retryMu.Lock()
+	defer q.retryMu.Unlock()
+
+	for _, r := range q.retries {
+		q.dropUnsent(r.sms)
+	}
+	q.retries = nil
+}
+
+// dropUnsent logs a message that is abandoned at shutdown without a journal
+func (q *SMSQueue) dropUnsent(sms *SMS) {
+	if q.journal == nil {
+		log.Printf("Dropping unsent SMS %s to %s at shutdown", sms.ID, maskPhone(sms.Recipient))
+	}
+}
+
+// deliver sends a single message and marks it done in the journal on
+// success. Failures are retried according to the retry policy; messages
+// that cannot be delivered end up in the dead-letter store.
+func (q *SMSQueue) deliver(sms *SMS) {
+	q.setStatus(sms, status.Sending, nil)
+	err := q.send(sms)
+	if err == nil {
+		q.setStatus(sms, status.Sent, nil)
+		if q.journal != nil {
+			if err := q.journal.MarkDone(sms.ID); err != nil {
+				log.Printf("Failed to mark SMS %s as done: %v", sms.ID, err)
+			}
+		}
+		return
+	}
+
+	sms.Attempts++
+	if q.retry.ShouldRetry(sms.Attempts, err) {
+		delay := q.retry.Delay(sms.Attempts)
+		log.Printf("Failed to send SMS to %s (attempt %d of %d), retrying in %s: %v",
+			maskPhone(sms.Recipient), sms.Attempts, q.retry.MaxAttempts, delay, err)
+		q.setStatus(sms, status.Queued, err)
+		q.scheduleRetry(sms, delay)
+		return
+	}
+
+	log.Printf("Failed to send SMS to %s after %d attempt(s), moving it to the dead letters: %v",
+		maskPhone(sms.Recipient), sms.Attempts, err)
+	q.setStatus(sms, status.Failed, err)
+	letter := DeadLetter{SMS: sms, Error: err.Error(), FailedAt: time.Now().UTC()}
+	if q.journal != nil {
+		if err := q.journal.MarkDead(letter); err != nil {
+			log.Printf("Failed to journal dead letter %s: %v", sms.ID, err)
+		}
+	}
+	q.deadLetters.Add(letter)
+}
+
+// DeadLetters returns the messages that exhausted their retries
+func (q *SMSQueue) DeadLetters() []DeadLetter {
+	return q.deadLetters.List()
+}
+
+// Requeue moves a dead letter back into the queue with a fresh retry budget
+func (q *SMSQueue) Requeue(id string) error {
+	letter, ok := q.deadLetters.Take(id)
+	if !ok {
+		return ErrDeadLetterNotFound
+	}
+
+	sms := *letter.SMS
+	sms.Attempts = 0
+	if err := q.Send(&sms); err != nil {
+		q.deadLetters.Add(letter)
+		return err
+	}
+	return nil
+}
+
+// Purge discards a single dead letter
+func (q *SMSQueue) Purge(id string) error {
+	letter, ok := q.deadLetters.Take(id)
+	if !ok {
+		return ErrDeadLetterNotFound
+	}
+	if q.journal != nil {
+		if err := q.journal.Purge(id); err != nil {
+			q.deadLetters.Add(letter)
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeAll discards every dead letter and returns how many were removed
+func (q *SMSQueue) PurgeAll() (int, error) {
+	purged := 0
+	for _, letter := range q.deadLetters.List() {
+		err := q.Purge(letter.SMS.ID)
+		if errors.Is(err, ErrDeadLetterNotFound) {
+			// Requeued or purged concurrently
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// send offers the message to each available provider in the chain until one
+// succeeds. Providers with an open circuit are skipped. The returned error is
+// permanent only if every provider that was tried failed permanently, or if
+// a provider already sent part of the message.
+func (q *SMSQueue) send(sms *SMS) error {
+	var failures []string
+	var lastErr error
+	permanent := true
+	for _, provider := range q.providers {
+		name := provider.Name()
+		breaker := q.breakers[name]
+		if !breaker.allow() {
+			log.Printf("Skipping provider %s for SMS %s: circuit open", name, sms.ID)
+			continue
+		}
+
+		err := provider.Send(sms)
+		if err == nil {
+			breaker.success()
+			if q.status != nil {
+				q.status.SetProvider(sms.ID, name)
+			}
+			log.Printf("SMS %s to %s delivered via %s", sms.ID, maskPhone(sms.Recipient), name)
+			return nil
+		}
+
+		if errors.Is(err, ErrPartiallySent) {
+			// The recipient already has some segments, the next provider
+			// would send them again
+			return err
+		}
+		lastErr = err
+		failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		if retry.IsPermanent(err) {
+			// The message itself is at fault, not the provider
+			continue
+		}
+		permanent = false
+		if breaker.failure(err) {
+			log.Printf("Provider %s failed %d times in a row, skipping it for %s", name, q.breakerLimit, q.breakerDelay)
+		}
+		log.Printf("Provider %s failed to send SMS %s, trying the next provider: %v", name, sms.ID, err)
+	}
+
+	if len(failures) == 0 {
+		return errors.New("no SMS provider available")
+	}
+	if len(failures) == 1 {
+		return lastErr
+	}
+	err := fmt.Errorf("all providers failed: %s", strings.Join(failures, "; "))
+	if permanent {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
 func NewSMSQueue(bufferSize int) *SMSQueue {
 	return &SMSQueue{
-		queue:   make(chan *SMS, bufferSize),
-		stopCh:  make(chan struct{}),
+		queue:       make(chan *SMS, bufferSize),
+		breakers:    make(map[string]*circuitBreaker),
+		stopCh:      make(chan struct{}),
+		retry:       retry.Policy{MaxAttempts: 1},
+		deadLetters: NewDeadLetterStore(),
+		wake:        make(chan struct{}, 1),
+		workers:     1,
 	}
 }
 
@@ -79,3 +466,16 @@ func (q *SMSQueue) Stop() {
 	close(q.stopCh)
 	q.wg.Wait()
 }
+
+// SendScheduled is the scheduler handler for SMS: it queues the message
+// once its send time has come
+func SendScheduled(q *SMSQueue) schedule.Handler {
+	return func(job schedule.Job) error {
+		var sms SMS
+		if err := json.Unmarshal(job.Payload, &sms); err != nil {
+			return retry.Permanent(fmt.Errorf("unreadable scheduled SMS: %w", err))
+		}
+		sms.ID = job.ID
+		return q.Send(&sms)
+	}
+}
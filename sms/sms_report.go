@@ -0,0 +1,204 @@
+package sms
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"message_handler/status"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// reportTimeout is how long a sent message waits for its delivery
+	// report. Message references wrap after 256 messages, so old ones must
+	// not linger.
+	reportTimeout = 72 * time.Hour
+
+	// earlyReportTimeout is how long a report is kept that arrived before
+	// the send that caused it was recorded
+	earlyReportTimeout = time.Minute
+)
+
+// reportedMessage is a sent message waiting for the reports of its segments
+type reportedMessage struct {
+	id          string
+	outstanding int // segments without a final report
+	sent        time.Time
+}
+
+// earlyReport is a status report that did not match any sent message yet
+type earlyReport struct {
+	status   byte
+	received time.Time
+}
+
+// DeliveryReports correlates the status reports of a modem with the
+// messages they belong to, using the message reference from +CMGS, and
+// records whether the messages were delivered.
+type DeliveryReports struct {
+	mu      sync.Mutex
+	pending map[int]*reportedMessage // by message reference
+	early   map[int]earlyReport      // by message reference
+	status  *status.Store
+}
+
+// NewDeliveryReports creates a correlator that records outcomes in store
+func NewDeliveryReports(store *status.Store) *DeliveryReports {
+	return &DeliveryReports{
+		pending: make(map[int]*reportedMessage),
+		early:   make(map[int]earlyReport),
+		status:  store,
+	}
+}
+
+// Track records that message id was sent as the segments with message
+// references refs
+func (d *DeliveryReports) Track(id string, refs []int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for ref, msg := range d.pending {
+		if now.Sub(msg.sent) > reportTimeout {
+			delete(d.pending, ref)
+		}
+	}
+	for ref, report := range d.early {
+		if now.Sub(report.received) > earlyReportTimeout {
+			delete(d.early, ref)
+		}
+	}
+
+	msg := &reportedMessage{id: id, sent: now}
+	early := make(map[int]byte)
+	for _, ref := range refs {
+		if ref < 0 {
+			continue // the modem did not say
+		}
+		msg.outstanding++
+		d.pending[ref] = msg
+		if report, ok := d.early[ref]; ok {
+			delete(d.early, ref)
+			early[ref] = report.status
+		}
+	}
+	for ref, st := range early {
+		d.apply(ref, st)
+	}
+}
+
+// HandleURC processes a +CDS status report, in text or PDU mode
+func (d *DeliveryReports) HandleURC(urc URC) {
+	ref, st, err := parseStatusReport(urc)
+	if err != nil {
+		log.Printf("Modem: ignoring unreadable status report %q: %v", urc.Line, err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.pending[ref]; !ok {
+		// The report may have overtaken the end of the send
+		d.early[ref] = earlyReport{status: st, received: time.Now()}
+		return
+	}
+	d.apply(ref, st)
+}
+
+// apply records the status of one segment. The caller must hold d.mu.
+func (d *DeliveryReports) apply(ref int, st byte) {
+	msg, ok := d.pending[ref]
+	if !ok {
+		return
+	}
+	state, err, final := reportOutcome(st)
+	if !final {
+		return // the service centre is still trying
+	}
+	delete(d.pending, ref)
+
+	if state == status.Delivered {
+		msg.outstanding--
+		if msg.outstanding > 0 {
+			return
+		}
+	} else {
+		// One lost segment is enough to lose the message; drop the rest
+		for other, m := range d.pending {
+			if m == msg {
+				delete(d.pending, other)
+			}
+		}
+	}
+	log.Printf("SMS %s %s", msg.id, state)
+	if d.status != nil {
+		d.status.Set(msg.id, status.KindSMS, state, err)
+	}
+}
+
+// reportOutcome maps a TP-ST value to a message state. final is false
+// while the service centre is still trying to deliver.
+func reportOutcome(st byte) (state status.State, err error, final bool) {
+	switch {
+	case st < 0x20:
+		return status.Delivered, nil, true
+	case st < 0x40:
+		return "", nil, false
+	case st == 0x46:
+		return status.Expired, errors.New("validity period expired"), true
+	default:
+		return status.Failed, fmt.Errorf("not delivered: status 0x%02X", st), true
+	}
+}
+
+// parseStatusReport extracts the message reference and TP-ST from a +CDS
+// URC. In PDU mode the report is the PDU line; in text mode the line is
+// "+CDS: <fo>,<mr>,[<ra>],[<tora>],<scts>,<dt>,<st>".
+func parseStatusReport(urc URC) (int, byte, error) {
+	if urc.PDU != "" {
+		report, err := DecodeStatusReportPDU(urc.PDU)
+		if err != nil {
+			return 0, 0, err
+		}
+		return report.Reference, report.Status, nil
+	}
+
+	_, params, _ := strings.Cut(urc.Line, ":")
+	fields := splitParams(params)
+	if len(fields) < 7 {
+		return 0, 0, errors.New("too few fields")
+	}
+	ref, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	st, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || st < 0 || st > 255 {
+		return 0, 0, fmt.Errorf("invalid status %q", fields[len(fields)-1])
+	}
+	return ref, byte(st), nil
+}
+
+// splitParams splits the parameters of a response line at commas outside
+// quotes, removing the quotes
+func splitParams(params string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted := false
+	for _, r := range strings.TrimSpace(params) {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			fields = append(fields, strings.TrimSpace(field.String()))
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, strings.TrimSpace(field.String()))
+}
@@ -0,0 +1,127 @@
+package sms
+
+import (
+	"fmt"
+	"message_handler/status"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statusReportPDU builds an SMS-STATUS-REPORT PDU for message reference mr
+func statusReportPDU(mr, st byte) string {
+	return fmt.Sprintf("0006%02X0B916407281553F8%s%s%02X", mr, "42101021000040", "42101021500040", st)
+}
+
+// TestDecodeStatusReportPDU tests decoding of delivery reports.
+func TestDecodeStatusReportPDU(t *testing.T) {
+	report, err := DecodeStatusReportPDU(statusReportPDU(0x2A, 0x46))
+	if err != nil {
+		t.Fatalf("DecodeStatusReportPDU: %v", err)
+	}
+	if report.Reference != 0x2A || report.Recipient != "+46708251358" || report.Status != 0x46 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if report.Delivered.Minute() != 5 {
+		t.Errorf("Unexpected discharge time %v", report.Delivered)
+	}
+
+	if _, err := DecodeStatusReportPDU("07911326040000F0040B911346610089F60000208062917314080CC8F71D14969741F977FD07"); err == nil {
+		t.Error("Expected an error for an SMS-DELIVER PDU")
+	}
+}
+
+// TestParseStatusReport tests +CDS in text and PDU mode.
+func TestParseStatusReport(t *testing.T) {
+	ref, st, err := parseStatusReport(URC{Name: "+CDS", Line: `+CDS: 6,17,"+46708251358",145,"24/01/01,12:00:00+04","24/01/01,12:00:05+04",0`})
+	if err != nil || ref != 17 || st != 0 {
+		t.Errorf("Text mode: got %d, %d, %v", ref, st, err)
+	}
+	ref, st, err = parseStatusReport(URC{Name: "+CDS", Line: "+CDS: 25", PDU: statusReportPDU(3, 0x30)})
+	if err != nil || ref != 3 || st != 0x30 {
+		t.Errorf("PDU mode: got %d, %d, %v", ref, st, err)
+	}
+	if _, _, err := parseStatusReport(URC{Name: "+CDS", Line: "+CDS: 6,17"}); err == nil {
+		t.Error("Expected an error for a short text mode report")
+	}
+}
+
+// TestDeliveryReports tests correlation of reports with sent messages.
+func TestDeliveryReports(t *testing.T) {
+	store := status.NewStore(10)
+	reports := NewDeliveryReports(store)
+	report := func(mr, st byte) {
+		reports.HandleURC(URC{Name: "+CDS", Line: "+CDS: 25", PDU: statusReportPDU(mr, st)})
+	}
+
+	// A two-segment message is delivered once both segments are
+	store.Set("long", status.KindSMS, status.Sent, nil)
+	reports.Track("long", []int{1, 2})
+	report(1, 0x00)
+	if record, _ := store.Get("long"); record.State != status.Sent {
+		t.Errorf("Expected sent after one of two reports, got %s", record.State)
+	}
+	report(2, 0x20) // still trying
+	report(2, 0x00)
+	if record, _ := store.Get("long"); record.State != status.Delivered {
+		t.Errorf("Expected delivered, got %s", record.State)
+	}
+
+	store.Set("late", status.KindSMS, status.Sent, nil)
+	reports.Track("late", []int{3})
+	report(3, 0x46)
+	if record, _ := store.Get("late"); record.State != status.Expired || record.Error == "" {
+		t.Errorf("Expected expired with an error, got %+v", record)
+	}
+
+	// A report that overtakes the end of the send
+	report(4, 0x00)
+	reports.Track("fast", []int{4})
+	store.Set("fast", status.KindSMS, status.Sent, nil)
+	if record, _ := store.Get("fast"); record.State != status.Delivered {
+		t.Errorf("Expected delivered for an early report, got %s", record.State)
+	}
+}
+
+// TestHardwareProviderDeliveryReports tests that the modem is asked for
+// reports and that a +CDS updates the message status.
+func TestHardwareProviderDeliveryReports(t *testing.T) {
+	modem := newFakeModem(func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "AT+CMGS="):
+			return "\r\n> "
+		case strings.HasSuffix(cmd, "\x1a"):
+			return "\r\n+CMGS: 9\r\n\r\nOK\r\n\r\n+CDS: 6,9,\"+1234567890\",145,\"24/01/01,12:00:00+04\",\"24/01/01,12:00:05+04\",0\r\n"
+		}
+		return "\r\nOK\r\n"
+	})
+	defer modem.Close()
+
+	store := status.NewStore(10)
+	provider := NewHardwareProvider(modem, ModeText)
+	if err := provider.EnableDeliveryReports(NewDeliveryReports(store)); err != nil {
+		t.Fatalf("EnableDeliveryReports: %v", err)
+	}
+	if err := provider.Send(&SMS{ID: "msg", Recipient: "+1234567890", Message: "Hi"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		record, _ := store.Get("msg")
+		if record.State == status.Delivered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected delivered, got %+v", record)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	written := modem.Written()
+	for _, cmd := range []string{"AT+CNMI=2,1,0,1,0\r", "AT+CSMP=49,167,0,0\r"} {
+		if !strings.Contains(written, cmd) {
+			t.Errorf("Expected %q to be sent, got %q", cmd, written)
+		}
+	}
+}
@@ -1,18 +1,28 @@
 package sms
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"message_handler/retry"
+	"net/http"
+	"net/url"
 	"strings"
-	"time"
+
 	twilio "github.com/twilio/twilio-go"
+	"github.com/twilio/twilio-go/client"
 	openapi "github.com/twilio/twilio-go/rest/api/v2010"
 )
 
-// SendSMSviaTwilio sends SMS using Twilio's API
-func SendSMSviaTwilio(accountSID, authToken, twilioNumber string, sms *SMS) error {
-	client := twilio.NewRestClientWithParams(twilio.ClientParams{
+// ErrPartiallySent is returned when the network accepted some segments of a
+// concatenated message but not all of them
+var ErrPartiallySent = errors.New("message partially sent")
+
+// SendSMSviaTwilio sends SMS using Twilio's API. If statusCallback is set,
+// Twilio reports the delivery status of the message to that URL, with the
+// message ID added as the "id" query parameter.
+func SendSMSviaTwilio(accountSID, authToken, twilioNumber, statusCallback string, sms *SMS) error {
+	twilioClient := twilio.NewRestClientWithParams(twilio.ClientParams{
 		Username: accountSID,
 		Password: authToken,
 	})
@@ -21,45 +31,142 @@ func SendSMSviaTwilio(accountSID, authToken, twilioNumber string, sms *SMS) erro
 	params.SetTo(sms.Recipient)
 	params.SetFrom(twilioNumber)
 	params.SetBody(sms.Message)
+	if statusCallback != "" {
+		callback, err := statusCallbackURL(statusCallback, sms.ID)
+		if err != nil {
+			return retry.Permanent(err)
+		}
+		params.SetStatusCallback(callback)
+	}
 
-	resp, err := client.Api.CreateMessage(params)
+	resp, err := twilioClient.Api.CreateMessage(params)
 	if err != nil {
-		return err
+		return classifyTwilioError(err)
 	}
 
 	log.Printf("Twilio SMS sent: SID=%s Status=%s", *resp.Sid, *resp.Status)
 	return nil
 }
 
-// SendSMSviaHardware sends an SMS using a hardware modem over serial
-func SendSMSviaHardware(port io.ReadWriter, recipient, message string) error {
+// statusCallbackURL adds the message ID to the status callback URL
+func statusCallbackURL(base, id string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid status callback URL: %w", err)
+	}
+	query := u.Query()
+	query.Set("id", id)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// classifyTwilioError marks client errors (bad number, unverified sender,
+// ...) as permanent so they are not retried. Rate limiting and server
+// errors stay retryable.
+func classifyTwilioError(err error) error {
+	var restErr *client.TwilioRestError
+	if errors.As(err, &restErr) && restErr.Status >= 400 && restErr.Status < 500 &&
+		restErr.Status != http.StatusTooManyRequests {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
+// SendSMSviaHardware sends an SMS in text mode over an AT connection and
+// returns the message reference the network assigned to it. With
+// statusReport set the network is asked for a delivery report. Invalid
+// input and recipients the network rejects are reported as permanent
+// errors; modem errors, timeouts and I/O failures may be retried.
+func SendSMSviaHardware(conn *ATConn, recipient, message string, statusReport bool) ([]int, error) {
+	if !ValidatePhone(recipient) {
+		return nil, retry.Permanent(fmt.Errorf("invalid phone number: %s", maskPhone(recipient)))
+	}
+	if strings.TrimSpace(message) == "" {
+		return nil, retry.Permanent(errors.New("message cannot be empty"))
+	}
+
 	log.Printf("Sending SMS to %s", maskPhone(recipient))
 
 	// Set SMS to text mode
-	cmd := "AT+CMGF=1\r"
-	if _, err := port.Write([]byte(cmd)); err != nil {
-		return fmt.Errorf("failed to set text mode: %w", err)
+	timeout, _ := conn.Timeouts()
+	if _, err := conn.Command("AT+CMGF=1", timeout); err != nil {
+		return nil, fmt.Errorf("failed to set text mode: %w", err)
+	}
+	if statusReport {
+		// First octet 49: SMS-SUBMIT, relative validity period, status report
+		// request; validity 167: 24 hours
+		if _, err := conn.Command("AT+CSMP=49,167,0,0", timeout); err != nil {
+			return nil, fmt.Errorf("failed to request a delivery report: %w", err)
+		}
 	}
-	time.Sleep(1 * time.Second)
 
-	// Set recipient
-	cmd = fmt.Sprintf(`AT+CMGS="%s"`+"\r", recipient)
-	if _, err := port.Write([]byte(cmd)); err != nil {
-		return fmt.Errorf("failed to send phone number: %w", err)
+	mr, err := submit(conn, fmt.Sprintf(`AT+CMGS="%s"`, recipient), message)
+	if err != nil {
+		return nil, err
 	}
-	time.Sleep(1 * time.Second)
+	return []int{mr}, nil
+}
 
-	// Send message, followed by Ctrl+Z
-	if _, err := port.Write([]byte(message + string(rune(26)))); err != nil {
-		return fmt.Errorf("failed to send message: %w", err)
+// SendSMSviaHardwarePDU sends an SMS using a hardware modem in PDU mode and
+// returns the message reference of every segment. Unlike text mode this
+// sends accents, emoji and non-Latin scripts intact: the message is encoded
+// as GSM-7 when possible and as UCS-2 otherwise. Long messages are sent as
+// concatenated segments numbered with ref. With statusReport set every
+// segment requests a delivery report. If a segment fails after earlier ones
+// were accepted, the error wraps ErrPartiallySent and is permanent.
+func SendSMSviaHardwarePDU(conn *ATConn, recipient, message string, ref byte, statusReport bool) ([]int, error) {
+	if !ValidatePhone(recipient) {
+		return nil, retry.Permanent(fmt.Errorf("invalid phone number: %s", maskPhone(recipient)))
 	}
+	if strings.TrimSpace(message) == "" {
+		return nil, retry.Permanent(errors.New("message cannot be empty"))
+	}
+	pdus, err := EncodeSubmitPDUs(recipient, message, ref, statusReport)
+	if err != nil {
+		return nil, retry.Permanent(fmt.Errorf("failed to encode PDU: %w", err))
+	}
+
+	log.Printf("Sending SMS to %s in PDU mode (%d segment(s))", maskPhone(recipient), len(pdus))
 
-	// Read modem response
-	response := make([]byte, 1024)
-	n, _ := port.Read(response)
-	if !strings.Contains(string(response[:n]), "OK") {
-		return fmt.Errorf("failed to send SMS, modem response: %s", string(response[:n]))
+	// Set SMS to PDU mode
+	timeout, _ := conn.Timeouts()
+	if _, err := conn.Command("AT+CMGF=0", timeout); err != nil {
+		return nil, fmt.Errorf("failed to set PDU mode: %w", err)
 	}
 
-	return nil
+	refs := make([]int, 0, len(pdus))
+	for i, pdu := range pdus {
+		// AT+CMGS announces the TPDU length, without the SMSC octet
+		mr, err := submit(conn, fmt.Sprintf("AT+CMGS=%d", pdu.Length), pdu.Hex)
+		if err != nil {
+			if len(refs) > 0 {
+				// Sending the message again, through any modem or provider,
+				// would deliver the accepted segments twice
+				return refs, retry.Permanent(fmt.Errorf("%w: segment %d of %d: %w", ErrPartiallySent, i+1, len(pdus), err))
+			}
+			if len(pdus) > 1 {
+				return refs, fmt.Errorf("segment %d of %d: %w", i+1, len(pdus), err)
+			}
+			return refs, err
+		}
+		refs = append(refs, mr)
+	}
+	return refs, nil
+}
+
+// submit runs an AT+CMGS command and returns the message reference from
+// the modem's +CMGS response
+func submit(conn *ATConn, cmd, payload string) (int, error) {
+	_, timeout := conn.Timeouts()
+	lines, err := conn.CommandWithPrompt(cmd, payload, timeout)
+	if err != nil {
+		return 0, classifySubmitError(fmt.Errorf("failed to send SMS: %w", err))
+	}
+	mr, err := parseMessageReference(lines)
+	if err != nil {
+		// The modem answered OK, so the message was accepted
+		log.Printf("SMS sent but %v", err)
+		return -1, nil
+	}
+	return mr, nil
 }
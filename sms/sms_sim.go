@@ -0,0 +1,144 @@
+package sms
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// simReadyChecks and simReadyDelay bound the wait for the SIM to become
+	// ready after its PIN was entered
+	simReadyChecks = 20
+	simReadyDelay  = 500 * time.Millisecond
+
+	// cmeIncorrectPassword is the +CME ERROR code for a wrong PIN
+	cmeIncorrectPassword = 16
+)
+
+var (
+	// ErrSIMLocked means the SIM asks for a PIN and none is configured
+	ErrSIMLocked = errors.New("SIM is locked and no PIN is configured")
+	// ErrSIMPINRejected means the SIM did not accept the configured PIN.
+	// The PIN is not tried again, so the SIM is not blocked by retries.
+	ErrSIMPINRejected = errors.New("SIM rejected the PIN")
+	// ErrSIMBlocked means the SIM needs its PUK after too many wrong PINs
+	ErrSIMBlocked = errors.New("SIM is PUK-blocked")
+)
+
+// simUnusable reports whether err is a SIM problem that reconnecting will
+// not fix
+func simUnusable(err error) bool {
+	return errors.Is(err, ErrSIMLocked) || errors.Is(err, ErrSIMPINRejected) || errors.Is(err, ErrSIMBlocked)
+}
+
+// ModemProfile is the set-up run on a modem once its port is open. Empty
+// fields keep the settings of the modem and SIM.
+type ModemProfile struct {
+	PIN     string // SIM PIN, entered when the SIM asks for it
+	SMSC    string // Service centre number for AT+CSCA
+	Charset string // Character set for AT+CSCS, e.g. "GSM" or "IRA"
+	Storage string // Message storage for AT+CPMS, e.g. "SM" or "ME", or "SM,SM,ME"
+}
+
+// SetProfile configures the set-up that Init runs on the modem
+func (p *HardwareProvider) SetProfile(profile ModemProfile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.profile = profile
+}
+
+// profileCommands returns the commands that apply the profile
+func (p *HardwareProvider) profileCommands() []string {
+	var cmds []string
+	if smsc := p.profile.SMSC; smsc != "" {
+		toa := 129 // national or unknown number
+		if strings.HasPrefix(smsc, "+") {
+			toa = 145 // international number
+		}
+		cmds = append(cmds, fmt.Sprintf(`AT+CSCA="%s",%d`, smsc, toa))
+	}
+	if p.profile.Charset != "" {
+		cmds = append(cmds, fmt.Sprintf(`AT+CSCS="%s"`, p.profile.Charset))
+	}
+	if p.profile.Storage != "" {
+		mems := strings.Split(p.profile.Storage, ",")
+		if len(mems) == 1 {
+			mems = []string{mems[0], mems[0], mems[0]} // read, write and receive
+		}
+		for i, mem := range mems {
+			mems[i] = `"` + strings.TrimSpace(mem) + `"`
+		}
+		cmds = append(cmds, "AT+CPMS="+strings.Join(mems, ","))
+	}
+	return cmds
+}
+
+// unlockSIM checks the SIM with AT+CPIN? and enters the PIN if the SIM
+// asks for it. The caller holds p.mu.
+func (p *HardwareProvider) unlockSIM(timeout time.Duration) error {
+	state, err := p.simState(timeout)
+	if err != nil {
+		return err
+	}
+	switch state {
+	case "READY":
+		return nil
+	case "SIM PIN":
+		if p.profile.PIN == "" {
+			return ErrSIMLocked
+		}
+	case "SIM PUK":
+		return ErrSIMBlocked
+	default: // e.g. PH-SIM PIN, a modem locked to another network
+		return fmt.Errorf("%w: SIM asks for %s", ErrSIMLocked, state)
+	}
+
+	if _, err := p.conn.Command(fmt.Sprintf(`AT+CPIN="%s"`, p.profile.PIN), timeout); err != nil {
+		// Errors that name the command would put the PIN in the log
+		var cmeErr *CMEError
+		var atErr *ATError
+		switch {
+		case errors.As(err, &cmeErr) && cmeErr.Code == cmeIncorrectPassword, errors.As(err, &atErr):
+			return ErrSIMPINRejected
+		case errors.Is(err, ErrATTimeout):
+			return fmt.Errorf("failed to enter SIM PIN: %w", ErrATTimeout)
+		}
+		return fmt.Errorf("failed to enter SIM PIN: %w", err)
+	}
+
+	// The SIM takes a moment to become ready after the PIN
+	for i := 0; i < simReadyChecks; i++ {
+		state, err = p.simState(timeout)
+		switch {
+		case err != nil:
+		case state == "READY":
+			return nil
+		case state == "SIM PUK":
+			return ErrSIMBlocked
+		case state == "SIM PIN":
+			return ErrSIMPINRejected
+		}
+		time.Sleep(simReadyDelay)
+	}
+	return fmt.Errorf("SIM not ready after entering the PIN (%s)", state)
+}
+
+// simState returns the state reported by "+CPIN: <code>"
+func (p *HardwareProvider) simState(timeout time.Duration) (string, error) {
+	lines, err := p.conn.Command("AT+CPIN?", timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to query SIM state: %w", err)
+	}
+	for _, line := range lines {
+		if state, ok := strings.CutPrefix(line, "+CPIN:"); ok {
+			state = strings.Trim(strings.TrimSpace(state), `"`)
+			p.updateStatus(func(st *ModemStatus) {
+				st.SIM = state
+			})
+			return state, nil
+		}
+	}
+	return "", fmt.Errorf("failed to query SIM state: no +CPIN response")
+}
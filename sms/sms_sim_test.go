@@ -0,0 +1,94 @@
+package sms
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// lockedModem is a modem whose SIM asks for pin, or for its PUK if
+// blocked is set
+func lockedModem(pin string, blocked bool) *fakeModem {
+	unlocked := false
+	return newFakeModem(func(cmd string) string {
+		switch {
+		case cmd == "AT+CPIN?\r" && blocked:
+			return "\r\n+CPIN: SIM PUK\r\n\r\nOK\r\n"
+		case cmd == "AT+CPIN?\r" && unlocked:
+			return "\r\n+CPIN: READY\r\n\r\nOK\r\n"
+		case cmd == "AT+CPIN?\r":
+			return "\r\n+CPIN: SIM PIN\r\n\r\nOK\r\n"
+		case strings.HasPrefix(cmd, "AT+CPIN="):
+			if cmd != `AT+CPIN="`+pin+`"`+"\r" {
+				return "\r\n+CME ERROR: 16\r\n"
+			}
+			unlocked = true
+		}
+		return "\r\nOK\r\n"
+	})
+}
+
+// TestHardwareProviderInit tests SIM unlocking and the modem profile.
+func TestHardwareProviderInit(t *testing.T) {
+	modem := lockedModem("1234", false)
+	provider := NewHardwareProvider(modem, ModePDU)
+	provider.SetProfile(ModemProfile{PIN: "1234", SMSC: "+447785016005", Charset: "IRA", Storage: "ME"})
+	if err := provider.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	written := modem.Written()
+	for _, cmd := range []string{
+		`AT+CPIN="1234"`,
+		`AT+CSCA="+447785016005",145`,
+		`AT+CSCS="IRA"`,
+		`AT+CPMS="ME","ME","ME"`,
+		"AT+CMGF=0",
+	} {
+		if !strings.Contains(written, cmd+"\r") {
+			t.Errorf("Expected %s, got %q", cmd, written)
+		}
+	}
+	if sim := provider.Status().SIM; sim != "READY" {
+		t.Errorf("Expected SIM state READY, got %q", sim)
+	}
+}
+
+// TestHardwareProviderInitSIMErrors tests that unusable SIMs are reported.
+func TestHardwareProviderInitSIMErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		pin     string
+		blocked bool
+		want    error
+	}{
+		{"no PIN", "", false, ErrSIMLocked},
+		{"wrong PIN", "0000", false, ErrSIMPINRejected},
+		{"PUK-blocked", "1234", true, ErrSIMBlocked},
+	}
+	for _, tt := range tests {
+		provider := NewHardwareProvider(lockedModem("1234", tt.blocked), ModeText)
+		provider.SetProfile(ModemProfile{PIN: tt.pin})
+		if err := provider.Init(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+// TestModemSupervisorLockedSIM tests that a locked SIM fails startup.
+func TestModemSupervisorLockedSIM(t *testing.T) {
+	opens := 0
+	open := func() (io.ReadWriteCloser, error) {
+		opens++
+		return lockedModem("1234", false), nil
+	}
+	supervisor := NewModemSupervisor("/dev/ttyUSB0", open, NewHardwareProvider(nil, ModeText))
+	if err := supervisor.Start(); !errors.Is(err, ErrSIMLocked) {
+		t.Fatalf("Expected ErrSIMLocked, got %v", err)
+	}
+	supervisor.Stop()
+	if opens != 1 {
+		t.Errorf("Expected a single attempt, got %d", opens)
+	}
+}
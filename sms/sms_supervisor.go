@@ -0,0 +1,294 @@
+package sms
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"message_handler/retry"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPollFailures is the number of failed health polls after which a
+	// modem that stopped answering is reconnected
+	maxPollFailures = 3
+)
+
+// ModemStatus is the connection and network state of a modem
+type ModemStatus struct {
+	Device       string    `json:"device"`
+	Connected    bool      `json:"connected"`
+	SIM          string    `json:"sim,omitempty"` // SIM state from AT+CPIN?, e.g. "READY" or "SIM PIN"
+	Reconnects   int       `json:"reconnects"`
+	LastError    string    `json:"last_error,omitempty"`
+	SignalRSSI   int       `json:"signal_rssi"`          // 0-31, 99 if unknown
+	SignalDBm    int       `json:"signal_dbm,omitempty"` // derived from the RSSI
+	Registration string    `json:"registration"`         // network registration, e.g. "home" or "roaming"
+	Operator     string    `json:"operator,omitempty"`
+	LastPoll     time.Time `json:"last_poll,omitempty"`
+}
+
+// registrationStates names the <stat> values of +CREG
+var registrationStates = map[int]string{
+	0: "not registered",
+	1: "home",
+	2: "searching",
+	3: "denied",
+	4: "unknown",
+	5: "roaming",
+}
+
+// ModemSupervisor keeps a modem connected. It opens the serial port,
+// initialises the modem, and reopens the port with backoff whenever it
+// fails or the modem stops answering. While connected it polls the signal
+// quality, network registration and operator.
+type ModemSupervisor struct {
+	device   string
+	open     func() (io.ReadWriteCloser, error)
+	provider *HardwareProvider
+	port     io.ReadWriteCloser
+	backoff  retry.Policy
+	poll     time.Duration
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewModemSupervisor creates a supervisor for the modem behind provider,
+// using open to (re)open its serial port
+func NewModemSupervisor(device string, open func() (io.ReadWriteCloser, error), provider *HardwareProvider) *ModemSupervisor {
+	provider.updateStatus(func(s *ModemStatus) {
+		s.Device = device
+		s.SignalRSSI = 99
+		s.Registration = "unknown"
+	})
+	return &ModemSupervisor{
+		device:   device,
+		open:     open,
+		provider: provider,
+		backoff:  retry.Policy{BaseDelay: time.Second, MaxDelay: time.Minute, Jitter: 0.2},
+		poll:     30 * time.Second,
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// SetPollInterval configures how often the modem's health is checked
+func (s *ModemSupervisor) SetPollInterval(interval time.Duration) {
+	s.poll = interval
+}
+
+// SetMaxBackoff configures the longest wait between reconnection attempts
+func (s *ModemSupervisor) SetMaxBackoff(delay time.Duration) {
+	s.backoff.MaxDelay = delay
+}
+
+// Start connects the modem and keeps it connected. The first attempt is
+// made before Start returns, so a modem that is present is usable right
+// away. A SIM that is locked, rejects its PIN or is PUK-blocked is not
+// retried: Start returns the error and does not supervise the modem.
+func (s *ModemSupervisor) Start() error {
+	if err := s.connect(); err != nil {
+		if simUnusable(err) {
+			return err
+		}
+		log.Printf("Modem %s: %v", s.device, err)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run()
+	}()
+	return nil
+}
+
+// Stop stops supervising and closes the serial port
+func (s *ModemSupervisor) Stop() {
+	close(s.stopCh)
+	s.wg.Wait()
+	if s.port != nil {
+		s.port.Close()
+	}
+}
+
+func (s *ModemSupervisor) run() {
+	attempts := 0
+	for {
+		if s.port == nil {
+			attempts++
+			delay := s.backoff.Delay(attempts)
+			select {
+			case <-time.After(delay):
+			case <-s.stopCh:
+				return
+			}
+			if err := s.connect(); err != nil {
+				if simUnusable(err) {
+					log.Printf("Modem %s: %v, no longer reconnecting", s.device, err)
+					return
+				}
+				log.Printf("Modem %s: %v (reconnect attempt %d)", s.device, err, attempts)
+				continue
+			}
+			attempts = 0
+		}
+		s.supervise()
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+	}
+}
+
+// connect opens the port and initialises the modem
+func (s *ModemSupervisor) connect() error {
+	port, err := s.open()
+	if err != nil {
+		s.recordError(err)
+		return fmt.Errorf("failed to open serial port: %w", err)
+	}
+	s.provider.Conn().Reset(port)
+	if err := s.provider.Init(); err != nil {
+		port.Close()
+		s.recordError(err)
+		return err
+	}
+
+	s.port = port
+	s.provider.updateStatus(func(st *ModemStatus) {
+		st.LastError = ""
+	})
+	log.Printf("Modem %s connected", s.device)
+	s.pollHealth()
+	return nil
+}
+
+// supervise polls the connected modem until its port fails, it stops
+// answering or the supervisor is stopped. It closes the port in the first
+// two cases.
+func (s *ModemSupervisor) supervise() {
+	ticker := time.NewTicker(s.poll)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-s.provider.Conn().Done():
+			s.disconnect("serial port failed")
+			return
+		case <-ticker.C:
+			if err := s.pollHealth(); err != nil {
+				failures++
+				if failures >= maxPollFailures {
+					s.disconnect(fmt.Sprintf("no answer to %d health checks: %v", failures, err))
+					return
+				}
+				continue
+			}
+			failures = 0
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// disconnect closes a failed port so that run reconnects
+func (s *ModemSupervisor) disconnect(reason string) {
+	log.Printf("Modem %s disconnected: %s, reconnecting", s.device, reason)
+	s.port.Close()
+	s.port = nil
+	s.provider.updateStatus(func(st *ModemStatus) {
+		st.Reconnects++
+		st.LastError = reason
+		st.SignalRSSI = 99
+		st.SignalDBm = 0
+		st.Registration = "unknown"
+		st.Operator = ""
+	})
+}
+
+func (s *ModemSupervisor) recordError(err error) {
+	s.provider.updateStatus(func(st *ModemStatus) {
+		st.LastError = err.Error()
+	})
+}
+
+// pollHealth queries signal quality, network registration and operator
+func (s *ModemSupervisor) pollHealth() error {
+	conn := s.provider.Conn()
+	timeout, _ := conn.Timeouts()
+
+	lines, err := conn.Command("AT+CSQ", timeout)
+	if err != nil {
+		s.recordError(err)
+		return err
+	}
+	rssi := parseSignalQuality(lines)
+
+	registration := "unknown"
+	if lines, err := conn.Command("AT+CREG?", timeout); err == nil {
+		registration = parseRegistration(lines)
+	}
+	operator := ""
+	if lines, err := conn.Command("AT+COPS?", timeout); err == nil {
+		operator = parseOperator(lines)
+	}
+
+	s.provider.updateStatus(func(st *ModemStatus) {
+		st.SignalRSSI = rssi
+		st.SignalDBm = 0
+		if rssi >= 0 && rssi <= 31 {
+			st.SignalDBm = -113 + 2*rssi
+		}
+		st.Registration = registration
+		st.Operator = operator
+		st.LastPoll = time.Now().UTC()
+	})
+	return nil
+}
+
+// parseSignalQuality returns the RSSI from "+CSQ: <rssi>,<ber>", or 99
+func parseSignalQuality(lines []string) int {
+	for _, line := range lines {
+		if params, ok := strings.CutPrefix(line, "+CSQ:"); ok {
+			fields := splitParams(params)
+			if rssi, err := strconv.Atoi(fields[0]); err == nil {
+				return rssi
+			}
+		}
+	}
+	return 99
+}
+
+// parseRegistration names the state from "+CREG: <n>,<stat>[,...]"
+func parseRegistration(lines []string) string {
+	for _, line := range lines {
+		if params, ok := strings.CutPrefix(line, "+CREG:"); ok {
+			fields := splitParams(params)
+			if len(fields) < 2 {
+				continue
+			}
+			if stat, err := strconv.Atoi(fields[1]); err == nil {
+				if name, ok := registrationStates[stat]; ok {
+					return name
+				}
+			}
+		}
+	}
+	return "unknown"
+}
+
+// parseOperator returns the operator from "+COPS: <mode>,<format>,<oper>"
+func parseOperator(lines []string) string {
+	for _, line := range lines {
+		if params, ok := strings.CutPrefix(line, "+COPS:"); ok {
+			if fields := splitParams(params); len(fields) >= 3 {
+				return fields[2]
+			}
+		}
+	}
+	return ""
+}
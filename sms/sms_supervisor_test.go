@@ -0,0 +1,103 @@
+package sms
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// healthyModem answers the health checks of the supervisor
+func healthyModem(cmd string) string {
+	switch cmd {
+	case "AT+CPIN?\r":
+		return "\r\n+CPIN: READY\r\n\r\nOK\r\n"
+	case "AT+CSQ\r":
+		return "\r\n+CSQ: 20,99\r\n\r\nOK\r\n"
+	case "AT+CREG?\r":
+		return "\r\n+CREG: 0,5\r\n\r\nOK\r\n"
+	case "AT+COPS?\r":
+		return "\r\n+COPS: 0,0,\"Example Mobile\",7\r\n\r\nOK\r\n"
+	}
+	return "\r\nOK\r\n"
+}
+
+// TestModemSupervisorReconnect tests that a failed port is reopened and
+// the modem initialised again.
+func TestModemSupervisorReconnect(t *testing.T) {
+	var mu sync.Mutex
+	var modems []*fakeModem
+	opens := 0
+	open := func() (io.ReadWriteCloser, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		opens++
+		if opens == 2 {
+			return nil, errors.New("no such device") // still unplugged
+		}
+		modem := newFakeModem(healthyModem)
+		modems = append(modems, modem)
+		return modem, nil
+	}
+
+	provider := NewHardwareProvider(nil, ModePDU)
+	supervisor := NewModemSupervisor("/dev/ttyUSB0", open, provider)
+	supervisor.SetMaxBackoff(10 * time.Millisecond)
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	status := provider.Status()
+	if !status.Connected || status.SignalRSSI != 20 || status.SignalDBm != -73 ||
+		status.Registration != "roaming" || status.Operator != "Example Mobile" {
+		t.Fatalf("Unexpected status after connecting: %+v", status)
+	}
+	mu.Lock()
+	first := modems[0]
+	mu.Unlock()
+	if written := first.Written(); !strings.Contains(written, "ATE0\r") || !strings.Contains(written, "AT+CMGF=0\r") {
+		t.Errorf("Modem was not initialised, got %q", written)
+	}
+
+	first.Close() // unplugged
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		reopened := len(modems) == 2
+		mu.Unlock()
+		if reopened && provider.Connected() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Modem was not reconnected, status %+v", provider.Status())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err := provider.Conn().Command("AT", time.Second); err != nil {
+		t.Errorf("Command after reconnect failed: %v", err)
+	}
+	if status := provider.Status(); status.Reconnects != 1 || status.Device != "/dev/ttyUSB0" {
+		t.Errorf("Unexpected status after reconnecting: %+v", status)
+	}
+}
+
+// TestParseModemHealth tests parsing of the health check responses.
+func TestParseModemHealth(t *testing.T) {
+	if rssi := parseSignalQuality([]string{"+CSQ: 31,0"}); rssi != 31 {
+		t.Errorf("parseSignalQuality = %d, want 31", rssi)
+	}
+	if rssi := parseSignalQuality(nil); rssi != 99 {
+		t.Errorf("parseSignalQuality without a response = %d, want 99", rssi)
+	}
+	if reg := parseRegistration([]string{"+CREG: 2,1,\"00C3\",\"1A2B\""}); reg != "home" {
+		t.Errorf("parseRegistration = %q, want home", reg)
+	}
+	if reg := parseRegistration([]string{"+CREG: 0,3"}); reg != "denied" {
+		t.Errorf("parseRegistration = %q, want denied", reg)
+	}
+	if op := parseOperator([]string{"+COPS: 0"}); op != "" {
+		t.Errorf("parseOperator without an operator = %q", op)
+	}
+}
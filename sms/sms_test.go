@@ -1,97 +1,129 @@
 package sms
 
 import (
-	"bytes"
+	"errors"
+	"message_handler/retry"
+	"message_handler/status"
 	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
-// MockPort simulates a serial port for testing purposes.
-type MockPort struct {
-	WriteBuffer bytes.Buffer
-	ReadBuffer  bytes.Buffer
-}
-
-// Write writes data to the mock port's write buffer.
-func (m *MockPort) Write(p []byte) (int, error) {
-	return m.WriteBuffer.Write(p)
-}
-
-// Read reads data from the mock port's read buffer.
-func (m *MockPort) Read(p []byte) (int, error) {
-	return m.ReadBuffer.Read(p)
-}
-
-// Close simulates closing the mock port.
-func (m *MockPort) Close() error {
-	return nil
-}
-
-// TestSendSMS tests the SendSMS function.
+// TestSendSMS tests sending in text mode against a scripted modem.
 func TestSendSMS(t *testing.T) {
 	err := godotenv.Load("../settings.env")
 	if err != nil {
 		t.Fatalf("Failed to load environment variables: %v", err)
 	}
 
-	mockPort := &MockPort{}
-
 	tests := []struct {
-		name          string
-		recipient     string
-		message       string
-		mockResponse  string
-		expectError   bool
-		expectedWrite string
+		name            string
+		recipient       string
+		message         string
+		mockResponse    string
+		expectError     bool
+		expectPermanent bool
+		expectTimeout   bool
+		expectedRef     int
+		expectedWrite   string
 	}{
 		{
 			name:          "ValidSMS",
 			recipient:     "+1234567890",
 			message:       "Hello, this is a test message",
-			mockResponse:  "OK",
-			expectError:   false,
+			mockResponse:  "\r\n+CMGS: 42\r\n\r\nOK\r\n",
+			expectedRef:   42,
 			expectedWrite: "AT+CMGF=1\rAT+CMGS=\"+1234567890\"\rHello, this is a test message\x1A",
 		},
+		{
+			name:         "InterleavedURC",
+			recipient:    "+1234567890",
+			message:      "Test interleaved URC",
+			mockResponse: "\r\n+CMTI: \"SM\",1\r\n+CMGS: 7\r\n\r\nOK\r\n",
+			expectedRef:  7,
+		},
 		{
 			name:         "ModemErrorResponse",
 			recipient:    "+1234567890",
 			message:      "Test error response",
-			mockResponse: "ERROR",
+			mockResponse: "\r\nERROR\r\n",
+			expectError:  true,
+		},
+		{
+			name:            "PermanentCMSError",
+			recipient:       "+1234567890",
+			message:         "Test unassigned number",
+			mockResponse:    "\r\n+CMS ERROR: 1\r\n",
+			expectError:     true,
+			expectPermanent: true,
+		},
+		{
+			name:         "InvalidParameterCMSError",
+			recipient:    "+1234567890",
+			message:      "Test invalid parameter",
+			mockResponse: "\r\n+CMS ERROR: 305\r\n",
 			expectError:  true,
 		},
 		{
-			name:        "EmptyMessage",
-			recipient:   "+1234567890",
-			message:     "",
-			expectError: true,
+			name:         "TemporaryCMSError",
+			recipient:    "+1234567890",
+			message:      "Test no network",
+			mockResponse: "\r\n+CMS ERROR: 331\r\n",
+			expectError:  true,
+		},
+		{
+			name:          "NoModemResponse",
+			recipient:     "+1234567890",
+			message:       "Test missing response",
+			expectError:   true,
+			expectTimeout: true,
 		},
 		{
-			name:        "InvalidRecipient",
-			recipient:   "INVALID",
-			message:     "Test message",
-			expectError: true,
+			name:            "EmptyMessage",
+			recipient:       "+1234567890",
+			message:         "",
+			expectError:     true,
+			expectPermanent: true,
+		},
+		{
+			name:            "InvalidRecipient",
+			recipient:       "INVALID",
+			message:         "Test message",
+			expectError:     true,
+			expectPermanent: true,
 		},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			mockPort.ReadBuffer.Reset()
-			mockPort.ReadBuffer.WriteString(tc.mockResponse)
+			modem := newFakeModem(smsModem(tc.mockResponse))
+			defer modem.Close()
+			conn := NewATConn(modem)
+			conn.SetTimeouts(100*time.Millisecond, 100*time.Millisecond)
 
-			mockPort.WriteBuffer.Reset()
-
-			err := SendSMS(mockPort, tc.recipient, tc.message)
+			refs, err := SendSMSviaHardware(conn, tc.recipient, tc.message, false)
 			if tc.expectError && err == nil {
 				t.Errorf("Expected error but got none")
 			} else if !tc.expectError && err != nil {
 				t.Errorf("Did not expect error but got one: %v", err)
 			}
+			if err != nil && retry.IsPermanent(err) != tc.expectPermanent {
+				t.Errorf("Expected permanent error to be %v, got %v", tc.expectPermanent, retry.IsPermanent(err))
+			}
+			if err != nil && errors.Is(err, ErrATTimeout) != tc.expectTimeout {
+				t.Errorf("Expected timeout to be %v, got %v", tc.expectTimeout, err)
+			}
+			if err == nil && (len(refs) != 1 || refs[0] != tc.expectedRef) {
+				t.Errorf("Expected message reference %d, got %v", tc.expectedRef, refs)
+			}
 
-			if tc.expectedWrite != "" && mockPort.WriteBuffer.String() != tc.expectedWrite {
-				t.Errorf("Unexpected commands sent to port. Got: %q, want: %q", mockPort.WriteBuffer.String(), tc.expectedWrite)
+			if tc.expectedWrite != "" && modem.Written() != tc.expectedWrite {
+				t.Errorf("Unexpected commands sent to port. Got: %q, want: %q", modem.Written(), tc.expectedWrite)
 			}
 		})
 	}
@@ -133,10 +165,11 @@ func TestQueueSMS(t *testing.T) {
 	}
 
 	smsQueue := NewSMSQueue(maxQueueSize)
-	smsQueue.SetSender(func(sms *SMS) {
+	smsQueue.SetProviders(NewFuncProvider("hardware", Capabilities{}, func(sms *SMS) error {
 		// mock SMS send it to avoid actual work or sleeping in tests
 		t.Logf("Mock send to %s: %s", sms.Recipient, sms.Message)
-	})
+		return nil
+	}))
 	smsQueue.Start()
 	defer smsQueue.Stop()
 
@@ -172,3 +205,410 @@ func TestQueueSMS(t *testing.T) {
 		})
 	}
 }
+
+// TestJournalReplay tests that unsent messages survive reopening the journal.
+func TestJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	journal, err := OpenJournal(dir)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	sent := &SMS{ID: "sent", Recipient: "+1234567890", Message: "first"}
+	unsent := &SMS{ID: "unsent", Recipient: "+1234567890", Message: "second"}
+	for _, sms := range []*SMS{sent, unsent} {
+		if err := journal.Append(sms); err != nil {
+			t.Fatalf("Failed to append to journal: %v", err)
+		}
+	}
+	if err := journal.MarkDone(sent.ID); err != nil {
+		t.Fatalf("Failed to mark message done: %v", err)
+	}
+	journal.Close()
+
+	journal, err = OpenJournal(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen journal: %v", err)
+	}
+	defer journal.Close()
+
+	replay := journal.Replay()
+	if len(replay) != 1 || replay[0].ID != unsent.ID || replay[0].Message != unsent.Message {
+		t.Fatalf("Expected only the unsent message to be replayed, got %+v", replay)
+	}
+	if again := journal.Replay(); len(again) != 0 {
+		t.Errorf("Expected Replay to return messages only once, got %d", len(again))
+	}
+}
+
+// TestQueueJournal tests that the queue replays journaled messages that were
+// waiting for a retry and only marks them done once the sender succeeds.
+func TestQueueJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	journal, err := OpenJournal(dir)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	queue := NewSMSQueue(10)
+	queue.SetJournal(journal)
+	// The retry is still pending when the queue stops
+	queue.SetRetryPolicy(retry.Policy{MaxAttempts: 2, BaseDelay: time.Hour})
+	failed := make(chan struct{})
+	queue.SetProviders(NewFuncProvider("hardware", Capabilities{}, func(sms *SMS) error {
+		defer close(failed)
+		return errors.New("modem unavailable")
+	}))
+	queue.Start()
+	if err := queue.Send(&SMS{Recipient: "+1234567890", Message: "Hello!"}); err != nil {
+		t.Fatalf("Failed to queue SMS: %v", err)
+	}
+	<-failed
+	queue.Stop()
+	journal.Close()
+
+	journal, err = OpenJournal(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen journal: %v", err)
+	}
+	tracker := status.NewStore(10)
+	queue = NewSMSQueue(10)
+	queue.SetJournal(journal)
+	queue.SetStatusStore(tracker)
+	delivered := make(chan *SMS, 1)
+	queue.SetProviders(NewFuncProvider("hardware", Capabilities{}, func(sms *SMS) error {
+		delivered <- sms
+		return nil
+	}))
+	queue.Start()
+	sms := <-delivered
+	if sms.Message != "Hello!" {
+		t.Errorf("Expected replayed message %q, got %q", "Hello!", sms.Message)
+	}
+	queue.Stop()
+	journal.Close()
+	if record, _ := tracker.Get(sms.ID); record.State != status.Sent || record.Segments != 1 {
+		t.Errorf("Expected the replayed message to be tracked with its segments, got %+v", record)
+	}
+
+	journal, err = OpenJournal(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen journal: %v", err)
+	}
+	defer journal.Close()
+	if replay := journal.Replay(); len(replay) != 0 {
+		t.Errorf("Expected no pending messages after delivery, got %d", len(replay))
+	}
+}
+
+// TestQueueDeadLetters tests retries, dead-lettering and requeueing.
+func TestQueueDeadLetters(t *testing.T) {
+	dir := t.TempDir()
+
+	journal, err := OpenJournal(dir)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	queue := NewSMSQueue(10)
+	queue.SetJournal(journal)
+	queue.SetRetryPolicy(retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	attempts := make(chan struct{}, 10)
+	queue.SetProviders(NewFuncProvider("hardware", Capabilities{}, func(sms *SMS) error {
+		attempts <- struct{}{}
+		return errors.New("modem unavailable")
+	}))
+	queue.Start()
+	if err := queue.Send(&SMS{ID: "msg-1", Recipient: "+1234567890", Message: "Hello!"}); err != nil {
+		t.Fatalf("Failed to queue SMS: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		<-attempts
+	}
+	queue.Stop()
+	journal.Close()
+
+	letters := queue.DeadLetters()
+	if len(letters) != 1 || letters[0].SMS.ID != "msg-1" || letters[0].SMS.Attempts != 3 {
+		t.Fatalf("Expected msg-1 as dead letter after 3 attempts, got %+v", letters)
+	}
+
+	// Dead letters survive a restart and can be requeued
+	journal, err = OpenJournal(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen journal: %v", err)
+	}
+	defer journal.Close()
+	queue = NewSMSQueue(10)
+	queue.SetJournal(journal)
+	delivered := make(chan *SMS, 1)
+	queue.SetProviders(NewFuncProvider("hardware", Capabilities{}, func(sms *SMS) error {
+		delivered <- sms
+		return nil
+	}))
+	queue.Start()
+	defer queue.Stop()
+
+	if len(queue.DeadLetters()) != 1 {
+		t.Fatalf("Expected dead letter to be loaded from the journal")
+	}
+	if err := queue.Requeue("unknown"); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("Expected ErrDeadLetterNotFound, got %v", err)
+	}
+	if err := queue.Requeue("msg-1"); err != nil {
+		t.Fatalf("Failed to requeue dead letter: %v", err)
+	}
+	if sms := <-delivered; sms.ID != "msg-1" {
+		t.Errorf("Expected requeued message msg-1, got %s", sms.ID)
+	}
+	if len(queue.DeadLetters()) != 0 {
+		t.Errorf("Expected no dead letters after requeue")
+	}
+}
+
+// TestQueuePermanentError tests that permanent errors skip the retries.
+func TestQueuePermanentError(t *testing.T) {
+	tracker := status.NewStore(10)
+	queue := NewSMSQueue(10)
+	queue.SetStatusStore(tracker)
+	queue.SetRetryPolicy(retry.Policy{MaxAttempts: 5, BaseDelay: time.Millisecond})
+	attempts := make(chan struct{}, 10)
+	queue.SetProviders(NewFuncProvider("hardware", Capabilities{}, func(sms *SMS) error {
+		attempts <- struct{}{}
+		return retry.Permanent(errors.New("invalid number"))
+	}))
+	queue.Start()
+	msg := &SMS{Recipient: "+1234567890", Message: "Hello!"}
+	if err := queue.Send(msg); err != nil {
+		t.Fatalf("Failed to queue SMS: %v", err)
+	}
+	<-attempts
+	queue.Stop()
+
+	if record, ok := tracker.Get(msg.ID); !ok || record.State != status.Failed || record.Error != "invalid number" {
+		t.Errorf("Expected message to be tracked as failed, got %+v", record)
+	}
+	if len(attempts) != 0 {
+		t.Errorf("Expected a single attempt for a permanent error")
+	}
+	if letters := queue.DeadLetters(); len(letters) != 1 {
+		t.Errorf("Expected 1 dead letter, got %d", len(letters))
+	}
+}
+
+// TestQueueModemSetupError tests that a plain ERROR while preparing the
+// modem is retried instead of failing the message.
+func TestQueueModemSetupError(t *testing.T) {
+	var failed atomic.Bool
+	delivered := make(chan struct{}, 1)
+	modem := newFakeModem(func(cmd string) string {
+		switch {
+		case cmd == "AT+CMGF=1\r" && failed.CompareAndSwap(false, true):
+			return "\r\nERROR\r\n"
+		case strings.HasPrefix(cmd, "AT+CMGS="):
+			return "\r\n> "
+		case strings.HasSuffix(cmd, "\x1a"):
+			delivered <- struct{}{}
+			return "\r\n+CMGS: 3\r\n\r\nOK\r\n"
+		}
+		return "\r\nOK\r\n"
+	})
+	defer modem.Close()
+
+	tracker := status.NewStore(10)
+	queue := NewSMSQueue(10)
+	queue.SetStatusStore(tracker)
+	queue.SetRetryPolicy(retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	queue.SetProviders(NewHardwareProvider(modem, ModeText))
+	queue.Start()
+	msg := &SMS{Recipient: "+1234567890", Message: "Hello!"}
+	if err := queue.Send(msg); err != nil {
+		t.Fatalf("Failed to queue SMS: %v", err)
+	}
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the message to be delivered after the failed AT+CMGF")
+	}
+	queue.Stop()
+
+	if record, _ := tracker.Get(msg.ID); record.State != status.Sent {
+		t.Errorf("Expected message to be tracked as sent, got %+v", record)
+	}
+	if letters := queue.DeadLetters(); len(letters) != 0 {
+		t.Errorf("Expected no dead letters, got %d", len(letters))
+	}
+}
+
+// TestQueuePartiallySent tests that a concatenated message whose second
+// segment fails is neither resent nor handed to the next provider.
+func TestQueuePartiallySent(t *testing.T) {
+	var segments atomic.Int32
+	modem := newFakeModem(func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "AT+CMGS="):
+			return "\r\n> "
+		case strings.HasSuffix(cmd, "\x1a"):
+			if segments.Add(1) == 2 {
+				return "\r\n+CMS ERROR: 331\r\n" // no network service
+			}
+			return "\r\n+CMGS: 1\r\n\r\nOK\r\n"
+		}
+		return "\r\nOK\r\n"
+	})
+	defer modem.Close()
+
+	tracker := status.NewStore(10)
+	queue := NewSMSQueue(10)
+	queue.SetStatusStore(tracker)
+	queue.SetRetryPolicy(retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	fallbackCalls := 0
+	fallback := NewFuncProvider("twilio", Capabilities{Multipart: true}, func(sms *SMS) error {
+		fallbackCalls++
+		return nil
+	})
+	queue.SetProviders(NewHardwareProvider(modem, ModePDU), fallback)
+	queue.Start()
+	msg := &SMS{Recipient: "+1234567890", Message: strings.Repeat("a", 400)}
+	if err := queue.Send(msg); err != nil {
+		t.Fatalf("Failed to queue SMS: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(queue.DeadLetters()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	queue.Stop()
+
+	if n := segments.Load(); n != 2 {
+		t.Errorf("Expected 2 segments submitted, got %d", n)
+	}
+	if fallbackCalls != 0 {
+		t.Errorf("Expected no failover after a segment was accepted, got %d calls", fallbackCalls)
+	}
+	if record, _ := tracker.Get(msg.ID); record.State != status.Failed {
+		t.Errorf("Expected message to be tracked as failed, got %+v", record)
+	}
+	if letters := queue.DeadLetters(); len(letters) != 1 {
+		t.Errorf("Expected 1 dead letter, got %d", len(letters))
+	}
+}
+
+// TestQueueFull tests that Send reports a full queue instead of blocking.
+func TestQueueFull(t *testing.T) {
+	queue := NewSMSQueue(1)
+	if err := queue.Send(&SMS{Recipient: "+1234567890", Message: "first"}); err != nil {
+		t.Fatalf("Failed to queue SMS: %v", err)
+	}
+	if err := queue.Send(&SMS{Recipient: "+1234567890", Message: "second"}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+}
+
+// TestJournalCompaction tests that the journal is compacted at runtime while
+// dead letters are still live.
+func TestJournalCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	journal, err := OpenJournal(dir)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+
+	dead := DeadLetter{SMS: &SMS{ID: "dead", Recipient: "+1234567890", Message: "failed"}, Error: "modem error"}
+	if err := journal.MarkDead(dead); err != nil {
+		t.Fatalf("Failed to journal dead letter: %v", err)
+	}
+	for i := 0; i < journalCompactThreshold; i++ {
+		sms := &SMS{ID: strconv.Itoa(i), Recipient: "+1234567890", Message: "Hello!"}
+		if err := journal.Append(sms); err != nil {
+			t.Fatalf("Failed to append to journal: %v", err)
+		}
+		if err := journal.MarkDone(sms.ID); err != nil {
+			t.Fatalf("Failed to mark message done: %v", err)
+		}
+	}
+	if journal.entries >= journalCompactThreshold {
+		t.Errorf("Expected journal to be compacted, it has %d entries", journal.entries)
+	}
+
+	journal.Close()
+	journal, err = OpenJournal(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen journal: %v", err)
+	}
+	defer journal.Close()
+	if letters := journal.DeadLetters(); len(letters) != 1 || letters[0].SMS.ID != "dead" {
+		t.Errorf("Expected dead letter to survive compaction, got %+v", letters)
+	}
+}
+
+// TestQueueFailover tests that a failing provider falls through to the next
+// one and is skipped once its circuit opens.
+func TestQueueFailover(t *testing.T) {
+	tracker := status.NewStore(10)
+	queue := NewSMSQueue(10)
+	queue.SetStatusStore(tracker)
+	queue.SetCircuitBreaker(2, time.Hour)
+
+	twilioCalls := 0
+	twilio := NewFuncProvider("twilio", Capabilities{}, func(sms *SMS) error {
+		twilioCalls++
+		return errors.New("twilio unavailable")
+	})
+	delivered := make(chan *SMS, 3)
+	hardware := NewFuncProvider("hardware", Capabilities{}, func(sms *SMS) error {
+		delivered <- sms
+		return nil
+	})
+	queue.SetProviders(twilio, hardware)
+	queue.Start()
+
+	var sent []*SMS
+	for i := 0; i < 3; i++ {
+		msg := &SMS{Recipient: "+1234567890", Message: "Hello!"}
+		if err := queue.Send(msg); err != nil {
+			t.Fatalf("Failed to queue SMS: %v", err)
+		}
+		sent = append(sent, msg)
+		<-delivered
+	}
+	queue.Stop()
+
+	if twilioCalls != 2 {
+		t.Errorf("Expected twilio to be skipped after 2 failures, got %d calls", twilioCalls)
+	}
+	for _, msg := range sent {
+		if record, _ := tracker.Get(msg.ID); record.Provider != "hardware" || record.State != status.Sent {
+			t.Errorf("Expected message sent via hardware, got %+v", record)
+		}
+	}
+	health := queue.ProviderHealth()
+	if len(health) != 2 || health[0].Circuit != CircuitOpen || health[1].Sent != 3 {
+		t.Errorf("Unexpected provider health: %+v", health)
+	}
+}
+
+// TestRegistry tests registering and looking up providers by name.
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	send := func(sms *SMS) error { return nil }
+	if err := registry.Register(NewFuncProvider("twilio", Capabilities{}, send)); err != nil {
+		t.Fatalf("Failed to register provider: %v", err)
+	}
+	if err := registry.Register(NewFuncProvider("custom", Capabilities{Unicode: true}, send)); err != nil {
+		t.Fatalf("Failed to register provider: %v", err)
+	}
+	if err := registry.Register(NewFuncProvider("custom", Capabilities{}, send)); err == nil {
+		t.Error("Expected an error registering a duplicate provider name")
+	}
+
+	provider, ok := registry.Get("custom")
+	if !ok || !provider.Capabilities().Unicode {
+		t.Errorf("Expected to find the custom provider, got %v", provider)
+	}
+	if _, ok := registry.Get("hardware"); ok {
+		t.Error("Did not expect an unregistered provider to be found")
+	}
+	if names := registry.Names(); len(names) != 2 || names[0] != "custom" || names[1] != "twilio" {
+		t.Errorf("Unexpected provider names: %v", names)
+	}
+}
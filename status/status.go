@@ -0,0 +1,181 @@
+package status
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// State is a step in the lifecycle of a message
+type State string
+
+const (
+	Scheduled   State = "scheduled" // Waiting for its send_at time
+	Queued      State = "queued"
+	Sending     State = "sending"
+	Sent        State = "sent"
+	Failed      State = "failed"
+	Delivered   State = "delivered"
+	Expired     State = "expired"     // Not delivered within the validity period
+	Undelivered State = "undelivered" // Sent, but the carrier could not deliver it
+	Canceled    State = "canceled"    // A scheduled message that was canceled before it was sent
+)
+
+// progress orders the states of a message, so that late or out-of-order
+// updates can be told apart from real progress
+func (s State) progress() int {
+	switch s {
+	case Scheduled, Queued:
+		return 0
+	case Sending:
+		return 1
+	case Sent:
+		return 2
+	default: // final outcomes
+		return 3
+	}
+}
+
+// Message kinds
+const (
+	KindSMS   = "sms"
+	KindEmail = "email"
+)
+
+// Record is the tracked status of a single message
+type Record struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	State     State     `json:"state"`
+	Provider  string    `json:"provider,omitempty"`
+	Segments  int       `json:"segments,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Store keeps the status of recent messages in memory. Once it holds more
+// than its maximum number of records the oldest ones are forgotten.
+type Store struct {
+	mu      sync.Mutex
+	records map[string]*Record
+	order   []string
+	max     int
+}
+
+// NewStore creates a store that remembers up to maxRecords messages
+func NewStore(maxRecords int) *Store {
+	return &Store{
+		records: make(map[string]*Record),
+		max:     maxRecords,
+	}
+}
+
+// Set records the current state of a message, creating the record if the
+// message is not tracked yet. err, if not nil, is kept as the last error.
+// A final state from a delivery report or callback that arrived before the
+// sender reported the message as sent is not overwritten by Sent.
+func (s *Store) Set(id, kind string, state State, err error) {
+	s.update(id, kind, func(record *Record) {
+		if state == Sent && record.State != "" && record.State.progress() > Sent.progress() {
+			return
+		}
+		record.State = state
+		record.Error = ""
+		if err != nil {
+			record.Error = err.Error()
+		}
+	})
+}
+
+// Advance records the state of a message like Set, unless the message is
+// already further along. It is meant for provider callbacks, which can
+// arrive out of order. It reports whether the state was recorded.
+func (s *Store) Advance(id, kind string, state State, err error) bool {
+	advanced := false
+	s.update(id, kind, func(record *Record) {
+		if record.State != "" && state.progress() < record.State.progress() {
+			return
+		}
+		advanced = true
+		record.State = state
+		record.Error = ""
+		if err != nil {
+			record.Error = err.Error()
+		}
+	})
+	return advanced
+}
+
+// SetProvider records which provider sent a message
+func (s *Store) SetProvider(id, provider string) {
+	s.update(id, "", func(record *Record) {
+		record.Provider = provider
+	})
+}
+
+// SetSegments records how many SMS segments a message is sent as
+func (s *Store) SetSegments(id string, segments int) {
+	s.update(id, "", func(record *Record) {
+		record.Segments = segments
+	})
+}
+
+// update applies fn to the record of a message, creating it if needed
+func (s *Store) update(id, kind string, fn func(*Record)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	record, exists := s.records[id]
+	if !exists {
+		record = &Record{ID: id, Kind: kind, CreatedAt: now}
+		s.records[id] = record
+		s.order = append(s.order, id)
+		for s.max > 0 && len(s.order) > s.max {
+			delete(s.records, s.order[0])
+			s.order = s.order[1:]
+		}
+	}
+	fn(record)
+	record.UpdatedAt = now
+}
+
+// Get returns a copy of the record for id
+func (s *Store) Get(id string) (Record, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, exists := s.records[id]
+	if !exists {
+		return Record{}, false
+	}
+	return *record, true
+}
+
+// HandleGetMessage writes the status of the message named in the path as JSON
+func HandleGetMessage(w http.ResponseWriter, r *http.Request, store *Store) {
+	record, ok := store.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(record); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// NewID returns a random 128-bit hex message identifier
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,104 @@
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStoreLifecycle(t *testing.T) {
+	store := NewStore(10)
+	store.Set("msg-1", KindSMS, Queued, nil)
+	store.Set("msg-1", KindSMS, Failed, errors.New("modem unavailable"))
+
+	record, ok := store.Get("msg-1")
+	if !ok {
+		t.Fatal("Expected msg-1 to be tracked")
+	}
+	if record.State != Failed || record.Error != "modem unavailable" || record.Kind != KindSMS {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+
+	store.Set("msg-1", KindSMS, Queued, nil) // requeued
+	store.Set("msg-1", KindSMS, Sent, nil)
+	if record, _ := store.Get("msg-1"); record.State != Sent || record.Error != "" {
+		t.Errorf("Expected error to be cleared once sent, got %+v", record)
+	}
+}
+
+// TestStoreEarlyCallback tests that a final state reported by a callback
+// before the sender recorded Sent is kept.
+func TestStoreEarlyCallback(t *testing.T) {
+	store := NewStore(10)
+	for _, final := range []State{Delivered, Expired, Undelivered, Failed} {
+		id := "msg-" + string(final)
+		store.Set(id, KindSMS, Sending, nil)
+		store.Advance(id, KindSMS, final, errors.New("carrier report"))
+		store.Set(id, KindSMS, Sent, nil)
+		if record, _ := store.Get(id); record.State != final || record.Error != "carrier report" {
+			t.Errorf("Expected %s to be kept, got %+v", final, record)
+		}
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	store := NewStore(2)
+	store.Set("a", KindSMS, Queued, nil)
+	store.Set("b", KindSMS, Queued, nil)
+	store.Set("c", KindEmail, Queued, nil)
+
+	if _, ok := store.Get("a"); ok {
+		t.Error("Expected oldest record to be evicted")
+	}
+	if _, ok := store.Get("c"); !ok {
+		t.Error("Expected newest record to be kept")
+	}
+}
+
+func TestHandleGetMessage(t *testing.T) {
+	store := NewStore(10)
+	store.Set("msg-1", KindEmail, Sent, nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		HandleGetMessage(w, r, store)
+	})
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/messages/msg-1", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	var record Record
+	if err := json.NewDecoder(rr.Body).Decode(&record); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if record.ID != "msg-1" || record.State != Sent {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/messages/unknown", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+// TestStoreAdvance tests that out-of-order updates are ignored.
+func TestStoreAdvance(t *testing.T) {
+	store := NewStore(10)
+	if !store.Advance("msg", KindSMS, Sent, nil) {
+		t.Error("Expected the first update to be recorded")
+	}
+	if !store.Advance("msg", KindSMS, Delivered, nil) {
+		t.Error("Expected delivered to be recorded after sent")
+	}
+	if store.Advance("msg", KindSMS, Sending, nil) {
+		t.Error("Expected sending to be ignored after delivered")
+	}
+	if record, _ := store.Get("msg"); record.State != Delivered {
+		t.Errorf("Expected delivered, got %s", record.State)
+	}
+}
@@ -0,0 +1,399 @@
+package templates
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+const templatesFile = "templates.json"
+
+var (
+	// ErrNotFound is returned for a template name that is not stored
+	ErrNotFound = errors.New("template not found")
+	// ErrInvalid is wrapped by the errors of templates that cannot be stored
+	// as given
+	ErrInvalid = errors.New("invalid template")
+
+	validName   = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	validLocale = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+)
+
+// Variant is the content of a template in one language. Subject and Text
+// use text/template, HTML uses html/template, so values are escaped there.
+// An SMS uses Text; an email uses Subject and Text and/or HTML.
+type Variant struct {
+	Subject string `json:"subject,omitempty"`
+	Text    string `json:"text,omitempty"`
+	HTML    string `json:"html,omitempty"`
+}
+
+// Template is a named message with variables. Its own parts are used when
+// none of its locale variants suits the recipient.
+type Template struct {
+	Name string `json:"name"`
+	Variant
+	Locales   map[string]Variant `json:"locales,omitempty"` // e.g. "nl", "en", "pt-br"
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// Rendered is a template with its variables filled in
+type Rendered struct {
+	Locale  string // Variant used; empty for the template's own parts
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Store keeps the templates, in a file if it has a directory
+type Store struct {
+	mu            sync.Mutex
+	templates     map[string]*Template
+	path          string // empty keeps the templates in memory only
+	defaultLocale string
+}
+
+// Open creates a store that keeps its templates in dir, loading those
+// saved before. An empty dir keeps them in memory only.
+func Open(dir string) (*Store, error) {
+	s := &Store{templates: make(map[string]*Template)}
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create template directory: %w", err)
+	}
+	s.path = filepath.Join(dir, templatesFile)
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read templates: %w", err)
+	}
+	if len(data) > 0 {
+		var templates []*Template
+		if err := json.Unmarshal(data, &templates); err != nil {
+			return nil, fmt.Errorf("failed to read templates: %w", err)
+		}
+		for _, t := range templates {
+			s.templates[t.Name] = t
+		}
+	}
+	return s, nil
+}
+
+// SetDefaultLocale configures the variant used when a template has none
+// for the recipient's locale
+func (s *Store) SetDefaultLocale(locale string) {
+	s.defaultLocale = NormalizeLocale(locale)
+}
+
+// Get returns the template called name
+func (s *Store) Get(name string) (Template, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.templates[name]
+	if !ok {
+		return Template{}, false
+	}
+	return *t, true
+}
+
+// List returns every template, sorted by name
+func (s *Store) List() []Template {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	templates := make([]Template, 0, len(s.templates))
+	for _, t := range s.templates {
+		templates = append(templates, *t)
+	}
+	sort.Slice(templates, func(a, b int) bool { return templates[a].Name < templates[b].Name })
+	return templates
+}
+
+// Put checks that a template parses and stores it, replacing any template
+// of the same name. It reports whether the template is new. Errors of
+// templates that fail the checks wrap ErrInvalid.
+func (s *Store) Put(t Template) (bool, error) {
+	locales, err := validate(t)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	t.Locales = locales
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, exists := s.templates[t.Name]
+	t.UpdatedAt = time.Now().UTC()
+	s.templates[t.Name] = &t
+	if err := s.save(); err != nil {
+		if exists {
+			s.templates[t.Name] = old
+		} else {
+			delete(s.templates, t.Name)
+		}
+		return false, err
+	}
+	return !exists, nil
+}
+
+// validate checks the name and parts of a template and returns its locale
+// variants keyed by normalized locale
+func validate(t Template) (map[string]Variant, error) {
+	if !validName.MatchString(t.Name) {
+		return nil, fmt.Errorf("name %q: use lowercase letters, digits, '-' and '_'", t.Name)
+	}
+	if t.Text == "" && t.HTML == "" && len(t.Locales) == 0 {
+		return nil, errors.New("needs a text or html part")
+	}
+	if _, err := parse(t.Variant); err != nil {
+		return nil, err
+	}
+	locales := make(map[string]Variant, len(t.Locales))
+	for locale, v := range t.Locales {
+		key := NormalizeLocale(locale)
+		if !validLocale.MatchString(key) {
+			return nil, fmt.Errorf("locale %q: use a language code such as \"nl\" or \"pt-BR\"", locale)
+		}
+		if v.Text == "" && v.HTML == "" {
+			return nil, fmt.Errorf("locale %s needs a text or html part", key)
+		}
+		if _, err := parse(v); err != nil {
+			return nil, fmt.Errorf("locale %s: %w", key, err)
+		}
+		locales[key] = v
+	}
+	return locales, nil
+}
+
+// Delete removes the template called name
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.templates[name]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.templates, name)
+	if err := s.save(); err != nil {
+		s.templates[name] = t
+		return err
+	}
+	return nil
+}
+
+// Render fills in the variant of the template called name that best
+// suits locale; see Template.Pick. A variable that the template uses but
+// vars does not define is an error.
+func (s *Store) Render(name, locale string, vars map[string]any) (Rendered, error) {
+	t, ok := s.Get(name)
+	if !ok {
+		return Rendered{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	chosen, v, ok := t.Pick(locale, s.defaultLocale)
+	if !ok {
+		return Rendered{}, fmt.Errorf("template %s has no variant for locale %q", name, locale)
+	}
+	rendered, err := render(v, vars)
+	if err != nil {
+		return Rendered{}, fmt.Errorf("template %s: %w", name, err)
+	}
+	rendered.Locale = chosen
+	return rendered, nil
+}
+
+// Pick chooses the variant for locale: the exact locale ("pt-br"), then
+// its language ("pt"), then the same for defaultLocale, and finally the
+// template's own parts. It returns the locale it chose, empty for the
+// template's own parts, and false if the template has nothing to send.
+func (t Template) Pick(locale, defaultLocale string) (string, Variant, bool) {
+	for _, candidate := range append(fallbacks(locale), fallbacks(defaultLocale)...) {
+		if v, ok := t.Locales[candidate]; ok {
+			return candidate, v, true
+		}
+	}
+	if t.Text != "" || t.HTML != "" {
+		return "", t.Variant, true
+	}
+	return "", Variant{}, false
+}
+
+// fallbacks lists locale and the less specific locales it belongs to, so
+// "zh-hant-tw" gives "zh-hant-tw", "zh-hant" and "zh"
+func fallbacks(locale string) []string {
+	locale = NormalizeLocale(locale)
+	var chain []string
+	for locale != "" {
+		chain = append(chain, locale)
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	return chain
+}
+
+// NormalizeLocale lowercases a locale and writes "pt_BR" as "pt-br"
+func NormalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// parsed holds the parsed parts of a template
+type parsed struct {
+	subject, text *texttemplate.Template
+	html          *htmltemplate.Template
+}
+
+func parse(t Variant) (*parsed, error) {
+	var p parsed
+	var err error
+	if p.subject, err = texttemplate.New("subject").Option("missingkey=error").Parse(t.Subject); err != nil {
+		return nil, fmt.Errorf("invalid subject template: %w", err)
+	}
+	if p.text, err = texttemplate.New("text").Option("missingkey=error").Parse(t.Text); err != nil {
+		return nil, fmt.Errorf("invalid text template: %w", err)
+	}
+	if p.html, err = htmltemplate.New("html").Option("missingkey=error").Parse(t.HTML); err != nil {
+		return nil, fmt.Errorf("invalid html template: %w", err)
+	}
+	return &p, nil
+}
+
+func render(t Variant, vars map[string]any) (Rendered, error) {
+	p, err := parse(t)
+	if err != nil {
+		return Rendered{}, err
+	}
+	if vars == nil {
+		vars = map[string]any{} // missingkey only applies to maps
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := p.subject.Execute(&subject, vars); err != nil {
+		return Rendered{}, err
+	}
+	if err := p.text.Execute(&text, vars); err != nil {
+		return Rendered{}, err
+	}
+	if err := p.html.Execute(&html, vars); err != nil {
+		return Rendered{}, err
+	}
+	return Rendered{Subject: subject.String(), Text: text.String(), HTML: html.String()}, nil
+}
+
+// ParseVars decodes the vars parameter of a request, a JSON object
+func ParseVars(value string) (map[string]any, error) {
+	vars := map[string]any{}
+	if value == "" {
+		return vars, nil
+	}
+	if err := json.Unmarshal([]byte(value), &vars); err != nil {
+		return nil, errors.New("vars must be a JSON object")
+	}
+	return vars, nil
+}
+
+// save atomically rewrites the template file. The caller must hold s.mu.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	templates := make([]*Template, 0, len(s.templates))
+	for _, t := range s.templates {
+		templates = append(templates, t)
+	}
+	sort.Slice(templates, func(a, b int) bool { return templates[a].Name < templates[b].Name })
+
+	data, err := json.MarshalIndent(templates, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to write templates: %w", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write templates: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to write templates: %w", err)
+	}
+	return nil
+}
+
+// HandleList writes every template as JSON
+func HandleList(w http.ResponseWriter, r *http.Request, store *Store) {
+	writeJSON(w, http.StatusOK, store.List())
+}
+
+// HandleGet writes the template named in the path as JSON
+func HandleGet(w http.ResponseWriter, r *http.Request, store *Store) {
+	t, ok := store.Get(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// HandlePut creates or replaces the template named in the path from a JSON
+// body with subject, text and html
+func HandlePut(w http.ResponseWriter, r *http.Request, store *Store) {
+	var t Template
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&t); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	t.Name = r.PathValue("name")
+	created, err := store.Put(t)
+	if err != nil {
+		if errors.Is(err, ErrInvalid) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to store template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	t, _ = store.Get(t.Name)
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	writeJSON(w, code, t)
+}
+
+// HandleDelete removes the template named in the path
+func HandleDelete(w http.ResponseWriter, r *http.Request, store *Store) {
+	if err := store.Delete(r.PathValue("name")); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to delete template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte("Template deleted\n"))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package templates
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestRender tests variable substitution, HTML escaping and missing variables.
+func TestRender(t *testing.T) {
+	store, err := Open("")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := store.Put(Template{Name: "welcome", Variant: Variant{
+		Subject: "Welcome, {{.name}}",
+		Text:    "Hi {{.name}}, your code is {{.code}}",
+		HTML:    "<p>Hi {{.name}}</p>",
+	}}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	rendered, err := store.Render("welcome", "", map[string]any{"name": "Ann & <Bob>", "code": 1234})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	want := Rendered{
+		Subject: "Welcome, Ann & <Bob>",
+		Text:    "Hi Ann & <Bob>, your code is 1234",
+		HTML:    "<p>Hi Ann &amp; &lt;Bob&gt;</p>",
+	}
+	if rendered != want {
+		t.Errorf("Expected %+v, got %+v", want, rendered)
+	}
+
+	if _, err := store.Render("welcome", "", map[string]any{"name": "Ann"}); err == nil || !strings.Contains(err.Error(), "code") {
+		t.Errorf("Expected an error naming the missing variable, got %v", err)
+	}
+	if _, err := store.Render("unknown", "", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+// TestPut tests template validation and replacement.
+func TestPut(t *testing.T) {
+	store, _ := Open("")
+	tests := []struct {
+		name     string
+		template Template
+	}{
+		{"invalid name", Template{Name: "Bad Name", Variant: Variant{Text: "Hi"}}},
+		{"no body", Template{Name: "empty", Variant: Variant{Subject: "Hi"}}},
+		{"syntax error", Template{Name: "broken", Variant: Variant{Text: "Hi {{.name"}}},
+	}
+	for _, tt := range tests {
+		if _, err := store.Put(tt.template); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: expected ErrInvalid, got %v", tt.name, err)
+		}
+	}
+
+	if created, err := store.Put(Template{Name: "otp", Variant: Variant{Text: "Code {{.code}}"}}); err != nil || !created {
+		t.Fatalf("Expected a new template, got %v, %v", created, err)
+	}
+	if created, err := store.Put(Template{Name: "otp", Variant: Variant{Text: "Your code: {{.code}}"}}); err != nil || created {
+		t.Fatalf("Expected the template to be replaced, got %v, %v", created, err)
+	}
+	if tmpl, _ := store.Get("otp"); tmpl.Text != "Your code: {{.code}}" {
+		t.Errorf("Unexpected template %+v", tmpl)
+	}
+}
+
+// TestStoreSurvivesRestart tests that templates are saved to and reloaded
+// from the directory.
+func TestStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, name := range []string{"b", "a", "c"} {
+		if _, err := store.Put(Template{Name: name, Variant: Variant{Text: "Hi"}}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := store.Delete("c"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := store.Delete("c"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	list := reopened.List()
+	if len(list) != 2 || list[0].Name != "a" || list[1].Name != "b" {
+		t.Errorf("Expected templates a and b after a restart, got %+v", list)
+	}
+}
+
+// TestRenderLocale tests the choice of locale variant and its fallbacks.
+func TestRenderLocale(t *testing.T) {
+	store, _ := Open("")
+	store.SetDefaultLocale("en")
+	if _, err := store.Put(Template{
+		Name:    "otp",
+		Variant: Variant{Text: "Code: {{.code}}"},
+		Locales: map[string]Variant{
+			"en":    {Text: "Your code is {{.code}}"},
+			"nl":    {Text: "Je code is {{.code}}"},
+			"pt_BR": {Text: "Seu código é {{.code}}"},
+		},
+	}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	tests := []struct {
+		locale, want, text string
+	}{
+		{"nl", "nl", "Je code is 42"},
+		{"nl-BE", "nl", "Je code is 42"},
+		{"pt-br", "pt-br", "Seu código é 42"},
+		{"pt", "en", "Your code is 42"},
+		{"de", "en", "Your code is 42"},
+		{"", "en", "Your code is 42"},
+	}
+	for _, tt := range tests {
+		rendered, err := store.Render("otp", tt.locale, map[string]any{"code": 42})
+		if err != nil {
+			t.Fatalf("Render(%q) failed: %v", tt.locale, err)
+		}
+		if rendered.Locale != tt.want || rendered.Text != tt.text {
+			t.Errorf("Render(%q) = %s %q, want %s %q", tt.locale, rendered.Locale, rendered.Text, tt.want, tt.text)
+		}
+	}
+
+	store.SetDefaultLocale("")
+	if rendered, _ := store.Render("otp", "de", map[string]any{"code": 42}); rendered.Locale != "" || rendered.Text != "Code: 42" {
+		t.Errorf("Expected the template's own parts, got %+v", rendered)
+	}
+
+	if _, err := store.Put(Template{Name: "bad", Locales: map[string]Variant{"dutch language": {Text: "Hoi"}}}); err == nil {
+		t.Error("Expected an invalid locale to be rejected")
+	}
+}
+
+// TestHandlePut tests that invalid templates are answered 400 and storage
+// failures 500.
+func TestHandlePut(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	put := func(name, body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/templates/"+name, strings.NewReader(body))
+		req.SetPathValue("name", name)
+		rr := httptest.NewRecorder()
+		HandlePut(rr, req, store)
+		return rr.Code
+	}
+
+	if code := put("otp", `{"text":"Code {{.code}}"}`); code != http.StatusCreated {
+		t.Errorf("Expected 201 for a new template, got %d", code)
+	}
+	if code := put("broken", `{"text":"Hi {{.name"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid template, got %d", code)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if code := put("welcome", `{"text":"Hi {{.name}}"}`); code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when the template cannot be saved, got %d", code)
+	}
+}